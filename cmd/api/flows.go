@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/metrics"
+)
+
+// A flow served by the application
+type hostedFlow struct {
+	flow    *flow.Flow
+	metrics *metrics.Collector // collects stage metrics from the flow's trace events
+	cancel  context.CancelFunc
+	done    chan struct{} // closed once the flow has stopped
+	err     error         // the error returned by the flow; only read once done is closed
+}
+
+// Summarizes a hosted flow for API responses
+type flowStatus struct {
+	ID       string
+	Running  bool
+	Error    string            // why the flow stopped, unless it was stopped by the application
+	Warnings []string          // problems with the flow's topology, such as incompatible port schemas
+	Buffers  []flow.ConnBuffer // statistics of the flow's buffered conns while it is running
+}
+
+// Describes a message that a stage is stuck on for API responses
+type stuckMsg struct {
+	Stage string
+	ID    string
+	Since time.Time
+}
+
+// Describes a stage failure for API responses
+type stageFailure struct {
+	Time   time.Time
+	Stage  string
+	Error  string
+	Action flow.FailureAction
+}
+
+func (h *hostedFlow) status() flowStatus {
+	s := flowStatus{ID: h.flow.ID(), Running: true, Warnings: h.flow.Warnings(), Buffers: h.flow.ConnBuffers()}
+	select {
+	case <-h.done:
+		s.Running = false
+		if h.err != nil && !errors.Is(h.err, context.Canceled) {
+			s.Error = h.err.Error()
+		}
+	default:
+	}
+	return s
+}
+
+// Starts serving a flow in the background, consuming its outputs and trace events.
+// Stage failures and stuck stages are logged as they are traced. Stage metrics
+// are collected from the trace events, so only flows with a trace channel report them.
+func (app *application) startFlow(f *flow.Flow) error {
+	app.flowsMu.Lock()
+	defer app.flowsMu.Unlock()
+
+	if _, ok := app.flows[f.ID()]; ok {
+		return fmt.Errorf("a flow with id %q already exists", f.ID())
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	h := &hostedFlow{flow: f, metrics: metrics.New(f.QueueDepths), cancel: cancel, done: make(chan struct{})}
+	app.flows[f.ID()] = h
+
+	logger := app.logger.With(slog.Group("flow", "id", f.ID()))
+	for _, w := range f.Warnings() {
+		logger.Warn("flow warning", "warning", w)
+	}
+	app.wg.Go(func() {
+		defer close(h.done)
+		h.err = f.Serve(ctx)
+		logger.Info("flow stopped", "error", h.err)
+	})
+	app.wg.Go(func() {
+		for {
+			select {
+			case m := <-f.Out():
+				logger.Debug("flow output", "id", m.ID, "stage", m.Stage, "port", m.Port)
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+	if dir, ok := app.checkpointDir(f.ID()); ok && app.config.checkpointInterval > 0 {
+		app.wg.Go(func() {
+			ticker := time.NewTicker(app.config.checkpointInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					cctx, ccancel := context.WithTimeout(ctx, app.config.checkpointInterval)
+					err := f.Checkpoint(cctx, dir)
+					ccancel()
+					if err != nil && ctx.Err() == nil {
+						logger.Warn("flow checkpoint failed", "error", err)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	if trace := f.Trace(); trace != nil {
+		app.wg.Go(func() {
+			for {
+				select {
+				case e := <-trace:
+					h.metrics.Observe(e)
+					switch e := e.(type) {
+					case flow.TraceStageFailure:
+						logger.Warn("stage failed", "stage", e.Stage, "action", e.Action, "error", e.Error)
+					case flow.TraceStageStuck:
+						logger.Warn("stage stuck on a message", "stage", e.Stage, "msg", e.ID, "since", e.Since)
+					}
+				case <-ctx.Done():
+					return
+				}
+			}
+		})
+	}
+	return nil
+}
+
+func (app *application) hostedFlow(id string) (*hostedFlow, bool) {
+	app.flowsMu.Lock()
+	defer app.flowsMu.Unlock()
+	h, ok := app.flows[id]
+	return h, ok
+}
+
+// Returns the hosted flows sorted by ID
+func (app *application) hostedFlows() []*hostedFlow {
+	app.flowsMu.Lock()
+	defer app.flowsMu.Unlock()
+	var hs []*hostedFlow
+	for _, h := range app.flows {
+		hs = append(hs, h)
+	}
+	slices.SortFunc(hs, func(a, b *hostedFlow) int { return strings.Compare(a.flow.ID(), b.flow.ID()) })
+	return hs
+}
+
+// Drains a running flow until the context is done or the flow stops on its own.
+func (h *hostedFlow) drain(ctx context.Context) (flow.DrainReport, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-h.done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return h.flow.Drain(ctx)
+}
+
+// Returns the directory for the checkpoints of the flow with the given ID, or false
+// if checkpoints are disabled or the ID cannot name a directory within the checkpoint directory.
+func (app *application) checkpointDir(id string) (string, bool) {
+	if app.config.checkpointDir == "" || !filepath.IsLocal(id) {
+		return "", false
+	}
+	return filepath.Join(app.config.checkpointDir, id), true
+}
+
+// Returns the options that resume the flow with the given ID from its checkpoint, if it has one.
+func (app *application) resumeOptions(id string) []flow.Option {
+	dir, ok := app.checkpointDir(id)
+	if !ok {
+		return nil
+	}
+	if _, err := os.Stat(filepath.Join(dir, flow.CheckpointFile)); err != nil {
+		return nil
+	}
+	app.logger.Info("resuming flow from checkpoint", slog.Group("flow", "id", id), "dir", dir)
+	return []flow.Option{flow.ResumeFrom(dir)}
+}
+
+// Drains every hosted flow for up to the drain timeout, so that messages in flight
+// are not lost, then stops the flows and waits for them to return. If checkpoints are
+// enabled, each flow is checkpointed before it stops, so that it resumes any unfinished
+// work and the state of its stages when it is created again.
+func (app *application) stopFlows() {
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.drainTimeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for _, h := range app.hostedFlows() {
+		wg.Go(func() {
+			defer func() {
+				h.cancel()
+				<-h.done
+			}()
+			select {
+			case <-h.done:
+				return
+			default:
+			}
+			logger := app.logger.With(slog.Group("flow", "id", h.flow.ID()))
+			report, err := h.drain(ctx)
+			if err != nil {
+				logger.Warn("flow drain incomplete", "queued", report.Queued, "unfinished", report.Unfinished, "error", err)
+			} else {
+				logger.Info("flow drained", "queued", report.Queued)
+			}
+			if dir, ok := app.checkpointDir(h.flow.ID()); ok {
+				cctx, ccancel := context.WithTimeout(context.Background(), app.config.drainTimeout)
+				defer ccancel()
+				if err := h.flow.Checkpoint(cctx, dir); err != nil {
+					logger.Warn("flow checkpoint failed", "error", err)
+				} else {
+					logger.Info("flow checkpointed", "dir", dir)
+				}
+			}
+		})
+	}
+	wg.Wait()
+}
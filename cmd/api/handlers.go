@@ -3,6 +3,10 @@ package main
 import (
 	"net/http"
 
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/metrics"
+	"datapotamus.com/internal/flow/spec"
+	"datapotamus.com/internal/request"
 	"datapotamus.com/internal/response"
 )
 
@@ -16,3 +20,116 @@ func (app *application) status(w http.ResponseWriter, r *http.Request) {
 		app.serverError(w, r, err)
 	}
 }
+
+func (app *application) stageKinds(w http.ResponseWriter, r *http.Request) {
+	err := response.JSON(w, http.StatusOK, app.registry.Kinds())
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) listFlows(w http.ResponseWriter, r *http.Request) {
+	statuses := []flowStatus{}
+	for _, h := range app.hostedFlows() {
+		statuses = append(statuses, h.status())
+	}
+
+	err := response.JSON(w, http.StatusOK, statuses)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) createFlow(w http.ResponseWriter, r *http.Request) {
+	var s spec.Flow
+	err := request.DecodeJSONStrict(w, r, &s)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	f, err := s.Build(app.pubsub, app.registry, app.resumeOptions(s.ID)...)
+	if err != nil {
+		app.badRequest(w, r, err)
+		return
+	}
+
+	err = app.startFlow(f)
+	if err != nil {
+		app.errorMessage(w, r, http.StatusConflict, err.Error(), nil)
+		return
+	}
+
+	h, _ := app.hostedFlow(f.ID())
+	err = response.JSON(w, http.StatusCreated, h.status())
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) showFlow(w http.ResponseWriter, r *http.Request) {
+	h, ok := app.hostedFlow(r.PathValue("id"))
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	err := response.JSON(w, http.StatusOK, h.status())
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) flowFailures(w http.ResponseWriter, r *http.Request) {
+	h, ok := app.hostedFlow(r.PathValue("id"))
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	failures := []stageFailure{}
+	for _, f := range h.flow.Failures() {
+		failures = append(failures, stageFailure{Time: f.Time, Stage: f.Stage, Error: f.Error.Error(), Action: f.Action})
+	}
+
+	err := response.JSON(w, http.StatusOK, failures)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) flowStuck(w http.ResponseWriter, r *http.Request) {
+	h, ok := app.hostedFlow(r.PathValue("id"))
+	if !ok {
+		app.notFound(w, r)
+		return
+	}
+
+	stuck := []stuckMsg{}
+	for _, m := range h.flow.Stuck() {
+		stuck = append(stuck, stuckMsg{Stage: m.Stage, ID: string(m.ID), Since: m.Since})
+	}
+
+	err := response.JSON(w, http.StatusOK, stuck)
+	if err != nil {
+		app.serverError(w, r, err)
+	}
+}
+
+func (app *application) metrics(w http.ResponseWriter, r *http.Request) {
+	flows := map[string]map[string]metrics.Stage{}
+	buffers := map[string][]flow.ConnBuffer{}
+	for _, h := range app.hostedFlows() {
+		flows[h.flow.ID()] = h.metrics.Snapshot()
+		buffers[h.flow.ID()] = h.flow.ConnBuffers()
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := metrics.WritePrometheus(w, flows)
+	if err == nil {
+		err = metrics.WriteConnBuffers(w, buffers)
+	}
+	if err != nil {
+		app.reportServerError(r, err)
+	}
+}
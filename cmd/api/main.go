@@ -7,20 +7,14 @@ import (
 	"os"
 	"runtime/debug"
 	"sync"
+	"time"
 
+	"datapotamus.com/internal/flow/pubsub"
+	"datapotamus.com/internal/flow/registry"
+	"datapotamus.com/internal/stages"
 	"datapotamus.com/internal/version"
 )
 
-// type DelayConfig struct {
-// 	// todo: assert positive duration via validator on the config
-// 	Millis int64 `json:"millis"`
-// }
-
-// func DelayFromConfig(id string, cfg DelayConfig) (*Delay, error) {
-// 	duration := time.Duration(cfg.Millis) * time.Millisecond
-// 	return NewDelay(id, duration, flow.DefaultStageChans()), nil
-// }
-
 func main() {
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug}))
 
@@ -33,14 +27,21 @@ func main() {
 }
 
 type config struct {
-	baseURL  string
-	httpPort int
+	baseURL            string
+	httpPort           int
+	drainTimeout       time.Duration
+	checkpointDir      string
+	checkpointInterval time.Duration
 }
 
 type application struct {
-	config config
-	logger *slog.Logger
-	wg     sync.WaitGroup
+	config   config
+	logger   *slog.Logger
+	registry *registry.Registry
+	pubsub   *pubsub.PubSub
+	flowsMu  sync.Mutex
+	flows    map[string]*hostedFlow
+	wg       sync.WaitGroup
 }
 
 func run(logger *slog.Logger) error {
@@ -48,6 +49,9 @@ func run(logger *slog.Logger) error {
 
 	flag.StringVar(&cfg.baseURL, "base-url", "http://localhost:3223", "base URL for the application")
 	flag.IntVar(&cfg.httpPort, "http-port", 3223, "port to listen on for HTTP requests")
+	flag.DurationVar(&cfg.drainTimeout, "drain-timeout", 30*time.Second, "time allowed for flows to finish their work in flight on shutdown")
+	flag.StringVar(&cfg.checkpointDir, "checkpoint-dir", "", "directory in which to checkpoint flows on shutdown and resume them when they are created again; disabled if empty")
+	flag.DurationVar(&cfg.checkpointInterval, "checkpoint-interval", 0, "how often to checkpoint running flows, if a checkpoint directory is set; disabled if zero")
 
 	showVersion := flag.Bool("version", false, "display version and exit")
 
@@ -59,8 +63,11 @@ func run(logger *slog.Logger) error {
 	}
 
 	app := &application{
-		config: cfg,
-		logger: logger,
+		config:   cfg,
+		logger:   logger,
+		registry: stages.NewRegistry(),
+		pubsub:   pubsub.NewPubSub(),
+		flows:    map[string]*hostedFlow{},
 	}
 
 	return app.serveHTTP()
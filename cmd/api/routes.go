@@ -8,6 +8,13 @@ func (app *application) routes() http.Handler {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("GET /status", app.status)
+	mux.HandleFunc("GET /metrics", app.metrics)
+	mux.HandleFunc("GET /stages/kinds", app.stageKinds)
+	mux.HandleFunc("GET /flows", app.listFlows)
+	mux.HandleFunc("POST /flows", app.createFlow)
+	mux.HandleFunc("GET /flows/{id}", app.showFlow)
+	mux.HandleFunc("GET /flows/{id}/failures", app.flowFailures)
+	mux.HandleFunc("GET /flows/{id}/stuck", app.flowStuck)
 
 	return app.recoverPanic(mux)
 }
@@ -56,6 +56,7 @@ func (app *application) serveHTTP() error {
 
 	app.logger.Info("stopped server", slog.Group("server", "addr", srv.Addr))
 
+	app.stopFlows()
 	app.wg.Wait()
 	return nil
 }
@@ -0,0 +1,62 @@
+// Command graph prints the topology of a flow spec as Graphviz DOT, Mermaid, or JSON.
+//
+//	graph [-format dot|mermaid|json] spec.json
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"datapotamus.com/internal/flow/pubsub"
+	"datapotamus.com/internal/flow/spec"
+	"datapotamus.com/internal/stages"
+)
+
+func main() {
+	if err := run(); err != nil {
+		fmt.Fprintln(os.Stderr, "graph:", err)
+		os.Exit(1)
+	}
+}
+
+func run() error {
+	format := flag.String("format", "dot", `output format: "dot", "mermaid", or "json"`)
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: graph [-format dot|mermaid|json] spec.json\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	fs, err := spec.ParseFile(flag.Arg(0))
+	if err != nil {
+		return err
+	}
+	f, err := fs.Build(pubsub.NewPubSub(), stages.NewRegistry())
+	if err != nil {
+		return err
+	}
+	for _, w := range f.Warnings() {
+		fmt.Fprintln(os.Stderr, "graph: warning:", w)
+	}
+	g := f.Graph()
+
+	switch *format {
+	case "dot":
+		fmt.Print(g.DOT())
+	case "mermaid":
+		fmt.Print(g.Mermaid())
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(g)
+	default:
+		return fmt.Errorf("unknown format %q", *format)
+	}
+	return nil
+}
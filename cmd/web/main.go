@@ -30,6 +30,7 @@ func main() {
 		flow.NewBase("flow1").WithInOut(0),
 		ps,
 		[]flow.Stage{s1, s2, s3},
+		[]flow.Conn{{From: msg.NewAddr("flow1", "in"), To: msg.NewAddr("s1", "in")}},
 		[]flow.Conn{
 			{From: msg.NewAddr("s1", "out"), To: msg.NewAddr("s2", "in")},
 			{From: msg.NewAddr("s2", "out"), To: msg.NewAddr("s3", "in")},
@@ -42,7 +43,7 @@ func main() {
 	ctx := context.Background()
 	super.ServeBackground(ctx) // returns err in a channel
 
-	f.In() <- msg.Msg{Data: []any{1, 2}}.To(msg.NewAddr("s1", "in"))
+	f.In() <- msg.Msg{Data: []any{1, 2}}.To(msg.NewAddr("flow1", "in"))
 
 	// note: I think we actually need to set up a bunch of the stuff in the constructor and therefore need to have a separate cleanup function just in case the flow never gets added to the supervisor.
 	// Because otherwise, just because it's serving doesn't mean that it's actually done the subscription work yet.
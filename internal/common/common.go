@@ -1,6 +1,13 @@
 package common
 
-import "github.com/oklog/ulid/v2"
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+
+	"github.com/oklog/ulid/v2"
+)
 
 func NewID() string {
 	return ulid.Make().String()
@@ -11,3 +18,16 @@ func Assert(cond bool, msg any) {
 		panic(msg)
 	}
 }
+
+// Decodes a single JSON value, rejecting unknown fields and trailing data.
+func DecodeJSONStrict(data []byte, dst any) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(dst); err != nil {
+		return err
+	}
+	if err := dec.Decode(&struct{}{}); !errors.Is(err, io.EOF) {
+		return errors.New("must only contain a single JSON value")
+	}
+	return nil
+}
@@ -0,0 +1,408 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/sublist"
+)
+
+// A Stateful stage saves its state in flow checkpoints and has it restored
+// when a flow resumes from a checkpoint (see Flow.Checkpoint and ResumeFrom).
+type Stateful interface {
+	// Returns the stage's state in an encoding of its choice. The flow calls it during a
+	// checkpoint once the stage has finished processing the messages delivered to it, but
+	// it may be called concurrently with Serve.
+	SaveState() ([]byte, error)
+	// Restores a state returned by SaveState. NewFlow calls it before the stage is served.
+	RestoreState(state []byte) error
+}
+
+// Name of the checkpoint file within a checkpoint directory
+const CheckpointFile = "checkpoint.json"
+
+// Version of the checkpoint format
+const checkpointVersion = 1
+
+// The saved in-flight state of a flow
+type checkpoint struct {
+	Version int         `json:"version"`
+	Flow    string      `json:"flow"`
+	Time    time.Time   `json:"time"`
+	Queued  []queuedMsg `json:"queued"`
+	// States of stateful stages by stage path, with one state for each instance
+	States map[string][][]byte `json:"states,omitempty"`
+}
+
+// A message on its way to a stage
+type queuedMsg struct {
+	Stage string   `json:"stage"` // path of the stage
+	From  msg.Addr `json:"from"`  // address that the message was published from
+	To    msg.Addr `json:"to"`
+	Msg   msg.Msg  `json:"msg"`
+}
+
+// Holds deliveries to stages while a checkpoint is taken. Shared by a serving flow and
+// the flows nested in it, so that deliveries are held throughout the outermost flow.
+type gate struct {
+	mu      sync.Mutex
+	closed  bool
+	held    []heldMsg      // in the order they were delivered
+	pending map[string]int // deliveries held or being completed, by stage path
+	idle    *sync.Cond     // signalled when a stage has no pending deliveries
+}
+
+func newGate() *gate {
+	g := &gate{pending: map[string]int{}}
+	g.idle = sync.NewCond(&g.mu)
+	return g
+}
+
+// A held delivery
+type heldMsg struct {
+	queuedMsg
+	deliver func() // completes the delivery once the gate opens
+}
+
+// Holds a delivery if the gate is closed, returning whether it was held.
+func (g *gate) hold(q queuedMsg, deliver func()) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.closed {
+		return false
+	}
+	g.held = append(g.held, heldMsg{q, deliver})
+	g.pending[q.Stage]++
+	return true
+}
+
+func (g *gate) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+}
+
+// Opens the gate and completes the held deliveries in order for each stage,
+// without waiting for them, since stages may not be ready to receive. The
+// deliveries are tracked by the WaitGroup.
+func (g *gate) open(wg *sync.WaitGroup) {
+	g.mu.Lock()
+	held := g.held
+	g.closed, g.held = false, nil
+	g.mu.Unlock()
+
+	byStage := map[string][]heldMsg{}
+	for _, h := range held {
+		byStage[h.Stage] = append(byStage[h.Stage], h)
+	}
+	for _, hs := range byStage {
+		wg.Go(func() {
+			for _, h := range hs {
+				h.deliver()
+				g.delivered(h.Stage)
+			}
+		})
+	}
+}
+
+// Records that a held delivery to the stage at the given path has been completed.
+func (g *gate) delivered(stage string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.pending[stage]--; g.pending[stage] == 0 {
+		delete(g.pending, stage)
+		g.idle.Broadcast()
+	}
+}
+
+// Waits until the held deliveries to the stage at the given path have been completed.
+func (g *gate) wait(stage string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.pending[stage] > 0 {
+		g.idle.Wait()
+	}
+}
+
+// Saves the flow's in-flight state to a checkpoint in the given directory, which can
+// be resumed by a flow created with the ResumeFrom option. Checkpoint must be called
+// while the flow is serving, and only on the outermost flow. The flow keeps running
+// once it returns.
+//
+// To take a consistent checkpoint, the flow stops taking input and holds deliveries to
+// its stages, including those of nested flows, until each stage has finished with the
+// messages already delivered to it or the context is done. The checkpoint then records
+// the held messages, with their tokens, and the state of each Stateful stage. Messages
+// left in the flow's In channel are not recorded, and message data must be encodable
+// as JSON.
+//
+// Like Drain, Checkpoint assumes that stages without a trace channel have finished
+// with each message once it is handed to them. Messages that stages send of their own
+// accord once the flow is idle are delivered after the checkpoint and not recorded.
+func (f *Flow) Checkpoint(ctx context.Context, dir string) error {
+	if f.path != "" {
+		return fmt.Errorf("flow %q: checkpoint: only the outermost flow can be checkpointed", f.ID())
+	}
+	resume := make(chan struct{})
+	select {
+	case f.pause <- resume:
+	case <-ctx.Done():
+		return fmt.Errorf("flow %q: checkpoint: %w", f.ID(), context.Cause(ctx))
+	}
+	defer close(resume)
+
+	f.mu.RLock()
+	c, g := f.inflight, f.gate
+	f.mu.RUnlock()
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		cp, ok, err := f.snapshot(c, g)
+		if err != nil {
+			return fmt.Errorf("flow %q: checkpoint: %w", f.ID(), err)
+		}
+		if ok {
+			if err := writeCheckpoint(dir, cp); err != nil {
+				return fmt.Errorf("flow %q: checkpoint: %w", f.ID(), err)
+			}
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("flow %q: checkpoint: %w", f.ID(), context.Cause(ctx))
+		}
+	}
+}
+
+// Returns a checkpoint of the flow if every unfinished delivery is held at the gate,
+// and otherwise reports that the flow is not yet idle.
+func (f *Flow) snapshot(c *inflight, g *gate) (checkpoint, bool, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	held := map[string]int{}
+	for _, h := range g.held {
+		held[h.Stage]++
+	}
+	if !maps.Equal(c.unfinished(), held) {
+		return checkpoint{}, false, nil
+	}
+	cp := checkpoint{Version: checkpointVersion, Flow: f.ID(), Time: time.Now(), Queued: []queuedMsg{}, States: map[string][][]byte{}}
+	for _, h := range g.held {
+		cp.Queued = append(cp.Queued, h.queuedMsg)
+	}
+	if err := f.saveStates(cp.States); err != nil {
+		return checkpoint{}, false, err
+	}
+	return cp, true, nil
+}
+
+// Adds the states of the flow's stateful stages, including those of nested flows, by path.
+func (f *Flow) saveStates(states map[string][][]byte) error {
+	f.mu.RLock()
+	stages := f.topo.stages()
+	f.mu.RUnlock()
+	for _, s := range stages {
+		insts := instances(s)
+		if nf, ok := asFlow(insts[0]); ok {
+			if err := nf.saveStates(states); err != nil {
+				return err
+			}
+			continue
+		}
+		var saved [][]byte
+		for _, inst := range insts {
+			var state []byte
+			if st, ok := inst.(Stateful); ok {
+				var err error
+				if state, err = st.SaveState(); err != nil {
+					return fmt.Errorf("stage %q: save state: %w", s.ID(), err)
+				}
+			}
+			saved = append(saved, state)
+		}
+		if slices.ContainsFunc(saved, func(state []byte) bool { return state != nil }) {
+			states[f.stagePath(s.ID())] = saved
+		}
+	}
+	return nil
+}
+
+// Writes the checkpoint file, replacing any previous checkpoint only once it is complete.
+func writeCheckpoint(dir string, cp checkpoint) error {
+	data, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, CheckpointFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filepath.Join(dir, CheckpointFile))
+}
+
+// Resumes the flow from the checkpoint in the given directory (see Flow.Checkpoint).
+// NewFlow restores the state of each Stateful stage, and Serve delivers the messages
+// that were on their way to stages when the checkpoint was taken. The flow must have
+// the ID of the checkpointed flow, and the stages that the checkpoint refers to.
+// Message data is restored as encoding/json decodes it, so numbers become float64.
+// If the directory has no checkpoint, NewFlow fails with an error wrapping fs.ErrNotExist.
+func ResumeFrom(dir string) Option {
+	return func(f *Flow) {
+		f.resumeDir = dir
+	}
+}
+
+// Loads the checkpoint in the directory, restoring the states of stateful stages
+// and queueing the checkpointed messages for delivery by the flows that own their stages.
+func (f *Flow) restore(dir string) error {
+	data, err := os.ReadFile(filepath.Join(dir, CheckpointFile))
+	if err != nil {
+		return err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return err
+	}
+	if cp.Version != checkpointVersion {
+		return fmt.Errorf("unsupported checkpoint version %d (expected %d)", cp.Version, checkpointVersion)
+	}
+	if cp.Flow != f.ID() {
+		return fmt.Errorf("checkpoint is for flow %q", cp.Flow)
+	}
+	for _, path := range slices.Sorted(maps.Keys(cp.States)) {
+		s, _, ok := f.findStage(path)
+		if !ok {
+			return fmt.Errorf("checkpoint has state for a missing stage %q", path)
+		}
+		insts, states := instances(s), cp.States[path]
+		if len(insts) != len(states) {
+			return fmt.Errorf("stage %q: checkpoint has state for %d instances, but the stage has %d", path, len(states), len(insts))
+		}
+		for i, inst := range insts {
+			st, ok := inst.(Stateful)
+			if !ok {
+				if states[i] != nil {
+					return fmt.Errorf("stage %q: checkpoint has state, but the stage is not stateful", path)
+				}
+				continue
+			}
+			if err := st.RestoreState(states[i]); err != nil {
+				return fmt.Errorf("stage %q: restore state: %w", path, err)
+			}
+		}
+	}
+	for _, q := range cp.Queued {
+		s, owner, ok := f.findStage(q.Stage)
+		if !ok || q.To.Stage != s.ID() || !s.Ports().HasIn(q.To.Port) {
+			return fmt.Errorf("checkpoint has a message for a missing stage input %q port %q", q.Stage, q.To.Port)
+		}
+		owner.resumed = append(owner.resumed, q)
+	}
+	return nil
+}
+
+// Returns the stage at the given path, which may be within nested flows,
+// together with the flow it belongs to.
+func (f *Flow) findStage(path string) (Stage, *Flow, bool) {
+	id, rest, nested := strings.Cut(path, "/")
+	s, ok := f.topo.stagesById[id]
+	if !ok || !nested {
+		return s, f, ok
+	}
+	nf, ok := asFlow(s)
+	if !ok {
+		return nil, nil, false
+	}
+	return nf.findStage(rest)
+}
+
+// Delivers the messages queued when the flow was checkpointed, in order for each stage,
+// first tracing their routes. Partitioned messages are delivered to the replica chosen by
+// their conn's partition, and others are spread over the replicas in turn. Must be called
+// with the write lock held while serving, after the stages have started.
+func (f *Flow) deliverResumed(queued []queuedMsg) {
+	r, c := f.run, f.inflight
+	var ids []msg.ID
+	routes := map[msg.ID]int{}
+	byStage := map[string][]queuedMsg{}
+	for _, q := range queued {
+		if routes[q.Msg.ID] == 0 {
+			ids = append(ids, q.Msg.ID)
+		}
+		routes[q.Msg.ID]++
+		byStage[q.To.Stage] = append(byStage[q.To.Stage], q)
+		c.add(q.Stage, 1)
+	}
+	conns := slices.Concat(f.topo.inputConns, f.topo.stageConns)
+	type delivery struct {
+		ctx   context.Context
+		insts []Stage
+		qs    []queuedMsg
+	}
+	var deliveries []delivery
+	for id, qs := range byStage {
+		deliveries = append(deliveries, delivery{r.stages[id].ctx, instances(f.topo.stagesById[id]), qs})
+	}
+
+	r.wg.Go(func() {
+		for _, id := range ids {
+			f.trace(r.ctx, TraceRoute{time.Now(), id, routes[id]})
+		}
+		for _, d := range deliveries {
+			r.wg.Go(func() {
+				for i, q := range d.qs {
+					inst := d.insts[i%len(d.insts)]
+					if p := partitionFor(conns, f.ID(), q); p != nil {
+						if key, err := p.Key(q.Msg); err == nil {
+							inst = d.insts[p.replica(key, len(d.insts))]
+						}
+					}
+					select {
+					case inst.In() <- q.Msg.To(q.To):
+						if _, ok := asFlow(inst); !ok && inst.Trace() == nil {
+							c.add(q.Stage, -1)
+						}
+					case <-d.ctx.Done():
+						f.dropped(r, q.To.Stage, q.Msg.ID, fmt.Errorf("flow %q: resumed delivery to %v: %w", f.ID(), q.To, context.Cause(d.ctx)))
+					}
+				}
+			})
+		}
+	})
+}
+
+// Returns the partition of the conn that a queued message was delivered along, if any.
+func partitionFor(conns []Conn, flowID string, q queuedMsg) *Partition {
+	for _, conn := range conns {
+		if conn.To == q.To && conn.Partition != nil &&
+			sublist.SubjectMatchesFilter(subjectFor(flowID, q.From), subjectFor(flowID, conn.From)) {
+			return conn.Partition
+		}
+	}
+	return nil
+}
@@ -0,0 +1,189 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"datapotamus.com/internal/flow/token"
+	"github.com/thejerf/suture/v4"
+)
+
+// A stateful passthrough stage that counts the messages it has processed
+type counter struct {
+	Base
+	mu sync.Mutex
+	n  int
+}
+
+func newCounter(id string) *counter {
+	return &counter{Base: *NewBase(id).WithInOut(0).WithTrace(0).WithPorts(passthroughPorts)}
+}
+
+func (s *counter) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+func (s *counter) SaveState() ([]byte, error) {
+	return []byte(strconv.Itoa(s.count())), nil
+}
+
+func (s *counter) RestoreState(state []byte) error {
+	n, err := strconv.Atoi(string(state))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.n = n
+	return err
+}
+
+func (s *counter) Serve(ctx context.Context) error {
+	for {
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceRecv(m.ID)
+			s.mu.Lock()
+			s.n++
+			s.mu.Unlock()
+			s.TraceSend("out", m.Msg, m.Data)
+			s.TraceSuccess(m.ID)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Returns a flow that passes its input through a slow stage to a counter
+func newCheckpointFlow(t *testing.T, id string, opts ...Option) (*Flow, *counter) {
+	t.Helper()
+	a := msg.NewAddr
+	c := newCounter("s2")
+	f, err := NewFlow(NewBase(id).WithInOut(0), pubsub.NewPubSub(),
+		[]Stage{newSlow("s1", 20*time.Millisecond), c},
+		[]Conn{{From: a(id, "in"), To: a("s1", "in"), Buffer: 10}},
+		[]Conn{{From: a("s1", "out"), To: a("s2", "in")}},
+		[]Conn{{From: a("s2", "out"), To: a(id, "out")}},
+		opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, c
+}
+
+func TestCheckpointAndResume(t *testing.T) {
+	dir := t.TempDir()
+
+	// Checkpoint a flow partway through its input, then stop it
+	f, _ := newCheckpointFlow(t, "f")
+	ctx, cancel := context.WithCancel(t.Context())
+	go f.Serve(ctx)
+	for i := range 5 {
+		f.In() <- msg.New(i).MergeTokens(token.Tokens{"t": 1}).To(msg.NewAddr("f", "in"))
+	}
+	<-f.Out()
+	go func() {
+		for range f.Out() {
+		}
+	}()
+	cctx, ccancel := context.WithTimeout(t.Context(), time.Second)
+	defer ccancel()
+	if err := f.Checkpoint(cctx, dir); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+
+	// The resumed flow processes the rest, and its counter continues from the checkpoint
+	resumed, c := newCheckpointFlow(t, "f", ResumeFrom(dir))
+	go resumed.Serve(t.Context())
+	timeout := time.After(time.Second)
+	for c.count() < 5 {
+		select {
+		case m := <-resumed.Out():
+			if m.Tokens["t"] != 1 {
+				t.Errorf("got tokens %v, want the checkpointed tokens", m.Tokens)
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for the resumed flow; counted %d messages, want 5", c.count())
+		}
+	}
+}
+
+func TestResumeErrors(t *testing.T) {
+	dir := t.TempDir()
+	f, _ := newCheckpointFlow(t, "f")
+	go f.Serve(t.Context())
+	cctx, ccancel := context.WithTimeout(t.Context(), time.Second)
+	defer ccancel()
+	if err := f.Checkpoint(cctx, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := NewFlow(NewBase("g").WithInOut(0), pubsub.NewPubSub(), nil, nil, nil, nil, ResumeFrom(dir))
+	if err == nil || !strings.Contains(err.Error(), `checkpoint is for flow "f"`) {
+		t.Errorf("got error %v, want one about the flow ID", err)
+	}
+	_, err = NewFlow(NewBase("f").WithInOut(0), pubsub.NewPubSub(), nil, nil, nil, nil, ResumeFrom(t.TempDir()))
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v, want one wrapping fs.ErrNotExist", err)
+	}
+}
+
+func TestPipelineCompletesHeldDeliveries(t *testing.T) {
+	// A delivery held during a checkpoint is completed before the input of
+	// its stage is closed, even if the pipeline's input closes right away.
+	for range 20 {
+		a := msg.NewAddr
+		p, err := NewPipeline(NewBase("p").WithInOut(0), pubsub.NewPubSub(),
+			[]Stage{newSlow("s1", 10*time.Millisecond), newCounter("s2")},
+			[]Conn{{From: a("p", "in"), To: a("s1", "in"), Buffer: 10}},
+			[]Conn{{From: a("s1", "out"), To: a("s2", "in")}},
+			[]Conn{{From: a("s2", "out"), To: a("p", "out")}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errCh := make(chan error, 1)
+		go func() { errCh <- p.Serve(t.Context()) }()
+		p.In() <- msg.New(1).To(a("p", "in"))
+
+		cctx, ccancel := context.WithTimeout(t.Context(), time.Second)
+		err = p.Checkpoint(cctx, t.TempDir())
+		ccancel()
+		if err != nil {
+			t.Fatal(err)
+		}
+		close(p.In())
+
+		count := 0
+		timeout := time.After(time.Second)
+	loop:
+		for {
+			select {
+			case _, ok := <-p.Out():
+				if !ok {
+					break loop
+				}
+				count++
+			case <-timeout:
+				t.Fatalf("timeout waiting for the pipeline to close its output after %d messages", count)
+			}
+		}
+		if count != 1 {
+			t.Errorf("got %d outputs, want 1", count)
+		}
+		if err := <-errCh; !errors.Is(err, suture.ErrDoNotRestart) {
+			t.Errorf("got Serve error %v, want ErrDoNotRestart", err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+)
+
+// The error with which a stage built on Base fails a message that it does not finish
+// processing within its deadline (see Base.WithDeadline). It wraps context.DeadlineExceeded.
+var ErrDeadlineExceeded = fmt.Errorf("message processing deadline exceeded: %w", context.DeadlineExceeded)
+
+// Sets a deadline for processing each message, measured from its receipt. A message
+// received with TraceRecvContext that has no outcome once its deadline passes is failed
+// on the stage's behalf with an error wrapping ErrDeadlineExceeded: it is sent on the
+// error port and traced as a failure. Whatever the stage later sends or traces for the
+// message is discarded, so that the message has a single outcome. The stage should still
+// trace an outcome for the message, which is discarded too, since the stage remembers
+// the failure until then. A deadline of zero disables it.
+func (s *Base) WithDeadline(d time.Duration) *Base {
+	s.deadline = d
+	s.processing = &processing{msgs: map[msg.ID]*processingMsg{}, expired: map[msg.ID]bool{}}
+	return s
+}
+
+// Returns the stage's per-message processing deadline, or zero if it has none.
+func (s *Base) Deadline() time.Duration {
+	return s.deadline
+}
+
+// Messages being processed by a stage with a deadline, by ID
+type processing struct {
+	mu      sync.Mutex
+	msgs    map[msg.ID]*processingMsg
+	expired map[msg.ID]bool // messages failed at their deadline whose outcome the stage has not traced
+}
+
+// A message being processed by a stage with a deadline. Its lock is held while the
+// message's sends and outcome are traced, so that they are not interleaved with its
+// failure at the deadline.
+type processingMsg struct {
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	done    bool // the stage traced the outcome of the message
+	expired bool // the message was failed at its deadline
+}
+
+// Returns the message with the given ID if it is being processed, and whether it was
+// failed at its deadline.
+func (p *processing) get(id msg.ID) (*processingMsg, bool) {
+	if p == nil {
+		return nil, false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.msgs[id], p.expired[id]
+}
+
+func (p *processing) set(id msg.ID, pm *processingMsg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.msgs[id] = pm
+}
+
+// Removes the message with the given ID if it is pm, or any message if pm is nil,
+// and returns the removed message.
+func (p *processing) remove(id msg.ID, pm *processingMsg) *processingMsg {
+	if p == nil {
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	cur := p.msgs[id]
+	if cur == nil || (pm != nil && cur != pm) {
+		return nil
+	}
+	delete(p.msgs, id)
+	return cur
+}
+
+// Removes the message with the given ID, which was failed at its deadline, and
+// remembers the failure until the stage traces the message's outcome.
+func (p *processing) expire(id msg.ID, pm *processingMsg) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.msgs[id] == pm {
+		delete(p.msgs, id)
+		p.expired[id] = true
+	}
+}
+
+// Forgets the failure of the message with the given ID at its deadline, and
+// returns whether it was failed.
+func (p *processing) forget(id msg.ID) bool {
+	if p == nil {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	expired := p.expired[id]
+	delete(p.expired, id)
+	return expired
+}
+
+// Traces the receipt of a message like TraceRecv, and returns a context for processing
+// it. If the stage has a deadline, the context is done once the deadline passes or the
+// stage traces the message's outcome, and its cause then wraps ErrDeadlineExceeded or
+// is context.Canceled. Otherwise, the given context is returned.
+func (s *Base) TraceRecvContext(ctx context.Context, m msg.Msg) context.Context {
+	s.TraceRecv(m.ID)
+	if s.deadline <= 0 {
+		return ctx
+	}
+	err := fmt.Errorf("stage %q: %w after %v", s.id, ErrDeadlineExceeded, s.deadline)
+	mctx, cancel := context.WithTimeoutCause(ctx, s.deadline, err)
+	pm := &processingMsg{cancel: cancel}
+	s.processing.set(m.ID, pm)
+	context.AfterFunc(mctx, func() {
+		if errors.Is(context.Cause(mctx), ErrDeadlineExceeded) {
+			s.expire(m, pm, context.Cause(mctx))
+		} else if ctx.Err() != nil {
+			// The stage is stopping, so it will not trace the outcome.
+			s.processing.remove(m.ID, pm)
+		}
+	})
+	return mctx
+}
+
+// Fails a message at its deadline unless the stage has traced its outcome.
+func (s *Base) expire(m msg.Msg, pm *processingMsg, err error) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.done {
+		return
+	}
+	pm.expired = true
+	s.send(ErrorPort, m, FailedMsg{m, err, s.id, 1})
+	s.traceFailure(m.ID, err)
+	s.processing.expire(m.ID, pm)
+}
+
+// Traces the outcome of the message with the given ID by calling trace, unless the
+// message was failed at its deadline.
+func (s *Base) finish(id msg.ID, trace func()) {
+	pm := s.processing.remove(id, nil)
+	if pm == nil {
+		if !s.processing.forget(id) {
+			trace()
+		}
+		return
+	}
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	if pm.expired {
+		return
+	}
+	pm.done = true
+	pm.cancel()
+	trace()
+}
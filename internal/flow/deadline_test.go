@@ -0,0 +1,113 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"github.com/thejerf/suture/v4"
+)
+
+// A passthrough stage that holds each message until it is released, ignoring its
+// deadline, and then reports the cause of the message's context
+type hang struct {
+	Base
+	release chan struct{}
+	causes  chan error
+}
+
+func (s *hang) Serve(ctx context.Context) error {
+	for {
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			mctx := s.TraceRecvContext(ctx, m.Msg)
+			<-s.release
+			s.causes <- context.Cause(mctx)
+			s.TraceSend("out", m.Msg, m.Data)
+			s.TraceSuccess(m.ID)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestDeadlineFailsMessage(t *testing.T) {
+	a := msg.NewAddr
+	s := &hang{*NewBase("s1").WithInOut(0).WithTrace(0).WithDeadline(20 * time.Millisecond).WithPorts(passthroughPorts), make(chan struct{}), make(chan error, 1)}
+	f, err := NewFlow(NewBase("f").WithInOut(10).WithTrace(100), pubsub.NewPubSub(), []Stage{s},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in")}},
+		nil,
+		[]Conn{SelfConn(a("s1", "out")), SelfConn(a("s1", ErrorPort))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Serve(t.Context())
+
+	in := msg.New("x")
+	f.In() <- in.To(a("f", "in"))
+	if e := nextTrace[TraceFailure](t, f); e.ID != in.ID || e.Stage != "s1" || !errors.Is(e.Error, ErrDeadlineExceeded) {
+		t.Errorf("got failure %+v, want a deadline failure of the input at s1", e)
+	}
+	select {
+	case m := <-f.Out():
+		if failed, ok := m.Data.(FailedMsg); m.Port != ErrorPort || !ok || !errors.Is(failed.Error, context.DeadlineExceeded) {
+			t.Errorf("got %v on port %q, want a deadline error on the error port", m.Data, m.Port)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the error output")
+	}
+
+	// Whatever the stage does with the message after its deadline is discarded
+	close(s.release)
+	if err := <-s.causes; !errors.Is(err, ErrDeadlineExceeded) {
+		t.Errorf("got message context cause %v, want ErrDeadlineExceeded", err)
+	}
+	select {
+	case m := <-f.Out():
+		t.Errorf("unexpected output %v on port %q", m.Data, m.Port)
+	case <-time.After(50 * time.Millisecond):
+	}
+	for range len(f.Trace()) {
+		if e, ok := (<-f.Trace()).(TraceSuccess); ok && e.ID == in.ID {
+			t.Error("traced the success of a message that failed at its deadline")
+		}
+	}
+}
+
+func TestDeadlineForgetsExpiredMessages(t *testing.T) {
+	s := &hang{*NewBase("s1").WithInOut(0).WithDeadline(10 * time.Millisecond).WithPorts(passthroughPorts), make(chan struct{}), make(chan error, 1)}
+	go s.Serve(t.Context())
+	s.In() <- msg.New("x").To(msg.NewAddr("s1", "in"))
+	if m := <-s.Out(); m.Port != ErrorPort {
+		t.Fatalf("got %v on port %q, want a deadline error on the error port", m.Data, m.Port)
+	}
+
+	// The failure is remembered until the stage traces the message's outcome
+	waitFor := func(wantMsgs, wantExpired int) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for {
+			s.processing.mu.Lock()
+			msgs, expired := len(s.processing.msgs), len(s.processing.expired)
+			s.processing.mu.Unlock()
+			if msgs == wantMsgs && expired == wantExpired {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("got %d messages being processed and %d expired, want %d and %d", msgs, expired, wantMsgs, wantExpired)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(0, 1)
+	close(s.release)
+	<-s.causes
+	waitFor(0, 0)
+}
@@ -0,0 +1,171 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+)
+
+// Counts the work in flight in a serving flow, and is shared with the flows nested in it
+// so that messages are accounted for as they cross between them.
+//
+// A delivery to a stage is in flight until the stage traces its outcome or, if the stage
+// has no trace channel, until the message is handed to it. A message that a stage traces
+// as sent is in flight until the flow publishes it, which covers the time between the
+// stage tracing the outcome of its input and the flow receiving its outputs. A message
+// sent to the output of a nested flow is in flight until the parent flow publishes it.
+type inflight struct {
+	mu         sync.Mutex
+	deliveries map[string]int        // Unresolved deliveries, by stage path
+	sent       map[msg.ID]sentMsg    // Messages traced as sent but not yet published, by ID
+	received   map[receivedMsg]*recv // Messages traced as received without an outcome
+}
+
+// A message sent by a stage. The count is negative if the flow published the
+// message before the stage's trace event for it was observed.
+type sentMsg struct {
+	stage string
+	n     int
+}
+
+func newInflight() *inflight {
+	return &inflight{deliveries: map[string]int{}, sent: map[msg.ID]sentMsg{}, received: map[receivedMsg]*recv{}}
+}
+
+// Adds n deliveries to the stage at the given path, which may be negative.
+func (c *inflight) add(stage string, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deliveries[stage] += n
+	if c.deliveries[stage] == 0 {
+		delete(c.deliveries, stage)
+	}
+}
+
+// Records that a stage traced a message as sent, or that the flow published it.
+func (c *inflight) send(stage string, id msg.ID, n int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := c.sent[id]
+	s.stage, s.n = stage, s.n+n
+	if s.n == 0 {
+		delete(c.sent, id)
+	} else {
+		c.sent[id] = s
+	}
+}
+
+// Updates the counts from a trace event of the stage at the given path.
+func (c *inflight) observe(stage string, e TraceEvent) {
+	switch e := e.(type) {
+	case TraceSendFrom:
+		c.send(stage, e.Msg.ID, 1)
+	case TraceRecv:
+		c.recv(stage, e.ID, e.Time)
+	case TraceSuccess:
+		c.add(stage, -1)
+		c.finish(stage, e.ID)
+	case TraceFailure:
+		c.add(stage, -1)
+		c.finish(stage, e.ID)
+	}
+}
+
+// Returns the work in flight, by stage path, which is empty if the flow is idle.
+func (c *inflight) unfinished() map[string]int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := map[string]int{}
+	for stage, n := range c.deliveries {
+		if n > 0 {
+			m[stage] += n
+		}
+	}
+	for _, s := range c.sent {
+		if s.n > 0 {
+			m[s.stage] += s.n
+		}
+	}
+	return m
+}
+
+// Summarizes the work a flow left unfinished when it was drained
+type DrainReport struct {
+	// Number of messages left in the flow's In channel
+	Queued int
+	// Deliveries to stages that did not finish, together with messages sent by stages that
+	// the flow did not publish, by stage. Stages of nested flows are keyed by their path
+	// within the flow, such as "nested/stage".
+	Unfinished map[string]int
+}
+
+// How often Drain and Checkpoint check whether the flow is idle
+const drainPollInterval = 10 * time.Millisecond
+
+// Stops taking input and waits until the messages in flight have finished or the
+// context is done, returning the work left unfinished along with the context's error.
+// Drain must be called while the flow is serving. Cancel the context passed to Serve
+// once Drain returns to stop the flow.
+//
+// A flow is idle once every delivery to its stages has an outcome and every message
+// sent by its stages has been published, so stages that produce messages of their own
+// keep the flow from draining. Stages without a trace channel are assumed to have
+// finished with each message once it is handed to them.
+func (f *Flow) Drain(ctx context.Context) (DrainReport, error) {
+	select {
+	case f.drain <- struct{}{}:
+	case <-ctx.Done():
+		return DrainReport{Queued: len(f.Ch.In)}, fmt.Errorf("flow %q: drain: %w", f.ID(), context.Cause(ctx))
+	}
+
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for {
+		f.mu.RLock()
+		c := f.inflight
+		f.mu.RUnlock()
+		var unfinished map[string]int
+		if c != nil {
+			unfinished = c.unfinished()
+		}
+		report := DrainReport{Queued: len(f.Ch.In), Unfinished: unfinished}
+		if len(unfinished) == 0 {
+			return report, nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return report, fmt.Errorf("flow %q: drain: %w", f.ID(), context.Cause(ctx))
+		}
+	}
+}
+
+// Returns the flow underlying a stage if it is a flow or pipeline.
+func asFlow(s Stage) (*Flow, bool) {
+	switch s := s.(type) {
+	case *Flow:
+		return s, true
+	case *Pipeline:
+		return s.Flow, true
+	}
+	return nil, false
+}
+
+// Makes a nested flow share the in-flight counts and delivery gate of its parent,
+// under the given path of the nested flow within the parent.
+func (f *Flow) attach(c *inflight, g *gate, path string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.inflight, f.gate, f.path = c, g, path
+}
+
+// Returns the path of the stage with the given ID within the outermost flow
+func (f *Flow) stagePath(id string) string {
+	if f.path == "" {
+		return id
+	}
+	return f.path + "/" + id
+}
@@ -0,0 +1,138 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"github.com/thejerf/suture/v4"
+)
+
+// A passthrough stage that takes the given time to process each message
+type slow struct {
+	Base
+	d time.Duration
+}
+
+func newSlow(id string, d time.Duration) *slow {
+	return &slow{*NewBase(id).WithInOut(0).WithTrace(0).WithPorts(passthroughPorts), d}
+}
+
+func (s *slow) Serve(ctx context.Context) error {
+	for {
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceRecv(m.ID)
+			select {
+			case <-time.After(s.d):
+			case <-ctx.Done():
+				return nil
+			}
+			s.TraceSend("out", m.Msg, m.Data)
+			s.TraceSuccess(m.ID)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Serves the flow, sends it n inputs, and drains it with the given timeout,
+// returning the report, the number of outputs received before the drain returned, and its error.
+func drain(t *testing.T, f *Flow, n int, timeout time.Duration) (DrainReport, int, error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(t.Context())
+	defer cancel()
+	go f.Serve(ctx)
+	outputs := make(chan int)
+	go func() {
+		count := 0
+		for {
+			select {
+			case <-f.Out():
+				count++
+			case outputs <- count:
+				return
+			}
+		}
+	}()
+	for i := range n {
+		f.In() <- msg.New(i).To(msg.NewAddr(f.ID(), "in"))
+	}
+
+	dctx, dcancel := context.WithTimeout(t.Context(), timeout)
+	defer dcancel()
+	report, err := f.Drain(dctx)
+	return report, <-outputs, err
+}
+
+func TestDrainFinishesWorkInFlight(t *testing.T) {
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0), pubsub.NewPubSub(),
+		[]Stage{newSlow("s1", 10*time.Millisecond), newSlow("s2", 10*time.Millisecond)},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in"), Buffer: 10}},
+		[]Conn{{From: a("s1", "out"), To: a("s2", "in")}},
+		[]Conn{{From: a("s2", "out"), To: a("f", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, outputs, err := drain(t, f, 5, time.Second)
+	if err != nil || len(report.Unfinished) != 0 {
+		t.Errorf("unexpected drain result %+v, %v", report, err)
+	}
+	if outputs != 5 {
+		t.Errorf("got %d outputs before the drain finished, want 5", outputs)
+	}
+}
+
+func TestDrainWaitsForNestedFlows(t *testing.T) {
+	a := msg.NewAddr
+	ps := pubsub.NewPubSub()
+	inner, err := NewFlow(NewBase("inner").WithInOut(0), ps, []Stage{newSlow("s1", 10*time.Millisecond)},
+		[]Conn{{From: a("inner", "in"), To: a("s1", "in")}},
+		nil,
+		[]Conn{{From: a("s1", "out"), To: a("inner", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, err := NewFlow(NewBase("outer").WithInOut(0), ps, []Stage{inner, newSlow("s2", 10*time.Millisecond)},
+		[]Conn{{From: a("outer", "in"), To: a("inner", "in")}},
+		[]Conn{{From: a("inner", "out"), To: a("s2", "in")}},
+		[]Conn{{From: a("s2", "out"), To: a("outer", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, outputs, err := drain(t, outer, 3, time.Second)
+	if err != nil || len(report.Unfinished) != 0 {
+		t.Errorf("unexpected drain result %+v, %v", report, err)
+	}
+	if outputs != 3 {
+		t.Errorf("got %d outputs before the drain finished, want 3", outputs)
+	}
+}
+
+func TestDrainReportsUnfinishedWork(t *testing.T) {
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0), pubsub.NewPubSub(),
+		[]Stage{newSlow("s1", time.Hour)},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in"), Buffer: 10}},
+		nil,
+		[]Conn{{From: a("s1", "out"), To: a("f", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, _, err := drain(t, f, 3, 50*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("got error %v, want a deadline error", err)
+	}
+	if want := map[string]int{"s1": 3}; !maps.Equal(report.Unfinished, want) {
+		t.Errorf("got unfinished work %v, want %v", report.Unfinished, want)
+	}
+}
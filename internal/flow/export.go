@@ -0,0 +1,349 @@
+package flow
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"datapotamus.com/internal/flow/msg"
+)
+
+// A Graph describes the topology of a flow for people, such as in design reviews
+// and generated documentation. It encodes as JSON, and can be drawn with Graphviz
+// (see Graph.DOT) or Mermaid (see Graph.Mermaid).
+type Graph struct {
+	ID     string       `json:"id"`
+	Ports  Ports        `json:"ports"`
+	Stages []GraphStage `json:"stages"`
+	Conns  []GraphConn  `json:"conns"`
+}
+
+// Describes a stage of a flow graph
+type GraphStage struct {
+	ID string `json:"id"`
+	Description
+	Replicas int    `json:"replicas,omitempty"` // number of replicas, if the stage is replicated
+	Ports    Ports  `json:"ports"`
+	Flow     *Graph `json:"flow,omitempty"` // graph of a nested flow
+}
+
+// Identifies which of a flow's conns a graph conn comes from
+type ConnKind string
+
+const (
+	InputConn ConnKind = "input" // from a flow input port to a stage
+	StageConn ConnKind = "stage" // between stages
+	FlowConn  ConnKind = "flow"  // from a stage to a flow output port
+)
+
+// Describes a conn of a flow graph
+type GraphConn struct {
+	Kind ConnKind `json:"kind"`
+	From msg.Addr `json:"from"`
+	To   msg.Addr `json:"to"`
+	// The conn's edges, with any wildcards resolved to the stage ports they match
+	Edges     []GraphEdge `json:"edges"`
+	Buffer    int         `json:"buffer,omitempty"`
+	Overflow  string      `json:"overflow,omitempty"`  // set for buffered conns
+	Partition string      `json:"partition,omitempty"` // description of the partition, if any
+	// Set for feedback conns, which may close cycles
+	Feedback      bool `json:"feedback,omitempty"`
+	MaxIterations int  `json:"maxIterations,omitempty"`
+}
+
+// A connection between two concrete addresses
+type GraphEdge struct {
+	From msg.Addr `json:"from"`
+	To   msg.Addr `json:"to"`
+}
+
+// Returns the graph of the flow's current topology, including any nested flows.
+func (f *Flow) Graph() Graph {
+	f.mu.RLock()
+	t := f.topo
+	f.mu.RUnlock()
+
+	g := Graph{ID: t.id, Ports: t.ports}
+	for _, s := range t.stages() {
+		insts := instances(s)
+		gs := GraphStage{ID: s.ID(), Description: describe(insts[0]), Ports: s.Ports()}
+		if len(insts) > 1 {
+			gs.Replicas = len(insts)
+		}
+		if nf, ok := asFlow(insts[0]); ok {
+			ng := nf.Graph()
+			gs.Flow = &ng
+		}
+		g.Stages = append(g.Stages, gs)
+	}
+	for _, conn := range t.inputConns {
+		g.Conns = append(g.Conns, graphConn(InputConn, conn, []GraphEdge{{conn.From, conn.To}}))
+	}
+	for _, conn := range t.stageConns {
+		var edges []GraphEdge
+		for _, from := range t.sources(conn.From) {
+			edges = append(edges, GraphEdge{from, conn.To})
+		}
+		g.Conns = append(g.Conns, graphConn(StageConn, conn, edges))
+	}
+	for _, conn := range t.flowConns {
+		var edges []GraphEdge
+		for _, from := range t.sources(conn.From) {
+			// Wildcards in the 'to' address are replaced per message, as in subscribeFlow
+			to := conn.To
+			if to.Stage == "*" {
+				to.Stage = from.Stage
+			}
+			if to.Port == "*" {
+				to.Port = from.Port
+			}
+			edges = append(edges, GraphEdge{from, to})
+		}
+		g.Conns = append(g.Conns, graphConn(FlowConn, conn, edges))
+	}
+	return g
+}
+
+func graphConn(kind ConnKind, conn Conn, edges []GraphEdge) GraphConn {
+	gc := GraphConn{
+		Kind: kind, From: conn.From, To: conn.To, Edges: edges, Buffer: conn.Buffer,
+		Feedback: conn.Feedback, MaxIterations: conn.MaxIterations,
+	}
+	if conn.Buffer > 0 {
+		gc.Overflow = conn.Overflow.String()
+	}
+	if conn.Partition != nil {
+		gc.Partition = conn.Partition.Description
+	}
+	return gc
+}
+
+// Returns the description of a stage. Stages without one are described by their type.
+func describe(s Stage) Description {
+	switch s := s.(type) {
+	case *Pipeline:
+		return Description{Kind: "pipeline"}
+	case *Flow:
+		return Description{Kind: "flow"}
+	case interface{ Description() Description }:
+		if d := s.Description(); d.Kind != "" {
+			return d
+		}
+	}
+	return Description{Kind: strings.TrimPrefix(fmt.Sprintf("%T", s), "*")}
+}
+
+// Returns the graph in the Graphviz DOT language, with nested flows drawn as clusters.
+func (g Graph) DOT() string {
+	d := newDrawing(g)
+	var b strings.Builder
+	fmt.Fprintf(&b, "digraph %s {\n", dotQuote(g.ID))
+	b.WriteString("  rankdir=LR;\n  node [shape=box];\n")
+	var write func(c *cluster, indent string)
+	write = func(c *cluster, indent string) {
+		for _, n := range c.nodes {
+			shape := ""
+			if n.port {
+				shape = ", shape=cds"
+			}
+			fmt.Fprintf(&b, "%s%s [label=%s%s];\n", indent, n.id, dotQuote(strings.Join(n.label, "\n")), shape)
+		}
+		for _, sub := range c.clusters {
+			fmt.Fprintf(&b, "%ssubgraph %s {\n", indent, sub.id)
+			fmt.Fprintf(&b, "%s  label=%s;\n", indent, dotQuote(sub.label))
+			write(sub, indent+"  ")
+			fmt.Fprintf(&b, "%s}\n", indent)
+		}
+	}
+	write(d.root, "  ")
+	for _, e := range d.edges {
+		fmt.Fprintf(&b, "  %s -> %s", e.from, e.to)
+		if len(e.label) > 0 {
+			fmt.Fprintf(&b, " [label=%s]", dotQuote(strings.Join(e.label, "\n")))
+		}
+		b.WriteString(";\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// Returns the graph as a Mermaid flowchart, with nested flows drawn as subgraphs.
+func (g Graph) Mermaid() string {
+	d := newDrawing(g)
+	var b strings.Builder
+	b.WriteString("flowchart LR\n")
+	var write func(c *cluster, indent string)
+	write = func(c *cluster, indent string) {
+		for _, n := range c.nodes {
+			open, close := "[", "]"
+			if n.port {
+				open, close = "([", "])"
+			}
+			fmt.Fprintf(&b, "%s%s%s%s%s\n", indent, n.id, open, mermaidQuote(n.label), close)
+		}
+		for _, sub := range c.clusters {
+			fmt.Fprintf(&b, "%ssubgraph %s[%s]\n", indent, sub.id, mermaidQuote([]string{sub.label}))
+			write(sub, indent+"  ")
+			fmt.Fprintf(&b, "%send\n", indent)
+		}
+	}
+	write(d.root, "  ")
+	for _, e := range d.edges {
+		if len(e.label) > 0 {
+			fmt.Fprintf(&b, "  %s -->|%s| %s\n", e.from, mermaidQuote(e.label), e.to)
+		} else {
+			fmt.Fprintf(&b, "  %s --> %s\n", e.from, e.to)
+		}
+	}
+	return b.String()
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func mermaidQuote(lines []string) string {
+	for i, line := range lines {
+		lines[i] = strings.NewReplacer(`"`, "#quot;", "<", "#lt;", ">", "#gt;").Replace(line)
+	}
+	return `"` + strings.Join(lines, "<br/>") + `"`
+}
+
+// The nodes, clusters, and edges of a graph, in the form shared by its drawings.
+// Nodes and clusters have generated IDs, since IDs in the graph may contain any characters.
+type drawing struct {
+	root     *cluster
+	clusters map[string]*cluster // by the path of their flow; the root's path is empty
+	ids      map[string]string   // generated IDs by node key
+	edges    []edge
+}
+
+// A flow, drawn as a group of nodes
+type cluster struct {
+	id, label string
+	nodes     []node
+	clusters  []*cluster
+}
+
+type node struct {
+	id    string
+	label []string
+	port  bool // whether the node is a flow port rather than a stage
+}
+
+type edge struct {
+	from, to string
+	label    []string
+}
+
+func newDrawing(g Graph) *drawing {
+	d := &drawing{clusters: map[string]*cluster{}, ids: map[string]string{}}
+	d.root = &cluster{}
+	d.clusters[""] = d.root
+	d.addFlow(g, "")
+	return d
+}
+
+// Returns the ID for the node or cluster with the given key, generating it if needed.
+func (d *drawing) id(key, prefix string) string {
+	id, ok := d.ids[key]
+	if !ok {
+		id = fmt.Sprintf("%s%d", prefix, len(d.ids))
+		d.ids[key] = id
+	}
+	return id
+}
+
+func joinPath(path, id string) string {
+	if path == "" {
+		return id
+	}
+	return path + "/" + id
+}
+
+// Returns the ID of the node for an input or output port of the flow at the given path,
+// adding the node to the flow's cluster if needed.
+func (d *drawing) portNode(path, dir, port string) string {
+	key := dir + ":" + path + ":" + port
+	if _, ok := d.ids[key]; !ok {
+		c := d.clusters[path]
+		c.nodes = append(c.nodes, node{id: d.id(key, "p"), label: []string{dir + ": " + port}, port: true})
+	}
+	return d.ids[key]
+}
+
+// Adds the ports, stages, and conns of the flow at the given path.
+func (d *drawing) addFlow(g Graph, path string) {
+	c := d.clusters[path]
+	for _, port := range slices.Sorted(maps.Keys(g.Ports.In)) {
+		d.portNode(path, "in", port)
+	}
+	for _, port := range slices.Sorted(maps.Keys(g.Ports.Out)) {
+		d.portNode(path, "out", port)
+	}
+	nested := map[string]bool{}
+	for _, s := range g.Stages {
+		p := joinPath(path, s.ID)
+		label := s.ID + " (" + s.Kind + ")"
+		if s.Replicas > 1 {
+			label += fmt.Sprintf(" ×%d", s.Replicas)
+		}
+		if s.Flow != nil {
+			nested[s.ID] = true
+			sub := &cluster{id: d.id("cluster:"+p, "cluster_"), label: label}
+			c.clusters = append(c.clusters, sub)
+			d.clusters[p] = sub
+			d.addFlow(*s.Flow, p)
+			continue
+		}
+		lines := []string{label}
+		if s.Summary != "" {
+			lines = append(lines, s.Summary)
+		}
+		c.nodes = append(c.nodes, node{id: d.id("stage:"+p, "s"), label: lines})
+	}
+
+	// Returns the node for a stage end of an edge, and the port to show on the edge, if any.
+	// Edges to and from nested flows are drawn to and from their port nodes.
+	endpoint := func(addr msg.Addr, dir string) (string, string) {
+		if nested[addr.Stage] {
+			return d.portNode(joinPath(path, addr.Stage), dir, addr.Port), ""
+		}
+		return d.ids["stage:"+joinPath(path, addr.Stage)], addr.Port
+	}
+	for _, conn := range g.Conns {
+		for _, e := range conn.Edges {
+			var from, fromPort, to, toPort string
+			if conn.Kind == InputConn {
+				from = d.portNode(path, "in", e.From.Port)
+			} else {
+				from, fromPort = endpoint(e.From, "out")
+			}
+			if conn.Kind == FlowConn {
+				to = d.portNode(path, "out", e.To.Port)
+			} else {
+				to, toPort = endpoint(e.To, "in")
+			}
+			var label []string
+			switch {
+			case fromPort != "" && toPort != "":
+				label = append(label, fromPort+" → "+toPort)
+			case fromPort != "":
+				label = append(label, fromPort)
+			case toPort != "":
+				label = append(label, toPort)
+			}
+			if conn.Buffer > 0 {
+				label = append(label, fmt.Sprintf("buffer %d, %s", conn.Buffer, conn.Overflow))
+			}
+			if conn.Partition != "" {
+				label = append(label, "by "+conn.Partition)
+			}
+			if conn.Feedback {
+				label = append(label, fmt.Sprintf("feedback, %d iterations", conn.MaxIterations))
+			}
+			d.edges = append(d.edges, edge{from, to, label})
+		}
+	}
+}
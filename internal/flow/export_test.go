@@ -0,0 +1,115 @@
+package flow
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Returns a flow with a wildcard stage conn, a wildcard flow conn, and a nested flow.
+func newGraphFlow(t *testing.T) *Flow {
+	t.Helper()
+	a := msg.NewAddr
+	ps := pubsub.NewPubSub()
+	inner, err := NewFlow(NewBase("inner").WithInOut(0), ps, []Stage{newPassthrough("s3")},
+		[]Conn{{From: a("inner", "in"), To: a("s3", "in")}},
+		nil,
+		[]Conn{{From: a("s3", "out"), To: a("inner", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1 := &passthrough{*NewBase("s1").WithInOut(0).WithPorts(passthroughPorts).
+		WithDescription(Description{Kind: "jq", Summary: ".[]"})}
+	f, err := NewFlow(NewBase("f").WithInOut(0), ps, []Stage{s1, newPassthrough("s2"), inner},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in")}},
+		[]Conn{
+			{From: a("s1", "*"), To: a("s2", "in"), Buffer: 5},
+			{From: a("s2", "out"), To: a("inner", "in")},
+		},
+		[]Conn{
+			{From: a("inner", "out"), To: a("f", "out")},
+			{From: a("*", "error"), To: a("f", "*")},
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestGraphResolvesWildcards(t *testing.T) {
+	a := msg.NewAddr
+	g := newGraphFlow(t).Graph()
+
+	var kinds []string
+	for _, s := range g.Stages {
+		kinds = append(kinds, s.ID+":"+s.Kind)
+	}
+	if want := []string{"inner:flow", "s1:jq", "s2:flow.passthrough"}; !cmp.Equal(kinds, want) {
+		t.Errorf("got stages %v, want %v", kinds, want)
+	}
+	if g.Stages[0].Flow == nil || len(g.Stages[0].Flow.Stages) != 1 {
+		t.Errorf("nested flow graph is missing its stage: %+v", g.Stages[0].Flow)
+	}
+
+	var edges []GraphEdge
+	for _, c := range g.Conns {
+		edges = append(edges, c.Edges...)
+	}
+	want := []GraphEdge{
+		{a("f", "in"), a("s1", "in")},
+		{a("s1", "error"), a("s2", "in")},
+		{a("s1", "out"), a("s2", "in")},
+		{a("s2", "out"), a("inner", "in")},
+		{a("inner", "out"), a("f", "out")},
+		{a("s1", "error"), a("f", "error")},
+		{a("s2", "error"), a("f", "error")},
+	}
+	if diff := cmp.Diff(want, edges); diff != "" {
+		t.Errorf("edges mismatch (-want +got):\n%s", diff)
+	}
+
+	data, err := json.Marshal(g)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded Graph
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(g, decoded); diff != "" {
+		t.Errorf("JSON round trip mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestGraphDrawsNestedFlowsAsClusters(t *testing.T) {
+	g := newGraphFlow(t).Graph()
+
+	dot := g.DOT()
+	for _, want := range []string{
+		`digraph "f" {`,
+		"subgraph cluster_",
+		`label="inner (flow)";`,
+		`[label="s1 (jq)\n.[]"];`,
+		`[label="out → in\nbuffer 5, block"]`,
+	} {
+		if !strings.Contains(dot, want) {
+			t.Errorf("DOT output does not contain %q:\n%s", want, dot)
+		}
+	}
+
+	mermaid := g.Mermaid()
+	for _, want := range []string{
+		"flowchart LR",
+		`["inner (flow)"]`,
+		`["s1 (jq)<br/>.[]"]`,
+		`-->|"out → in<br/>buffer 5, block"|`,
+	} {
+		if !strings.Contains(mermaid, want) {
+			t.Errorf("Mermaid output does not contain %q:\n%s", want, mermaid)
+		}
+	}
+}
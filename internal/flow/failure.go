@@ -0,0 +1,185 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/thejerf/suture/v4"
+)
+
+// What a flow does when one of its stages fails, meaning that the stage's Serve method
+// returned an unexpected error or panicked. Returning nil or suture.ErrDoNotRestart is
+// not a failure, and a stage that returns suture.ErrTerminateSupervisorTree always
+// terminates the flow.
+type FailureAction int
+
+const (
+	// Restart the stage, backing off according to the suture.Spec of its policy or the flow's
+	Restart FailureAction = iota
+	// Stop the flow, returning the failure from its Serve method
+	Terminate
+	// Stop the stage and keep running the rest of the flow. Deliveries to an isolated stage
+	// are traced as failures, and a pipeline with an isolated stage never completes.
+	Isolate
+)
+
+var failureActionNames = []string{"restart", "terminate", "isolate"}
+
+func (a FailureAction) String() string {
+	if a < 0 || int(a) >= len(failureActionNames) {
+		return fmt.Sprintf("FailureAction(%d)", int(a))
+	}
+	return failureActionNames[a]
+}
+
+func (a FailureAction) MarshalText() ([]byte, error) {
+	if a < 0 || int(a) >= len(failureActionNames) {
+		return nil, fmt.Errorf("flow: unknown failure action %d", int(a))
+	}
+	return []byte(a.String()), nil
+}
+
+func (a *FailureAction) UnmarshalText(text []byte) error {
+	for i, name := range failureActionNames {
+		if string(text) == name {
+			*a = FailureAction(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("flow: unknown failure action %q (expected one of %v)", text, failureActionNames)
+}
+
+// Determines how a flow handles the failure of a stage
+type FailurePolicy struct {
+	Action FailureAction
+	// Restart settings such as the failure threshold and backoff. For the flow-wide
+	// policy, these configure the flow's supervisor. For a stage policy, the stage is
+	// run under its own supervisor with these settings. If nil, the flow's are used.
+	Spec *suture.Spec
+}
+
+// A stage failure, as recorded by the flow that ran the stage
+type StageFailure struct {
+	Time   time.Time
+	Stage  string
+	Error  error
+	Action FailureAction
+}
+
+// Number of recent stage failures retained by each flow
+const maxFailures = 100
+
+// An Option configures a flow
+type Option func(*Flow)
+
+// Sets the failure policy for the stages of the flow.
+// Its Spec, if any, configures the flow's supervisor.
+func WithFailurePolicy(policy FailurePolicy) Option {
+	return func(f *Flow) {
+		f.policy = policy
+	}
+}
+
+// Sets the failure policy for the stage with the given ID, overriding the flow's.
+func WithStageFailurePolicy(id string, policy FailurePolicy) Option {
+	return func(f *Flow) {
+		f.stagePolicies[id] = policy
+	}
+}
+
+// Returns the failure policy for the stage with the given ID
+func (f *Flow) policyFor(id string) FailurePolicy {
+	if p, ok := f.stagePolicies[id]; ok {
+		return p
+	}
+	return f.policy
+}
+
+// Returns the most recent stage failures, oldest first.
+func (f *Flow) Failures() []StageFailure {
+	f.failMu.Lock()
+	defer f.failMu.Unlock()
+	return append([]StageFailure(nil), f.failures...)
+}
+
+// Records a stage failure, traces it, and returns the error for the stage's
+// supervisor that carries out the failure policy.
+func (f *Flow) stageFailed(ctx context.Context, id string, err error, policy FailurePolicy) error {
+	failure := StageFailure{Time: time.Now(), Stage: id, Error: err, Action: policy.Action}
+	f.failMu.Lock()
+	f.failures = append(f.failures, failure)
+	if len(f.failures) > maxFailures {
+		f.failures = f.failures[len(f.failures)-maxFailures:]
+	}
+	f.failMu.Unlock()
+	f.mu.RLock()
+	path := f.stagePath(id)
+	f.mu.RUnlock()
+	f.trace(ctx, TraceStageFailure{failure.Time, path, err, policy.Action})
+
+	switch policy.Action {
+	case Terminate:
+		return errors.Join(suture.ErrTerminateSupervisorTree, err)
+	case Isolate:
+		f.isolate(id, err)
+		return errors.Join(suture.ErrDoNotRestart, err)
+	default:
+		return err
+	}
+}
+
+// Stops every instance of a running stage without removing it from the flow, so that
+// deliveries to it fail rather than block.
+func (f *Flow) isolate(id string, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.run == nil {
+		return
+	}
+	if sr, ok := f.run.stages[id]; ok {
+		sr.cancel(fmt.Errorf("stage %q is isolated after failing: %w", id, err))
+		f.inflight.forget(f.stagePath(id))
+		for _, token := range sr.tokens {
+			_ = f.sv.Remove(token)
+		}
+	}
+}
+
+// Runs a stage instance under a supervisor, applying the stage's failure policy.
+type supervised struct {
+	f      *Flow
+	id     string // ID of the stage, which is shared by its replicas
+	s      Stage
+	policy FailurePolicy
+}
+
+func (w *supervised) Serve(ctx context.Context) (err error) {
+	defer func() {
+		if pv := recover(); pv != nil {
+			err = w.f.stageFailed(ctx, w.id, fmt.Errorf("panic: %v", pv), w.policy)
+		}
+	}()
+	err = w.s.Serve(ctx)
+	if err == nil || ctx.Err() != nil || errors.Is(err, suture.ErrDoNotRestart) || errors.Is(err, suture.ErrTerminateSupervisorTree) {
+		return err
+	}
+	return w.f.stageFailed(ctx, w.id, err, w.policy)
+}
+
+func (w *supervised) String() string {
+	return w.id
+}
+
+// Returns the service to add to the flow's supervisor for an instance of the stage.
+func (f *Flow) service(id string, s Stage) suture.Service {
+	policy := f.policyFor(id)
+	w := &supervised{f: f, id: id, s: s, policy: policy}
+	if _, ok := f.stagePolicies[id]; !ok || policy.Spec == nil {
+		return w
+	}
+	sv := suture.New(id, *policy.Spec)
+	sv.Add(w)
+	return sv
+}
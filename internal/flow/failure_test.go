@@ -0,0 +1,198 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"github.com/thejerf/suture/v4"
+)
+
+// A passthrough stage whose first few runs fail, by returning an error or panicking
+type flaky struct {
+	passthrough
+	fails  int32
+	panics bool
+	runs   atomic.Int32
+}
+
+func newFlaky(id string, fails int32, panics bool) *flaky {
+	return &flaky{passthrough: *newPassthrough(id), fails: fails, panics: panics}
+}
+
+func (s *flaky) Serve(ctx context.Context) error {
+	if s.runs.Add(1) <= s.fails {
+		if s.panics {
+			panic("oops")
+		}
+		return errors.New("oops")
+	}
+	return s.passthrough.Serve(ctx)
+}
+
+// Returns a flow with two independent paths, in1 -> s1 -> out1 and in2 -> s2 -> out2.
+func newTwoPathFlow(t *testing.T, s1 Stage, opts ...Option) *Flow {
+	t.Helper()
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0).WithTrace(10), pubsub.NewPubSub(), []Stage{s1, newPassthrough("s2")},
+		[]Conn{{From: a("f", "in1"), To: a("s1", "in")}, {From: a("f", "in2"), To: a("s2", "in")}},
+		nil,
+		[]Conn{{From: a("s1", "out"), To: a("f", "out1")}, {From: a("s2", "out"), To: a("f", "out2")}},
+		opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+// Waits for the next trace event of the given type
+func nextTrace[E TraceEvent](t *testing.T, f *Flow) E {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case e := <-f.Trace():
+			if e, ok := e.(E); ok {
+				return e
+			}
+		case <-timeout:
+			var zero E
+			t.Fatalf("timeout waiting for %T", zero)
+			return zero
+		}
+	}
+}
+
+func expectOutput(t *testing.T, f *Flow, port string) {
+	t.Helper()
+	select {
+	case m := <-f.Out():
+		if m.Port != port {
+			t.Errorf("got output on %q, want %q", m.Port, port)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timeout waiting for output on %q", port)
+	}
+}
+
+func TestFailurePolicyTerminate(t *testing.T) {
+	f := newTwoPathFlow(t, newFlaky("s1", 1, true), WithFailurePolicy(FailurePolicy{Action: Terminate}))
+	errCh := make(chan error, 1)
+	go func() { errCh <- f.Serve(t.Context()) }()
+
+	e := nextTrace[TraceStageFailure](t, f)
+	if e.Stage != "s1" || e.Action != Terminate || !strings.Contains(e.Error.Error(), "panic: oops") {
+		t.Errorf("unexpected stage failure %+v", e)
+	}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, suture.ErrDoNotRestart) || !strings.Contains(err.Error(), "panic: oops") {
+			t.Errorf("unexpected Serve error: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the flow to terminate")
+	}
+}
+
+func TestFailurePolicyIsolate(t *testing.T) {
+	a := msg.NewAddr
+	f := newTwoPathFlow(t, newFlaky("s1", 1, false), WithStageFailurePolicy("s1", FailurePolicy{Action: Isolate}))
+	go f.Serve(t.Context())
+
+	if e := nextTrace[TraceStageFailure](t, f); e.Stage != "s1" || e.Action != Isolate {
+		t.Errorf("unexpected stage failure %+v", e)
+	}
+
+	// Deliveries to the isolated stage fail, and the other path keeps flowing
+	f.In() <- msg.New(1).To(a("f", "in1"))
+	if e := nextTrace[TraceFailure](t, f); !strings.Contains(e.Error.Error(), `stage "s1" is isolated after failing: oops`) {
+		t.Errorf("unexpected failure %v", e.Error)
+	}
+	go func() {
+		for range f.Trace() {
+		}
+	}()
+	f.In() <- msg.New(2).To(a("f", "in2"))
+	expectOutput(t, f, "out2")
+
+	failures := f.Failures()
+	if len(failures) != 1 || failures[0].Stage != "s1" || failures[0].Action != Isolate {
+		t.Errorf("unexpected recorded failures %+v", failures)
+	}
+}
+
+func TestFailurePolicyRestartWithStageSpec(t *testing.T) {
+	spec := &suture.Spec{FailureThreshold: 1, FailureBackoff: time.Millisecond}
+	f := newTwoPathFlow(t, newFlaky("s1", 3, false), WithStageFailurePolicy("s1", FailurePolicy{Action: Restart, Spec: spec}))
+	go f.Serve(t.Context())
+	for range 3 {
+		if e := nextTrace[TraceStageFailure](t, f); e.Action != Restart {
+			t.Errorf("unexpected stage failure %+v", e)
+		}
+	}
+	go func() {
+		for range f.Trace() {
+		}
+	}()
+
+	f.In() <- msg.New(1).To(msg.NewAddr("f", "in1"))
+	expectOutput(t, f, "out1")
+	if n := len(f.Failures()); n != 3 {
+		t.Errorf("got %d recorded failures, want 3", n)
+	}
+}
+
+func TestFailedMsgJSON(t *testing.T) {
+	m := msg.NewWithID("m", "data")
+	tests := []struct {
+		name   string
+		failed FailedMsg
+		want   string
+	}{
+		{"error", FailedMsg{m, errors.New("oops"), "s", 1}, `{"Msg":{"ID":"m","Data":"data","Tokens":null,"Iteration":0},"Error":"oops","Stage":"s","Attempt":1}`},
+		{"no error", FailedMsg{Msg: m}, `{"Msg":{"ID":"m","Data":"data","Tokens":null,"Iteration":0},"Error":null,"Stage":"","Attempt":0}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := json.Marshal(tt.failed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStageFailureWithUnreadTrace(t *testing.T) {
+	// Nothing reads the flow's unbuffered trace channel, so tracing the stage
+	// failure only returns once the flow is stopping.
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0).WithTrace(0), pubsub.NewPubSub(), []Stage{newFlaky("s1", 1, false)},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in")}},
+		nil,
+		[]Conn{SelfConn(a("s1", "out"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() { errCh <- f.Serve(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Serve to return")
+	}
+	if failures := f.Failures(); len(failures) != 1 {
+		t.Errorf("got %d recorded failures, want 1", len(failures))
+	}
+}
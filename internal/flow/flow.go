@@ -4,11 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"slices"
 	"sync"
+	"time"
 
+	"datapotamus.com/internal/common"
 	"datapotamus.com/internal/flow/msg"
 	"datapotamus.com/internal/flow/pubsub"
-	"datapotamus.com/internal/flow/sublist"
+	"datapotamus.com/internal/flow/schema"
 	"github.com/thejerf/suture/v4"
 )
 
@@ -16,12 +19,35 @@ import (
 type Conn struct {
 	From msg.Addr
 	To   msg.Addr
+
+	// If positive, messages sent along the conn are queued in a buffer of this size
+	// and delivered by their own goroutine, so that a slow receiver does not stall the
+	// sender or the other receivers of its messages. Otherwise, delivery is synchronous.
+	Buffer int
+	// What to do with a message when the buffer is full. Messages dropped on their
+	// way to a stage are traced as failures by the flow, and drop counts for each
+	// buffered conn are reported by Flow.ConnBuffers.
+	Overflow pubsub.Overflow
+
+	// If set, messages are delivered to the replicas of the 'to' stage by key rather than
+	// at random. Conns are compared by identity, so the pointer identifies the partition.
+	Partition *Partition
+
+	// Marks a stage conn as a feedback edge, which may close a cycle in the stage graph.
+	// Flows reject cycles that do not pass through a feedback conn, since synchronous
+	// delivery around a cycle can deadlock. Feedback conns must be buffered with an
+	// overflow policy other than Block, so that delivery along them never stalls.
+	Feedback bool
+	// For feedback conns, the number of times a message and its ancestors may be delivered
+	// along feedback conns (see msg.Msg.Iteration). Deliveries beyond the limit fail with
+	// ErrIterationLimit.
+	MaxIterations int
 }
 
 // Returns a connection from an address to itself, which can be used
 // to expose a stage output as a flow output with the same address.
 func SelfConn(addr msg.Addr) Conn {
-	return Conn{addr, addr}
+	return Conn{From: addr, To: addr}
 }
 
 // A Flow is a collection of connected communicating stages
@@ -29,173 +55,634 @@ type Flow struct {
 	Base                          // A flow is a stage
 	sv         *suture.Supervisor // Flows supervise its substages
 	ps         *pubsub.PubSub     // Flows manage inter-stage communication with pubsub
-	stagesById map[string]Stage   // Stages indexed by their ID
-	stageConns []Conn             // Connections between stages
-	flowConns  []Conn             // Output connections from stages to the flow
+	mu         sync.RWMutex       // Guards topo and run, which change when the flow is reconfigured
+	topo       *topology          // Stages and connections
+	run        *running           // Runtime state; only set while serving
+	completion *completion        // Close propagation state; only set for pipelines
+
+	policy        FailurePolicy            // Failure policy for stages without their own
+	stagePolicies map[string]FailurePolicy // Failure policies for individual stages
+	failMu        sync.Mutex               // Guards failures
+	failures      []StageFailure           // Recent stage failures
+
+	inflight *inflight     // Work in flight; set while serving, or by the parent of a nested flow
+	gate     *gate         // Holds deliveries during checkpoints; set like inflight
+	path     string        // Path of a nested flow within the outermost flow; empty if not nested
+	drain    chan struct{} // Receives a value once the flow should stop taking input
+
+	pause     chan chan struct{} // Receives a channel that is closed once a checkpoint is taken
+	resumeDir string             // Directory of the checkpoint to resume from, if any
+	resumed   []queuedMsg        // Messages to deliver once serving, from a checkpoint
+
+	stuckAfter time.Duration // How long stages may process a message before the watchdog reports them
 }
 
-func NewFlow(base *Base, ps *pubsub.PubSub, stages []Stage, stageConns []Conn, flowConns []Conn) (*Flow, error) {
-	// Create maps from stage ID to input and output channel
-	stagesById := map[string]Stage{}
-	for _, s := range stages {
-		if s.In() == nil {
-			panic(fmt.Sprintf("flow: stage %q: stage In() channel must not be nil", s.ID()))
-		}
-		if s.Out() == nil {
-			panic(fmt.Sprintf("flow: stage %q: stage Out() channel must not be nil", s.ID()))
-		}
-		if _, ok := stagesById[s.ID()]; ok {
-			return nil, fmt.Errorf("flow: duplicate stage id: %q", s.ID())
+// Runtime state of a serving flow
+type running struct {
+	ctx       context.Context
+	wg        *sync.WaitGroup      // Tracks publisher and trace forwarding goroutines
+	stages    map[string]*stageRun // Running stages indexed by their ID
+	stageSubs []*subscription      // Subscriptions for input and stage conns
+	flowSubs  []*subscription      // Subscriptions for flow conns
+}
+
+// Runtime state of a stage in a serving flow
+type stageRun struct {
+	tokens []suture.ServiceToken // One for each instance of the stage
+	ctx    context.Context       // Done once the stage is removed or isolated, or the flow stops
+	cancel context.CancelCauseFunc
+}
+
+// A pubsub subscription delivering messages along a conn
+type subscription struct {
+	conn   Conn
+	cancel context.CancelFunc          // Unsubscribes and drops any delivery in progress
+	flush  []func()                    // Wait for the conn's buffers to deliver their messages; nil if unbuffered
+	stats  []func() pubsub.BufferStats // Report the statistics of the conn's buffers; nil if unbuffered
+}
+
+// Input conns map the flow's own input ports, addressed as Addr{flowID, port}, to the
+// input ports of its stages, so that the flow presents a stable interface that does
+// not depend on the IDs of its internal stages. Flow conns map stage output ports
+// to the flow's output ports, which are the ports of their 'to' addresses.
+func NewFlow(base *Base, ps *pubsub.PubSub, stages []Stage, inputConns []Conn, stageConns []Conn, flowConns []Conn, opts ...Option) (*Flow, error) {
+	topo, err := newTopology(base.ID(), stages, inputConns, stageConns, flowConns)
+	if err != nil {
+		return nil, err
+	}
+	f := &Flow{
+		Base:          *base,
+		ps:            ps,
+		topo:          topo,
+		stagePolicies: map[string]FailurePolicy{},
+		drain:         make(chan struct{}),
+		pause:         make(chan chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(f)
+	}
+	if f.resumeDir != "" {
+		if err := f.restore(f.resumeDir); err != nil {
+			return nil, fmt.Errorf("flow %q: resume: %w", f.ID(), err)
 		}
-		stagesById[s.ID()] = s
 	}
+	var spec suture.Spec
+	if f.policy.Spec != nil {
+		spec = *f.policy.Spec
+	}
+	f.sv = suture.New(base.ID(), spec)
+	return f, nil
+}
 
-	// Validate that all stages referenced from stageConns exist.
-	for _, conn := range stageConns {
-		if _, ok := stagesById[conn.From.Stage]; !ok {
-			return nil, fmt.Errorf("stage conn: 'from' stage does not exist: %v", conn.From)
-		}
-		if _, ok := stagesById[conn.To.Stage]; !ok {
-			return nil, fmt.Errorf("stage conn: 'from' stage does not exist: %v", conn.From)
+// Returns the flow's ports, which are declared by its input and flow conns.
+func (f *Flow) Ports() Ports {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.topo.ports
+}
+
+// Returns warnings about the flow's topology, which describe problems that do not
+// prevent it from running, such as conns between ports with incompatible schemas.
+func (f *Flow) Warnings() []string {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return slices.Clone(f.topo.warnings)
+}
+
+// Returns the number of messages waiting in the In channels of the flow's stages, by
+// stage path, including the stages of nested flows. Replicated stages report the total
+// for their replicas.
+func (f *Flow) QueueDepths() map[string]int {
+	depths := map[string]int{}
+	f.queueDepths(depths)
+	return depths
+}
+
+func (f *Flow) queueDepths(depths map[string]int) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, s := range f.topo.stages() {
+		path := f.stagePath(s.ID())
+		for _, inst := range instances(s) {
+			depths[path] += len(inst.In())
+			if nf, ok := asFlow(inst); ok {
+				nf.queueDepths(depths)
+			}
 		}
 	}
+}
+
+// Delivery statistics for a buffered conn. The buffers of a conn to a replicated stage
+// are reported together.
+type ConnBuffer struct {
+	Path     string // Path of the nested flow the conn belongs to; empty for the flow itself
+	From, To msg.Addr
+	Len      int   // Number of buffered messages
+	Cap      int   // Total buffer size
+	Dropped  int64 // Number of messages dropped by the overflow policy or when the conn was removed
+}
 
-	// Validate that all stages referenced from flowConns exist.
-	for _, conn := range flowConns {
-		if _, ok := stagesById[conn.From.Stage]; !ok {
-			return nil, fmt.Errorf("flow conn: 'from' stage does not exist: %v", conn.From)
+// Returns the statistics of the flow's buffered conns, including those of nested flows,
+// while the flow is serving.
+func (f *Flow) ConnBuffers() []ConnBuffer {
+	var bufs []ConnBuffer
+	f.connBuffers(&bufs)
+	return bufs
+}
+
+func (f *Flow) connBuffers(bufs *[]ConnBuffer) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	if f.run == nil {
+		return
+	}
+	for _, sub := range slices.Concat(f.run.stageSubs, f.run.flowSubs) {
+		b := ConnBuffer{Path: f.path, From: sub.conn.From, To: sub.conn.To}
+		buffered := false
+		for _, stats := range sub.stats {
+			if stats != nil {
+				st := stats()
+				b.Len += st.Len
+				b.Cap += st.Cap
+				b.Dropped += st.Dropped
+				buffered = true
+			}
+		}
+		if buffered {
+			*bufs = append(*bufs, b)
 		}
 	}
-
-	stageSupervisor := suture.NewSimple(base.ID())
-	for _, s := range stages {
-		stageSupervisor.Add(s)
+	for _, s := range f.topo.stages() {
+		for _, inst := range instances(s) {
+			if nf, ok := asFlow(inst); ok {
+				nf.connBuffers(bufs)
+			}
+		}
 	}
-
-	return &Flow{
-		Base:       *base,
-		sv:         stageSupervisor,
-		ps:         ps,
-		stagesById: stagesById,
-		stageConns: stageConns,
-		flowConns:  flowConns,
-	}, nil
 }
 
 func (f *Flow) SubjectFor(addr msg.Addr) string {
-	return fmt.Sprintf("flow.%s.stage.%s.port.%s", f.ID(), addr.Stage, addr.Port)
+	return subjectFor(f.ID(), addr)
 }
 
 func (f *Flow) Serve(ctx context.Context) error {
-	// Create subscriptions and goroutines to coordinate
-	// message delivery between the flow and its stages.
-
-	// For each stage-to-stage connection, subscribe to the appropriate "From" subject
-	// and send messages to the appropriate "To" channel. From may contain wildcards.
-	// If the stage output is closed, fail the message.
-	for _, conn := range f.stageConns {
-		// The input of the "To" stage
-		in := f.stagesById[conn.To.Stage].In()
-		subj := f.SubjectFor(conn.From)
-		defer pubsub.Sub(f.ps, subj, func(subj string, m msg.Msg) {
-			in <- m.To(conn.To)
-		})()
-	}
-
-	// For each stage-to-flow output connection, subscribe to the appropriate "From" subject
-	// and send messages to the appropriate "To" address, remapping wildcards as necessary.
-	for _, conn := range f.flowConns {
-		subj := f.SubjectFor(conn.From)
-		defer pubsub.Sub(f.ps, subj, func(subj string, m msg.Msg) {
-			// Copy the "To" address by value so that we can override its fields in the case of wildcards
-			to := conn.To
-
-			// If the "To" subject has wildcards then we want to dynamically send to a different
-			// output stage and/or port on a per-message basis.
-			if to.Stage == "*" || to.Port == "*" {
-				tsa := [3]string{} // tokenize the subject into a (hopefully) stack-allocated slice
-				tts := sublist.TokenizeSubjectIntoSlice(tsa[:0], subj)
-				stage, port := tts[1], tts[2]
-				if to.Stage == "*" {
-					to.Stage = stage
-				}
-				if to.Port == "*" {
-					to.Port = port
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Start the stages along with the subscriptions and goroutines that
+	// coordinate message delivery between the flow and its stages.
+	var wg sync.WaitGroup
+	f.mu.Lock()
+	f.run = &running{ctx: ctx, wg: &wg, stages: map[string]*stageRun{}}
+	if f.path == "" {
+		f.inflight, f.gate = newInflight(), newGate()
+		if f.stuckAfter > 0 {
+			c := f.inflight
+			wg.Go(func() { f.watch(ctx, c) })
+		}
+	}
+	for _, s := range f.topo.stages() {
+		f.startStage(s)
+	}
+	for _, conn := range slices.Concat(f.topo.inputConns, f.topo.stageConns) {
+		f.subscribeStage(conn)
+	}
+	for _, conn := range f.topo.flowConns {
+		f.subscribeFlow(conn)
+	}
+	if f.resumed != nil {
+		f.deliverResumed(f.resumed)
+		f.resumed = nil
+	}
+	f.mu.Unlock()
+
+	errCh := f.sv.ServeBackground(ctx)
+
+	// Pipelines signal when every stage has finished; plain flows never do.
+	var done <-chan struct{}
+	if f.completion != nil {
+		done = f.completion.done
+	}
+
+	inputOpen := true        // Whether the flow is taking input
+	var resume chan struct{} // Set while a checkpoint is being taken
+	completed := false
+	var err error
+	svDone := false
+loop:
+	// Publish flow input messages onto the subjects for the flow's input ports.
+	for {
+		in := f.Ch.In
+		if !inputOpen || resume != nil {
+			in = nil
+		}
+		select {
+		case m, ok := <-in:
+			if !ok {
+				// Stop receiving, and for pipelines, close the input stages.
+				inputOpen = false
+				if f.completion != nil {
+					f.completion.inputDone(f)
 				}
+				continue
+			}
+			// The flow receives its inputs like any other stage, and succeeds
+			// once it has handed them to the stages connected to the input port.
+			f.trace(ctx, TraceRecv{Time: time.Now(), ID: m.ID})
+			if m.Stage != f.ID() || !f.Ports().HasIn(m.Port) {
+				f.trace(ctx, TraceFailure{Time: time.Now(), ID: m.ID, Error: fmt.Errorf("flow %q: no input port at address %v", f.ID(), m.Addr)})
+			} else {
+				f.publish(m.Msg.From(m.Addr))
+				f.trace(ctx, TraceSuccess{Time: time.Now(), ID: m.ID})
+			}
+			if f.path != "" {
+				// The parent flow counts each input as a delivery to this flow.
+				f.inflight.add(f.path, -1)
 			}
-			// Send the message to this flow's output channel
-			f.Ch.Out <- m.From(to)
-		})()
+
+		case <-f.drain:
+			// Stop taking input, leaving the In channel open. Since inputs are
+			// published as they are received, none are in progress now.
+			inputOpen = false
+
+		case resume = <-f.pause:
+			// Stop taking input and hold deliveries to stages until the checkpoint is taken
+			f.gate.close()
+
+		case <-resume:
+			resume = nil
+			f.gate.open(&wg)
+
+		case <-done:
+			completed = true
+			break loop
+
+		case err = <-errCh:
+			// The supervisor only stops on its own when a stage terminates the flow
+			svDone = true
+			break loop
+
+		case <-ctx.Done():
+			break loop
+		}
 	}
 
-	// The code above handles the subscribers -- now we handle publishing.
+	cancel()
+	if resume != nil {
+		// Complete the held deliveries, which are dropped now that the stages have stopped,
+		// so that nothing waits for them.
+		f.gate.open(&wg)
+	}
+	if !svDone {
+		err = <-errCh
+	}
+	wg.Wait()
 
-	var wg sync.WaitGroup
+	f.mu.Lock()
+	for _, sub := range slices.Concat(f.run.stageSubs, f.run.flowSubs) {
+		sub.cancel()
+	}
+	f.run = nil
+	f.mu.Unlock()
+
+	if completed {
+		// Every stage finished, so there is nothing left to restart.
+		return suture.ErrDoNotRestart
+	}
+	if err != nil {
+		// If the stage supervisor failed, for example because a stage failed with the
+		// Terminate failure policy, do not automatically restart the flow.
+		return errors.Join(suture.ErrDoNotRestart, err)
+	}
+	return nil
+}
+
+// Adds each instance of a stage to the supervisor and starts the goroutines that publish
+// its outputs and forward its trace events. Must be called with the write lock held while serving.
+func (f *Flow) startStage(s Stage) {
+	r := f.run
+	ctx, cancel := context.WithCancelCause(r.ctx)
+	sr := &stageRun{ctx: ctx, cancel: cancel}
+	r.stages[s.ID()] = sr
+	for _, inst := range instances(s) {
+		if nf, ok := asFlow(inst); ok {
+			nf.attach(f.inflight, f.gate, f.stagePath(s.ID()))
+		}
+		sr.tokens = append(sr.tokens, f.sv.Add(f.service(s.ID(), inst)))
+		f.startInstance(ctx, s.ID(), inst)
+	}
+}
+
+// Starts the goroutines for a single instance of the stage with the given ID.
+func (f *Flow) startInstance(ctx context.Context, id string, s Stage) {
+	r, c, path := f.run, f.inflight, f.stagePath(id)
+	_, nested := asFlow(s)
 
-	flowTraceCh := f.Ch.Trace
-	for _, s := range f.stagesById {
-		// Each stage publishes its outputs onto the pubsub subject for that stage and port.
+	// Each stage publishes its outputs onto the pubsub subject for that stage and port.
+	// This is equivalent to a range loop with context cancellation.
+	// If the stage closes its output, pipelines propagate the close downstream.
+	r.wg.Go(func() {
+		outCh := s.Out()
+		for {
+			select {
+			case m, ok := <-outCh:
+				if !ok {
+					if f.completion != nil {
+						f.completion.stageDone(f, id)
+					}
+					return
+				}
+				// Publish under the stage's own ID, so that a nested flow's
+				// outputs appear to come from the flow rather than its stages.
+				m.Addr.Stage = id
+				f.publish(m)
+				if nested {
+					c.add(path, -1)
+				} else {
+					c.send(path, m.ID, -1)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
+
+	// A nested flow counts its own work in flight, so its trace events are only forwarded.
+	// Events are attributed to the stage's path unless a nested flow has attributed them.
+	flowTraceCh, traceCh := f.Ch.Trace, s.Trace()
+	if traceCh != nil && (flowTraceCh != nil || !nested) {
+		// Each stage forwards its trace values to the flow trace channel
 		// This is equivalent to a range loop with context cancellation.
-		wg.Go(func() {
-			outCh := s.Out()
+		r.wg.Go(func() {
 			for {
 				select {
-				case m, ok := <-outCh:
+				case e, ok := <-traceCh:
 					if !ok {
 						return
 					}
-					subj := f.SubjectFor(m.Addr)
-					pubsub.Pub(f.ps, subj, m.Msg)
+					e = withStage(e, path)
+					if !nested {
+						c.observe(path, e)
+					}
+					if flowTraceCh == nil {
+						continue
+					}
+					select {
+					case flowTraceCh <- e:
+					case <-ctx.Done():
+						return
+					}
 				case <-ctx.Done():
 					return
 				}
 			}
 		})
+	}
+}
 
-		traceCh := s.Trace()
-		if flowTraceCh != nil && traceCh != nil {
-			// Each stage forwards its trace values to the flow trace channel
-			// This is equivalent to a range loop with context cancellation.
-			wg.Go(func() {
-				for {
-					select {
-					case e, ok := <-traceCh:
-						if !ok {
-							return
-						}
-						flowTraceCh <- e
-					case <-ctx.Done():
-						return
-					}
+// Stops a running stage. Messages queued at the stage are dropped.
+// Must be called with the write lock held while serving.
+func (f *Flow) stopStage(id string) {
+	sr := f.run.stages[id]
+	sr.cancel(errStageRemoved)
+	f.inflight.forget(f.stagePath(id))
+	for _, token := range sr.tokens {
+		// Removal is asynchronous, so this does not wait for the stage to return.
+		_ = f.sv.Remove(token)
+	}
+	delete(f.run.stages, id)
+}
+
+// Subscribes to the conn's 'from' subject, which may contain wildcards, and delivers
+// messages to the input of its 'to' stage. Used for both input and stage conns.
+// The instances of a replicated stage are subscribed as one queue group, so that
+// each message is delivered to exactly one of them, unless the conn is partitioned.
+// Must be called with the write lock held while serving, after the stage has started.
+func (f *Flow) subscribeStage(conn Conn) {
+	r, c, g, path := f.run, f.inflight, f.gate, f.stagePath(conn.To.Stage)
+	ctx, cancel := context.WithCancelCause(r.stages[conn.To.Stage].ctx)
+	var opts []pubsub.SubOption
+	if conn.Buffer > 0 {
+		opts = append(opts, pubsub.WithBuffer(conn.Buffer, conn.Overflow), pubsub.WithOnDrop(func(subj string, m any, err error) {
+			f.dropped(r, conn.To.Stage, m.(msg.MsgFrom).ID, fmt.Errorf("flow %q: conn %v -> %v: %w", f.ID(), conn.From, conn.To, err))
+		}))
+	}
+	// Nested flows validate the messages delivered to their own stages
+	to := f.topo.stagesById[conn.To.Stage]
+	var sch *schema.Schema
+	if _, ok := asFlow(to); !ok {
+		sch = to.Ports().In[conn.To.Port].Schema
+	}
+	// Sends the message to the stage, unless the conn or stage is removed first
+	send := func(inst Stage, m msg.MsgFrom) {
+		if ctx.Err() == nil {
+			select {
+			case inst.In() <- m.Msg.To(conn.To):
+				if _, ok := asFlow(inst); !ok && inst.Trace() == nil {
+					// Without trace events, the delivery is finished once the stage has the message.
+					c.add(path, -1)
 				}
-			})
+				return
+			case <-ctx.Done():
+			}
 		}
+		f.dropped(r, conn.To.Stage, m.ID, fmt.Errorf("flow %q: conn %v -> %v: %w", f.ID(), conn.From, conn.To, context.Cause(ctx)))
 	}
 
-	// Start the stages
-	errCh := f.sv.ServeBackground(ctx)
+	deliver := func(inst Stage, m msg.MsgFrom) {
+		if conn.Feedback {
+			if m.Iteration >= conn.MaxIterations {
+				f.dropped(r, conn.To.Stage, m.ID, fmt.Errorf("flow %q: conn %v -> %v: %w", f.ID(), conn.From, conn.To, ErrIterationLimit))
+				return
+			}
+			m.Iteration++
+		}
+		if err := sch.Validate(m.Data); err != nil {
+			f.rejected(r, conn, m.Msg, err)
+			return
+		}
+		// While a checkpoint is taken, the delivery is held and completed afterwards
+		if !g.hold(queuedMsg{path, m.Addr, conn.To, m.Msg}, func() { send(inst, m) }) {
+			send(inst, m)
+		}
+	}
 
-loop:
-	// Publish flow input messages to the appropriate stage subjects.
-	for {
-		select {
-		case m, ok := <-f.Ch.In:
-			if !ok {
-				break loop
+	subj := f.SubjectFor(conn.From)
+	insts := instances(to)
+	var unsubs []context.CancelFunc
+	var flush []func()
+	var stats []func() pubsub.BufferStats
+	if p := conn.Partition; p != nil {
+		// A single subscription picks the replica for each message by key
+		flush, stats = make([]func(), 1), make([]func() pubsub.BufferStats, 1)
+		unsubs = append(unsubs, pubsub.Sub(f.ps, subj, func(subj string, m msg.MsgFrom) {
+			key, err := p.Key(m.Msg)
+			if err != nil {
+				f.dropped(r, conn.To.Stage, m.ID, fmt.Errorf("flow %q: conn %v -> %v: partition key: %w", f.ID(), conn.From, conn.To, err))
+				return
 			}
-			f.stagesById[m.Stage].In() <- m
+			deliver(insts[p.replica(key, len(insts))], m)
+		}, append(opts, pubsub.WithFlush(&flush[0]), pubsub.WithStats(&stats[0]))...))
+	} else {
+		if len(insts) > 1 {
+			opts = append(opts, pubsub.WithQueueGroup(common.NewID()))
+		}
+		flush, stats = make([]func(), len(insts)), make([]func() pubsub.BufferStats, len(insts))
+		for i, inst := range insts {
+			unsubs = append(unsubs, pubsub.Sub(f.ps, subj, func(subj string, m msg.MsgFrom) {
+				deliver(inst, m)
+			}, slices.Concat(opts, []pubsub.SubOption{pubsub.WithFlush(&flush[i]), pubsub.WithStats(&stats[i])})...))
+		}
+	}
+	r.stageSubs = append(r.stageSubs, &subscription{conn, func() {
+		for _, unsub := range unsubs {
+			unsub()
+		}
+		cancel(errConnRemoved)
+	}, flush, stats})
+}
 
+// Subscribes to the conn's 'from' subject, which may contain wildcards, and sends
+// messages to the flow's output at the conn's 'to' address, remapping wildcards as
+// necessary. Must be called with the write lock held while serving.
+func (f *Flow) subscribeFlow(conn Conn) {
+	r := f.run
+	ctx, cancel := context.WithCancel(r.ctx)
+	var opts []pubsub.SubOption
+	if conn.Buffer > 0 {
+		// Flow outputs are not counted as deliveries, so drops here are not traced.
+		opts = append(opts, pubsub.WithBuffer(conn.Buffer, conn.Overflow))
+	}
+	flush, stats := make([]func(), 1), make([]func() pubsub.BufferStats, 1)
+	opts = append(opts, pubsub.WithFlush(&flush[0]), pubsub.WithStats(&stats[0]))
+	unsub := pubsub.Sub(f.ps, f.SubjectFor(conn.From), func(subj string, m msg.MsgFrom) {
+		// Copy the "To" address by value so that we can override its fields in the case of wildcards
+		to := conn.To
+
+		// If the "To" address has wildcards then we want to dynamically send to a different
+		// output stage and/or port on a per-message basis, taken from the source address.
+		if to.Stage == "*" {
+			to.Stage = m.Stage
+		}
+		if to.Port == "*" {
+			to.Port = m.Port
+		}
+		// Send the message to this flow's output channel
+		select {
+		case f.Ch.Out <- m.Msg.From(to):
 		case <-ctx.Done():
-			break loop
+		}
+	}, opts...)
+	r.flowSubs = append(r.flowSubs, &subscription{conn, func() { unsub(); cancel() }, flush, stats})
+}
+
+// Waits until the buffered input and stage conns to the stage have delivered every
+// message sent along them so far, including deliveries that were held during a
+// checkpoint. Must be called without the lock held.
+func (f *Flow) flushStageConns(id string) {
+	f.mu.RLock()
+	var flushes []func()
+	for _, sub := range f.run.stageSubs {
+		if sub.conn.To.Stage == id {
+			flushes = append(flushes, sub.flush...)
 		}
 	}
+	g, path := f.gate, f.stagePath(id)
+	f.mu.RUnlock()
+	flushAll(flushes)
+	g.wait(path)
+}
 
-	if err := <-errCh; err != nil {
-		// If the stage supervisor failed, do not automatically restart the flow.
-		// todo: is there a way for us to say "if any stage fails, fail the supervisor"?
-		return errors.Join(suture.ErrDoNotRestart, err)
+// Waits until the buffered flow conns have sent every message sent along them so far
+// to the flow's output. Must be called without the lock held.
+func (f *Flow) flushFlowConns() {
+	f.mu.RLock()
+	var flushes []func()
+	for _, sub := range f.run.flowSubs {
+		flushes = append(flushes, sub.flush...)
 	}
-	return nil
+	f.mu.RUnlock()
+	flushAll(flushes)
+}
+
+func flushAll(flushes []func()) {
+	for _, flush := range flushes {
+		if flush != nil {
+			flush()
+		}
+	}
+}
+
+// The error traced for a message that has been delivered along feedback conns as
+// many times as a feedback conn's MaxIterations allows.
+var ErrIterationLimit = errors.New("iteration limit reached")
+
+var (
+	errConnRemoved  = errors.New("conn was removed before delivery")
+	errStageRemoved = errors.New("stage was removed before delivery")
+)
+
+// Records the failure of a delivery to a stage that was dropped, either by a buffer's
+// overflow policy, because its partition key could not be computed, because it reached
+// the iteration limit of a feedback conn, or because its conn
+// or 'to' stage was removed or isolated while it was in progress, so that the message's
+// route is still resolved. Nothing is traced once the flow is stopping.
+func (f *Flow) dropped(r *running, stage string, id msg.ID, err error) {
+	path := f.stagePath(stage)
+	f.inflight.add(path, -1)
+	if r.ctx.Err() == nil {
+		f.trace(r.ctx, TraceFailure{Time: time.Now(), ID: id, Error: err, Stage: path})
+	}
+}
+
+// Sends a trace event on the flow's trace channel, if it has one, unless the context is
+// done first, since the trace events may no longer be consumed once the flow is stopping.
+func (f *Flow) trace(ctx context.Context, e TraceEvent) {
+	if f.Ch.Trace == nil {
+		return
+	}
+	select {
+	case f.Ch.Trace <- e:
+	case <-ctx.Done():
+	}
+}
+
+// Rejects a delivery whose data does not match the schema of its 'to' port. The flow
+// sends the message on the error port of the 'to' stage, as the stage would have if it
+// had failed to process the message, and traces the delivery as a failure.
+func (f *Flow) rejected(r *running, conn Conn, m msg.Msg, err error) {
+	err = fmt.Errorf("flow %q: conn %v -> %v: %w", f.ID(), conn.From, conn.To, err)
+	child := m.Child(FailedMsg{m, err, conn.To.Stage, 1})
+	if r.ctx.Err() == nil {
+		f.trace(r.ctx, TraceSendFrom{Time: time.Now(), ParentID: m.ID, Msg: child, Port: ErrorPort, Stage: f.stagePath(conn.To.Stage)})
+	}
+	f.publish(child.From(msg.NewAddr(conn.To.Stage, ErrorPort)))
+	f.dropped(r, conn.To.Stage, m.ID, err)
+}
+
+// Publishes a message onto the subject for its address, first tracing the number of
+// stages it will be delivered to and counting the deliveries as in flight. The deliveries
+// and the subscribers are read together under the lock, so that they agree even if the
+// flow is being reconfigured. A nested flow also counts the deliveries to its outputs,
+// which are in flight until its parent publishes them.
+func (f *Flow) publish(m msg.MsgFrom) {
+	f.mu.RLock()
+	r := f.run
+	stages, outputs := f.topo.deliveries(m.Addr)
+	matches := pubsub.Match(f.ps, f.SubjectFor(m.Addr))
+	f.mu.RUnlock()
+
+	for _, id := range stages {
+		f.inflight.add(f.stagePath(id), 1)
+	}
+	if f.path != "" {
+		f.inflight.add(f.path, outputs)
+	}
+	if r != nil {
+		f.trace(r.ctx, TraceRoute{time.Now(), m.ID, len(stages)})
+	}
+	// Buffer overflow errors are traced as failures by the drop handlers
+	_ = pubsub.Deliver(matches, m)
 }
 
 // Fulfill the HasSupervisor interface
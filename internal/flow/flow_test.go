@@ -0,0 +1,277 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"github.com/thejerf/suture/v4"
+)
+
+// A test stage that forwards each message from its "in" port to its "out" port
+type passthrough struct {
+	Base
+}
+
+var passthroughPorts = Ports{
+	In:  map[string]Port{"in": {}},
+	Out: map[string]Port{"out": {}},
+}
+
+func newPassthrough(id string) *passthrough {
+	return &passthrough{*NewBase(id).WithInOut(0).WithPorts(passthroughPorts)}
+}
+
+func (s *passthrough) Serve(ctx context.Context) error {
+	for {
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceRecv(m.ID)
+			s.TraceSend("out", m.Msg, m.Data)
+			s.TraceSuccess(m.ID)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Returns a feedback conn that allows three iterations
+func feedback(from, to msg.Addr) Conn {
+	return Conn{From: from, To: to, Feedback: true, MaxIterations: 3, Buffer: 10, Overflow: pubsub.Error}
+}
+
+func TestNewFlowValidatesConns(t *testing.T) {
+	a, b := msg.NewAddr, msg.NewAddr
+	tests := []struct {
+		name       string
+		inputConns []Conn
+		stageConns []Conn
+		flowConns  []Conn
+		want       string
+	}{
+		{"valid", nil, []Conn{{From: a("s1", "out"), To: b("s2", "in")}}, []Conn{SelfConn(a("s2", "out"))}, ""},
+		{"valid wildcard", nil, []Conn{{From: a("s1", "*"), To: b("s2", "in")}}, []Conn{{From: a("s2", "*"), To: b("*", "*")}}, ""},
+		{"from the error port", nil, []Conn{{From: a("s1", ErrorPort), To: b("s2", "in")}}, nil, ""},
+		{"missing from stage", nil, []Conn{{From: a("s0", "out"), To: b("s2", "in")}}, nil, `'from' stage does not exist: "s0"`},
+		{"missing to stage", nil, []Conn{{From: a("s1", "out"), To: b("s3", "in")}}, nil, `'to' stage does not exist: "s3"`},
+		{"from an input", nil, []Conn{{From: a("s1", "in"), To: b("s2", "in")}}, nil, `'from' port "in" is not an output of stage "s1"`},
+		{"to an output", nil, []Conn{{From: a("s1", "out"), To: b("s2", "out")}}, nil, `'to' port "out" is not an input of stage "s2"`},
+		{"to a wildcard", nil, []Conn{{From: a("s1", "out"), To: b("*", "in")}}, nil, "'to' address must not contain wildcards"},
+		{"unmatched wildcard", nil, []Conn{{From: a("*", "nope"), To: b("s2", "in")}}, nil, "'from' pattern does not match any stage output port"},
+		{"flow conn from an input", nil, nil, []Conn{SelfConn(a("s1", "in"))}, `'from' port "in" is not an output of stage "s1"`},
+		{"valid input", []Conn{{From: a("f", "docs"), To: b("s1", "in")}, {From: a("f", "docs"), To: b("s2", "in")}}, nil, nil, ""},
+		{"input from a stage", []Conn{{From: a("s2", "out"), To: b("s1", "in")}}, nil, nil, `'from' address must be a port of flow "f"`},
+		{"cycle", nil, []Conn{{From: a("s1", "out"), To: b("s2", "in")}, {From: a("s2", "out"), To: b("s1", "in")}}, nil, "found cycle: s1 -> s2 -> s1"},
+		{"wildcard cycle", nil, []Conn{{From: a("*", "out"), To: b("s2", "in")}}, nil, "found cycle: s2 -> s2"},
+		{"feedback cycle", nil, []Conn{{From: a("s1", "out"), To: b("s2", "in")}, feedback(a("s2", "out"), b("s1", "in"))}, nil, ""},
+		{"unbuffered feedback", nil, []Conn{{From: a("s2", "out"), To: b("s1", "in"), Feedback: true, MaxIterations: 3}}, nil, "feedback conn must be buffered"},
+		{"blocking feedback", nil, []Conn{{From: a("s2", "out"), To: b("s1", "in"), Feedback: true, MaxIterations: 3, Buffer: 1}}, nil, "must not block"},
+		{"feedback without a limit", nil, []Conn{{From: a("s2", "out"), To: b("s1", "in"), Feedback: true, Buffer: 1, Overflow: pubsub.Error}}, nil, "positive max iterations"},
+		{"limit without feedback", nil, []Conn{{From: a("s2", "out"), To: b("s1", "in"), MaxIterations: 3}}, nil, "only be set on feedback conns"},
+		{"feedback input", []Conn{{From: a("f", "docs"), To: b("s1", "in"), Feedback: true}}, nil, nil, "only stage conns can be feedback conns"},
+		{"input to an output", []Conn{{From: a("f", "docs"), To: b("s1", "out")}}, nil, nil, `'to' port "out" is not an input of stage "s1"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stages := []Stage{newPassthrough("s1"), newPassthrough("s2")}
+			_, err := NewFlow(NewBase("f").WithInOut(0), pubsub.NewPubSub(), stages, tt.inputConns, tt.stageConns, tt.flowConns)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFlowRejectsOverlappingPorts(t *testing.T) {
+	s := newPassthrough("s1")
+	s.WithPorts(Ports{In: map[string]Port{"x": {}}, Out: map[string]Port{"x": {}}})
+	_, err := NewFlow(NewBase("f").WithInOut(0), pubsub.NewPubSub(), []Stage{s}, nil, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), `port "x" is both an input and an output`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestNestedFlowInputPorts(t *testing.T) {
+	a := msg.NewAddr
+	ps := pubsub.NewPubSub()
+	inner, err := NewFlow(NewBase("inner").WithInOut(0), ps, []Stage{newPassthrough("s1")},
+		[]Conn{{From: a("inner", "docs"), To: a("s1", "in")}},
+		nil,
+		[]Conn{{From: a("s1", "out"), To: a("inner", "results")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, err := NewFlow(NewBase("outer").WithInOut(0).WithTrace(0), ps, []Stage{inner},
+		[]Conn{{From: a("outer", "in"), To: a("inner", "docs")}},
+		nil,
+		[]Conn{{From: a("inner", "results"), To: a("outer", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go outer.Serve(t.Context())
+
+	// An input on an unknown port fails rather than panicking
+	bad := msg.New("bad")
+	outer.In() <- bad.To(a("outer", "nope"))
+	for {
+		e := <-outer.Trace()
+		if e, ok := e.(TraceFailure); ok {
+			if e.ID != bad.ID {
+				t.Errorf("got failure for %v, want %v", e.ID, bad.ID)
+			}
+			break
+		}
+	}
+	go func() {
+		for range outer.Trace() {
+		}
+	}()
+
+	outer.In() <- msg.New("doc").To(a("outer", "in"))
+	select {
+	case m := <-outer.Out():
+		if m.Data != "doc" || m.Addr != a("outer", "out") {
+			t.Errorf("unexpected output %v", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for output")
+	}
+}
+
+func TestFeedbackLoopStopsAtIterationLimit(t *testing.T) {
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0).WithTrace(100), pubsub.NewPubSub(), []Stage{newPassthrough("s1")},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in")}},
+		[]Conn{feedback(a("s1", "out"), a("s1", "in"))},
+		[]Conn{{From: a("s1", "out"), To: a("f", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Serve(t.Context())
+
+	// The input goes around the loop three times, with an output each time
+	f.In() <- msg.New("x").To(a("f", "in"))
+	for want := range 4 {
+		select {
+		case m := <-f.Out():
+			if m.Iteration != want {
+				t.Errorf("got output with iteration %d, want %d", m.Iteration, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for output")
+		}
+	}
+	if e := nextTrace[TraceFailure](t, f); !errors.Is(e.Error, ErrIterationLimit) {
+		t.Errorf("got failure %v, want ErrIterationLimit", e.Error)
+	}
+}
+
+func TestTraceEventsAreAttributedToStages(t *testing.T) {
+	a := msg.NewAddr
+	ps := pubsub.NewPubSub()
+	s1 := &passthrough{*NewBase("s1").WithInOut(0).WithTrace(0).WithPorts(passthroughPorts)}
+	inner, err := NewFlow(NewBase("inner").WithInOut(0).WithTrace(0), ps, []Stage{s1},
+		[]Conn{{From: a("inner", "in"), To: a("s1", "in")}},
+		nil,
+		[]Conn{{From: a("s1", "out"), To: a("inner", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, err := NewFlow(NewBase("outer").WithInOut(0).WithTrace(0), ps, []Stage{inner},
+		[]Conn{{From: a("outer", "in"), To: a("inner", "in")}},
+		nil,
+		[]Conn{{From: a("inner", "out"), To: a("outer", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go outer.Serve(t.Context())
+	go func() {
+		for range outer.Out() {
+		}
+	}()
+
+	outer.In() <- msg.New("doc").To(a("outer", "in"))
+	seen := map[string]bool{}
+	for !seen["inner/s1"] || !seen["inner"] {
+		switch e := nextTrace[TraceSuccess](t, outer); e.Stage {
+		case "", "inner", "inner/s1":
+			seen[e.Stage] = true
+		default:
+			t.Fatalf("got success attributed to stage %q", e.Stage)
+		}
+	}
+}
+
+func TestConnBuffers(t *testing.T) {
+	a := msg.NewAddr
+	ps := pubsub.NewPubSub()
+	inner, err := NewFlow(NewBase("inner").WithInOut(0), ps, []Stage{newSlow("s1", time.Hour)},
+		[]Conn{{From: a("inner", "in"), To: a("s1", "in"), Buffer: 4, Overflow: pubsub.DropNewest}},
+		nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	outer, err := NewFlow(NewBase("outer").WithInOut(0), ps, []Stage{inner},
+		[]Conn{{From: a("outer", "in"), To: a("inner", "in")}},
+		nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bufs := outer.ConnBuffers(); len(bufs) != 0 {
+		t.Errorf("got buffers %+v before serving, want none", bufs)
+	}
+	go outer.Serve(t.Context())
+	for i := range 10 {
+		outer.In() <- msg.New(i).To(a("outer", "in"))
+	}
+
+	// The stage holds the first message and the buffer's goroutine the second,
+	// so four messages are buffered and the rest are dropped.
+	want := []ConnBuffer{{Path: "inner", From: a("inner", "in"), To: a("s1", "in"), Len: 4, Cap: 4, Dropped: 4}}
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := outer.ConnBuffers()
+		if len(got) == 1 && got[0] == want[0] {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got buffers %+v, want %+v", got, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlowStopsWithUnreadTrace(t *testing.T) {
+	// Nothing reads the flow's unbuffered trace channel, so its trace sends only
+	// return once the flow is stopping.
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0).WithTrace(0), pubsub.NewPubSub(), []Stage{newPassthrough("s1")},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in")}},
+		nil,
+		[]Conn{SelfConn(a("s1", "out"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() { errCh <- f.Serve(ctx) }()
+	f.In() <- msg.New(1).To(a("f", "in"))
+	cancel()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Serve to return")
+	}
+}
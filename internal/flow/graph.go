@@ -0,0 +1,93 @@
+package flow
+
+import (
+	"maps"
+	"slices"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/sublist"
+)
+
+// Returns the sorted IDs of the stages with an output port matching
+// the given 'from' address, which may contain wildcards.
+func (t *topology) stagesMatching(from msg.Addr) []string {
+	var ids []string
+	for _, addr := range t.sources(from) {
+		if !slices.Contains(ids, addr.Stage) {
+			ids = append(ids, addr.Stage)
+		}
+	}
+	return ids
+}
+
+// Returns the addresses of the stage output ports matching the given 'from' address,
+// which may contain wildcards, sorted by stage ID and then by port.
+func (t *topology) sources(from msg.Addr) []msg.Addr {
+	filter := t.subjectFor(from)
+	var addrs []msg.Addr
+	for _, id := range slices.Sorted(maps.Keys(t.stagesById)) {
+		for _, port := range slices.Sorted(maps.Keys(t.stagesById[id].Ports().Out)) {
+			addr := msg.NewAddr(id, port)
+			if sublist.SubjectMatchesFilter(t.subjectFor(addr), filter) {
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+	return addrs
+}
+
+// Returns the stage graph as a map from each stage ID to the sorted,
+// deduplicated IDs of the stages it sends messages to.
+func (t *topology) downstream(conns []Conn) map[string][]string {
+	edges := map[string][]string{}
+	for _, conn := range conns {
+		for _, from := range t.stagesMatching(conn.From) {
+			if !slices.Contains(edges[from], conn.To.Stage) {
+				edges[from] = append(edges[from], conn.To.Stage)
+			}
+		}
+	}
+	for _, tos := range edges {
+		slices.Sort(tos)
+	}
+	return edges
+}
+
+// Returns the stage IDs along some cycle in the graph, with the first
+// ID repeated at the end, or nil if the graph is acyclic.
+func findCycle(ids []string, edges map[string][]string) []string {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var path []string
+	var visit func(id string) []string
+	visit = func(id string) []string {
+		state[id] = visiting
+		path = append(path, id)
+		for _, next := range edges[id] {
+			switch state[next] {
+			case visiting:
+				start := slices.Index(path, next)
+				return append(slices.Clone(path[start:]), next)
+			case unvisited:
+				if cycle := visit(next); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[id] = visited
+		return nil
+	}
+	for _, id := range ids {
+		if state[id] == unvisited {
+			if cycle := visit(id); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
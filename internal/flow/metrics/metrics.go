@@ -0,0 +1,268 @@
+// Package metrics collects per-stage metrics from flow trace events and writes them
+// in the Prometheus text exposition format.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+)
+
+// Metrics for a single stage
+type Stage struct {
+	Received  int
+	Sent      int
+	Succeeded int
+	Failed    int // includes deliveries to the stage that the flow dropped
+	InFlight  int // messages received whose outcome has not yet been traced
+	// Messages waiting in the stage's In channel when the metrics were collected
+	QueueDepth int
+	// Time from the receipt of each message to its success or failure
+	Latency Histogram
+}
+
+// A histogram of durations in seconds
+type Histogram struct {
+	Bounds []float64 // inclusive upper bounds of the buckets, in increasing order
+	Counts []int     // observations in each bucket, followed by those above the last bound
+	Sum    float64
+	Count  int
+}
+
+// Default latency buckets in seconds, from a millisecond to a minute
+var DefaultBounds = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+func newHistogram(bounds []float64) Histogram {
+	return Histogram{Bounds: bounds, Counts: make([]int, len(bounds)+1)}
+}
+
+func (h *Histogram) observe(seconds float64) {
+	i, _ := slices.BinarySearch(h.Bounds, seconds)
+	h.Counts[i]++
+	h.Sum += seconds
+	h.Count++
+}
+
+// A Collector consumes the trace events of a flow and keeps metrics for each of its
+// stages, which are identified by their path within the flow (see flow.TraceRecv.Stage).
+// Events that are not attributed to a stage, such as the outcomes of the flow's own
+// inputs, are ignored.
+//
+// Latency is measured between the trace events of a stage, so stages without a trace
+// channel report only their queue depth, and messages that a stage never receives, such
+// as deliveries dropped by the flow, count towards its failures but not its latency.
+// When a stage fails (see flow.TraceStageFailure), the messages in flight at it are
+// forgotten, since it never traces their outcomes.
+type Collector struct {
+	queueDepths func() map[string]int
+	mu          sync.Mutex
+	stages      map[string]*stage
+}
+
+// Per-stage state
+type stage struct {
+	Stage
+	started map[msg.ID]time.Time // receipt times of messages in flight
+}
+
+// Returns a collector that reports queue depths from the given function, such
+// as the QueueDepths method of the observed flow. The function may be nil.
+func New(queueDepths func() map[string]int) *Collector {
+	return &Collector{queueDepths: queueDepths, stages: map[string]*stage{}}
+}
+
+// Observes trace events until the context is done or the channel is closed.
+func (c *Collector) Run(ctx context.Context, events <-chan flow.TraceEvent) {
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			c.Observe(e)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Updates the metrics with a single trace event.
+func (c *Collector) Observe(e flow.TraceEvent) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch e := e.(type) {
+	case flow.TraceRecv:
+		if s := c.stage(e.Stage); s != nil {
+			s.Received++
+			s.started[e.ID] = e.Time
+		}
+	case flow.TraceSendFrom:
+		if s := c.stage(e.Stage); s != nil {
+			s.Sent++
+		}
+	case flow.TraceSuccess:
+		if s := c.stage(e.Stage); s != nil {
+			s.Succeeded++
+			s.finish(e.ID, e.Time)
+		}
+	case flow.TraceFailure:
+		if s := c.stage(e.Stage); s != nil {
+			s.Failed++
+			s.finish(e.ID, e.Time)
+		}
+	case flow.TraceStageFailure:
+		// The messages in flight at the stage, or at the stages of a nested flow, are
+		// lost when it fails, whether it is restarted or stopped.
+		for path, s := range c.stages {
+			if path == e.Stage || strings.HasPrefix(path, e.Stage+"/") {
+				clear(s.started)
+			}
+		}
+	}
+}
+
+// Returns the state for the stage at the given path, creating it if needed,
+// or nil if the path is empty.
+func (c *Collector) stage(path string) *stage {
+	if path == "" {
+		return nil
+	}
+	s := c.stages[path]
+	if s == nil {
+		s = &stage{Stage: Stage{Latency: newHistogram(DefaultBounds)}, started: map[msg.ID]time.Time{}}
+		c.stages[path] = s
+	}
+	return s
+}
+
+// Records the outcome of a message, if the stage received it.
+func (s *stage) finish(id msg.ID, t time.Time) {
+	start, ok := s.started[id]
+	if !ok {
+		return
+	}
+	delete(s.started, id)
+	s.Latency.observe(t.Sub(start).Seconds())
+}
+
+// Returns the current metrics, by stage path. Stages with queue depths
+// are included even if none of their events have been observed.
+func (c *Collector) Snapshot() map[string]Stage {
+	var depths map[string]int
+	if c.queueDepths != nil {
+		depths = c.queueDepths()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := map[string]Stage{}
+	for path, s := range c.stages {
+		st := s.Stage
+		st.InFlight = len(s.started)
+		st.Latency.Counts = slices.Clone(st.Latency.Counts)
+		m[path] = st
+	}
+	for path, n := range depths {
+		st, ok := m[path]
+		if !ok {
+			st.Latency = newHistogram(DefaultBounds)
+		}
+		st.QueueDepth = n
+		m[path] = st
+	}
+	return m
+}
+
+// A metric family in the Prometheus text format
+type family struct {
+	name, kind, help string
+	value            func(Stage) int // unset for histograms
+}
+
+var families = []family{
+	{"datapotamus_stage_received_total", "counter", "Messages received by the stage.", func(s Stage) int { return s.Received }},
+	{"datapotamus_stage_sent_total", "counter", "Messages sent by the stage.", func(s Stage) int { return s.Sent }},
+	{"datapotamus_stage_succeeded_total", "counter", "Messages the stage processed successfully.", func(s Stage) int { return s.Succeeded }},
+	{"datapotamus_stage_failed_total", "counter", "Messages the stage failed to process, or that were dropped on their way to it.", func(s Stage) int { return s.Failed }},
+	{"datapotamus_stage_in_flight", "gauge", "Messages received by the stage whose outcome is not yet known.", func(s Stage) int { return s.InFlight }},
+	{"datapotamus_stage_queue_depth", "gauge", "Messages waiting in the stage's input channel.", func(s Stage) int { return s.QueueDepth }},
+	{"datapotamus_stage_latency_seconds", "histogram", "Time from the receipt of a message by the stage to its success or failure.", nil},
+}
+
+// Writes the metrics of each flow's stages, given by flow ID, in the Prometheus text
+// exposition format. Each sample is labeled with the flow ID and the stage path.
+func WritePrometheus(w io.Writer, flows map[string]map[string]Stage) error {
+	var b strings.Builder
+	for _, fam := range families {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", fam.name, fam.help, fam.name, fam.kind)
+		for _, id := range slices.Sorted(maps.Keys(flows)) {
+			stages := flows[id]
+			for _, path := range slices.Sorted(maps.Keys(stages)) {
+				s, labels := stages[path], fmt.Sprintf(`flow="%s",stage="%s"`, escape(id), escape(path))
+				if fam.value != nil {
+					fmt.Fprintf(&b, "%s{%s} %d\n", fam.name, labels, fam.value(s))
+					continue
+				}
+				h, n := s.Latency, 0
+				for i, bound := range h.Bounds {
+					n += h.Counts[i]
+					fmt.Fprintf(&b, "%s_bucket{%s,le=\"%s\"} %d\n", fam.name, labels, formatFloat(bound), n)
+				}
+				fmt.Fprintf(&b, "%s_bucket{%s,le=\"+Inf\"} %d\n", fam.name, labels, h.Count)
+				fmt.Fprintf(&b, "%s_sum{%s} %s\n", fam.name, labels, formatFloat(h.Sum))
+				fmt.Fprintf(&b, "%s_count{%s} %d\n", fam.name, labels, h.Count)
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// A metric family of buffered conns in the Prometheus text format
+type bufferFamily struct {
+	name, kind, help string
+	value            func(flow.ConnBuffer) int64
+}
+
+var bufferFamilies = []bufferFamily{
+	{"datapotamus_conn_buffer_length", "gauge", "Messages waiting in the conn's buffers.", func(b flow.ConnBuffer) int64 { return int64(b.Len) }},
+	{"datapotamus_conn_buffer_capacity", "gauge", "Total size of the conn's buffers.", func(b flow.ConnBuffer) int64 { return int64(b.Cap) }},
+	{"datapotamus_conn_dropped_total", "counter", "Messages dropped from the conn's buffers.", func(b flow.ConnBuffer) int64 { return b.Dropped }},
+}
+
+// Writes the statistics of each flow's buffered conns, given by flow ID (see
+// flow.Flow.ConnBuffers), in the Prometheus text exposition format. Each sample is
+// labeled with the flow ID, the path of the nested flow the conn belongs to, and the
+// stages and ports the conn connects.
+func WriteConnBuffers(w io.Writer, flows map[string][]flow.ConnBuffer) error {
+	var b strings.Builder
+	for _, fam := range bufferFamilies {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", fam.name, fam.help, fam.name, fam.kind)
+		for _, id := range slices.Sorted(maps.Keys(flows)) {
+			for _, buf := range flows[id] {
+				labels := fmt.Sprintf(`flow="%s",path="%s",from_stage="%s",from_port="%s",to_stage="%s",to_port="%s"`,
+					escape(id), escape(buf.Path), escape(buf.From.Stage), escape(buf.From.Port), escape(buf.To.Stage), escape(buf.To.Port))
+				fmt.Fprintf(&b, "%s{%s} %d\n", fam.name, labels, fam.value(buf))
+			}
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Escapes a label value for the Prometheus text format
+var escape = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
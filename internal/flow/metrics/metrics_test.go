@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+)
+
+func TestCollector(t *testing.T) {
+	c := New(func() map[string]int { return map[string]int{"a": 2, "idle": 1} })
+	t0 := time.Now()
+	m1, m2, m3 := msg.New(1), msg.New(2), msg.New(3)
+
+	c.Observe(flow.TraceRecv{Time: t0, ID: m1.ID}) // the flow's own input
+	c.Observe(flow.TraceRecv{Time: t0, ID: m1.ID, Stage: "a"})
+	c.Observe(flow.TraceSendFrom{Time: t0, ParentID: m1.ID, Msg: m1.Child(1), Stage: "a"})
+	c.Observe(flow.TraceSuccess{Time: t0.Add(20 * time.Millisecond), ID: m1.ID, Stage: "a"})
+	c.Observe(flow.TraceRecv{Time: t0, ID: m2.ID, Stage: "a"})
+	c.Observe(flow.TraceFailure{Time: t0.Add(2 * time.Second), ID: m2.ID, Error: errors.New("oops"), Stage: "a"})
+	c.Observe(flow.TraceRecv{Time: t0, ID: m3.ID, Stage: "a"})
+	c.Observe(flow.TraceFailure{Time: t0, ID: msg.New(4).ID, Error: errors.New("dropped"), Stage: "nested/b"})
+
+	got := c.Snapshot()
+	if len(got) != 3 {
+		t.Fatalf("got metrics for %d stages, want 3: %v", len(got), got)
+	}
+	a := got["a"]
+	if a.Received != 3 || a.Sent != 1 || a.Succeeded != 1 || a.Failed != 1 || a.InFlight != 1 || a.QueueDepth != 2 {
+		t.Errorf("unexpected metrics for a: %+v", a)
+	}
+	if a.Latency.Count != 2 || a.Latency.Counts[4] != 1 || a.Latency.Counts[10] != 1 {
+		t.Errorf("unexpected latency histogram for a: %+v", a.Latency)
+	}
+	if b := got["nested/b"]; b.Failed != 1 || b.Latency.Count != 0 {
+		t.Errorf("unexpected metrics for nested/b: %+v", b)
+	}
+	if idle := got["idle"]; idle.QueueDepth != 1 || len(idle.Latency.Counts) != len(DefaultBounds)+1 {
+		t.Errorf("unexpected metrics for idle: %+v", idle)
+	}
+}
+
+func TestCollectorForgetsMessagesOfFailedStages(t *testing.T) {
+	c := New(nil)
+	t0 := time.Now()
+	for _, path := range []string{"a", "ab", "nested/b", "other"} {
+		c.Observe(flow.TraceRecv{Time: t0, ID: msg.New(1).ID, Stage: path})
+	}
+	c.Observe(flow.TraceStageFailure{Time: t0, Stage: "a", Error: errors.New("oops"), Action: flow.Restart})
+	c.Observe(flow.TraceStageFailure{Time: t0, Stage: "nested", Error: errors.New("oops"), Action: flow.Isolate})
+
+	got := c.Snapshot()
+	for path, want := range map[string]int{"a": 0, "ab": 1, "nested/b": 0, "other": 1} {
+		if n := got[path].InFlight; n != want {
+			t.Errorf("got %d messages in flight at %s, want %d", n, path, want)
+		}
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	c := New(nil)
+	m, t0 := msg.New(1), time.Now()
+	c.Observe(flow.TraceRecv{Time: t0, ID: m.ID, Stage: `s"1`})
+	c.Observe(flow.TraceSuccess{Time: t0.Add(3 * time.Millisecond), ID: m.ID, Stage: `s"1`})
+
+	var b strings.Builder
+	if err := WritePrometheus(&b, map[string]map[string]Stage{"f": c.Snapshot()}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE datapotamus_stage_received_total counter\n",
+		`datapotamus_stage_received_total{flow="f",stage="s\"1"} 1` + "\n",
+		`datapotamus_stage_in_flight{flow="f",stage="s\"1"} 0` + "\n",
+		"# TYPE datapotamus_stage_latency_seconds histogram\n",
+		`datapotamus_stage_latency_seconds_bucket{flow="f",stage="s\"1",le="0.0025"} 0` + "\n",
+		`datapotamus_stage_latency_seconds_bucket{flow="f",stage="s\"1",le="0.005"} 1` + "\n",
+		`datapotamus_stage_latency_seconds_bucket{flow="f",stage="s\"1",le="+Inf"} 1` + "\n",
+		`datapotamus_stage_latency_seconds_count{flow="f",stage="s\"1"} 1` + "\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, b.String())
+		}
+	}
+}
+
+func TestWriteConnBuffers(t *testing.T) {
+	bufs := []flow.ConnBuffer{{From: msg.NewAddr("a", "out"), To: msg.NewAddr("b", "in"), Len: 2, Cap: 10, Dropped: 3}}
+	var b strings.Builder
+	if err := WriteConnBuffers(&b, map[string][]flow.ConnBuffer{"f": bufs}); err != nil {
+		t.Fatal(err)
+	}
+	labels := `flow="f",path="",from_stage="a",from_port="out",to_stage="b",to_port="in"`
+	for _, want := range []string{
+		"# TYPE datapotamus_conn_buffer_length gauge\n",
+		"datapotamus_conn_buffer_length{" + labels + "} 2\n",
+		"datapotamus_conn_buffer_capacity{" + labels + "} 10\n",
+		"# TYPE datapotamus_conn_dropped_total counter\n",
+		"datapotamus_conn_dropped_total{" + labels + "} 3\n",
+	} {
+		if !strings.Contains(b.String(), want) {
+			t.Errorf("output does not contain %q:\n%s", want, b.String())
+		}
+	}
+}
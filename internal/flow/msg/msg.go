@@ -15,11 +15,14 @@ type Msg struct {
 	ID     ID
 	Data   any
 	Tokens token.Tokens
+	// Number of times the message and its ancestors have been delivered
+	// along feedback conns, which limit how often a message can loop.
+	Iteration int
 }
 
 type Addr struct {
-	Stage string
-	Port  string
+	Stage string `json:"stage"`
+	Port  string `json:"port"`
 }
 
 // A message together with the stage/port address it is arriving to,
@@ -51,9 +54,10 @@ func NewWithID(id ID, data any) Msg {
 // Returns a new message that is a child of the parent message.
 func (m Msg) Child(data any) Msg {
 	return Msg{
-		Data:   data,
-		ID:     ID(common.NewID()),
-		Tokens: m.Tokens,
+		Data:      data,
+		ID:        ID(common.NewID()),
+		Tokens:    m.Tokens,
+		Iteration: m.Iteration,
 	}
 }
 
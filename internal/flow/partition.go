@@ -0,0 +1,31 @@
+package flow
+
+import (
+	"hash/fnv"
+
+	"datapotamus.com/internal/flow/msg"
+)
+
+// A Partition distributes the messages sent along a conn among the replicas of its 'to'
+// stage by key. Messages with the same key are always delivered to the same replica, in
+// the order they were sent, which preserves per-key ordering that random queue group
+// delivery would lose. Keys are hashed to choose a replica, so the assignment of keys
+// to replicas changes if the number of replicas does.
+type Partition struct {
+	// Extracts the key from a message. The delivery fails if it returns an error.
+	Key func(m msg.Msg) (string, error)
+	// Describes the key, such as the expression used to compute it
+	Description string
+}
+
+// Returns a partition by the key computed by the given function.
+func PartitionBy(description string, key func(m msg.Msg) (string, error)) *Partition {
+	return &Partition{Key: key, Description: description}
+}
+
+// Returns the index of the replica, out of n, that the key is assigned to.
+func (p *Partition) replica(key string, n int) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(n))
+}
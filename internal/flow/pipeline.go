@@ -0,0 +1,169 @@
+package flow
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+
+	"datapotamus.com/internal/flow/pubsub"
+)
+
+// A Pipeline is a Flow for completable DAG processing.
+//
+// Closing the pipeline's In channel closes the In channels of its input stages,
+// which are the stages connected to the pipeline's input ports.
+// Closes then propagate through the graph: each stage's In channel is closed once
+// every stage upstream of it has closed its Out channel. The pipeline closes its
+// own Out channel once every output stage (a stage feeding a flow conn) has closed,
+// and its Serve method returns once every stage has finished.
+//
+// For this to work, stages must close their Out channel once their In channel is
+// closed and they have finished processing, and the stage graph must be acyclic.
+type Pipeline struct {
+	*Flow
+}
+
+func NewPipeline(base *Base, ps *pubsub.PubSub, stages []Stage, inputConns []Conn, stageConns []Conn, flowConns []Conn, opts ...Option) (*Pipeline, error) {
+	f, err := NewFlow(base, ps, stages, inputConns, stageConns, flowConns, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := slices.Sorted(maps.Keys(f.topo.stagesById))
+	edges := f.topo.downstream(stageConns)
+	if cycle := findCycle(ids, edges); cycle != nil {
+		return nil, fmt.Errorf("pipeline: stage graph must be acyclic, found cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	c := &completion{
+		inputs:     map[string]bool{},
+		instances:  map[string]int{},
+		upstream:   map[string]int{},
+		downstream: edges,
+		outputs:    map[string]bool{},
+		open:       len(ids),
+		done:       make(chan struct{}),
+	}
+	for _, id := range ids {
+		c.instances[id] = len(instances(f.topo.stagesById[id]))
+	}
+	for _, conn := range inputConns {
+		if !c.inputs[conn.To.Stage] {
+			c.inputs[conn.To.Stage] = true
+			c.upstream[conn.To.Stage]++ // the pipeline's own input counts as an upstream
+		}
+	}
+	for _, tos := range edges {
+		for _, to := range tos {
+			c.upstream[to]++
+		}
+	}
+	for _, id := range ids {
+		if c.upstream[id] == 0 {
+			return nil, fmt.Errorf("pipeline: stage %q is neither an input nor downstream of one, so it would never be closed", id)
+		}
+	}
+	for _, conn := range flowConns {
+		for _, id := range f.topo.stagesMatching(conn.From) {
+			c.outputs[id] = true
+		}
+	}
+	if len(c.outputs) == 0 {
+		close(f.Ch.Out)
+	}
+
+	f.completion = c
+	return &Pipeline{f}, nil
+}
+
+// Tracks which stages are still open in a pipeline
+type completion struct {
+	mu         sync.Mutex
+	inputs     map[string]bool     // IDs of the input stages
+	instances  map[string]int      // Number of instances of each stage that have not closed their Out channel
+	upstream   map[string]int      // Number of open upstreams for each stage
+	downstream map[string][]string // Downstream stage IDs for each stage
+	outputs    map[string]bool     // IDs of the output stages that have not yet finished
+	open       int                 // Number of stages that have not yet finished
+	done       chan struct{}       // Closed once every stage has finished
+}
+
+// Called once the pipeline's In channel is closed
+func (c *completion) inputDone(f *Flow) {
+	c.mu.Lock()
+	var closing []string
+	for id := range c.inputs {
+		if c.closeUpstream(id) {
+			closing = append(closing, id)
+		}
+	}
+	c.mu.Unlock()
+	for _, id := range closing {
+		c.closeIn(f, id)
+	}
+}
+
+// Called once an instance of a stage has closed its Out channel, after it has published
+// all of its messages. The stage is done once all of its instances are.
+//
+// Buffered conns may still be delivering the stage's messages, so the stages downstream
+// of it, and the pipeline's Out channel, are only closed once the buffers of the conns
+// into them are empty. This waits without holding the lock, so that other stages can
+// finish meanwhile, and the stage only counts as finished afterwards, so that Serve does
+// not return while the buffers are in use.
+func (c *completion) stageDone(f *Flow, id string) {
+	c.mu.Lock()
+	c.instances[id]--
+	if c.instances[id] > 0 {
+		c.mu.Unlock()
+		return
+	}
+	var closing []string
+	for _, to := range c.downstream[id] {
+		if c.closeUpstream(to) {
+			closing = append(closing, to)
+		}
+	}
+	closeOut := false
+	if c.outputs[id] {
+		delete(c.outputs, id)
+		closeOut = len(c.outputs) == 0
+	}
+	c.mu.Unlock()
+
+	for _, to := range closing {
+		c.closeIn(f, to)
+	}
+	if closeOut {
+		f.flushFlowConns()
+		close(f.Ch.Out)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.open--
+	if c.open == 0 {
+		close(c.done)
+	}
+}
+
+// Records that one upstream of the stage has finished, and returns whether all of its
+// upstreams have, so that its instances should be closed. Must be called with the lock held.
+func (c *completion) closeUpstream(id string) bool {
+	c.upstream[id]--
+	return c.upstream[id] == 0
+}
+
+// Closes the In channel of each instance of the stage once the buffered conns into it
+// have delivered their messages.
+func (c *completion) closeIn(f *Flow, id string) {
+	f.flushStageConns(id)
+	f.mu.RLock()
+	s := f.topo.stagesById[id]
+	f.mu.RUnlock()
+	for _, inst := range instances(s) {
+		close(inst.In())
+	}
+}
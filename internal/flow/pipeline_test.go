@@ -0,0 +1,133 @@
+package flow
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"github.com/thejerf/suture/v4"
+)
+
+func TestPipelineCompletes(t *testing.T) {
+	// s1 fans out to s2 and s3, which both feed s4
+	stages := []Stage{newPassthrough("s1"), newPassthrough("s2"), newPassthrough("s3"), newPassthrough("s4")}
+	p, err := NewPipeline(NewBase("p").WithInOut(0), pubsub.NewPubSub(), stages,
+		[]Conn{{From: msg.NewAddr("p", "in"), To: msg.NewAddr("s1", "in")}},
+		[]Conn{
+			{From: msg.NewAddr("s1", "out"), To: msg.NewAddr("s2", "in")},
+			{From: msg.NewAddr("s1", "out"), To: msg.NewAddr("s3", "in")},
+			{From: msg.NewAddr("s2", "out"), To: msg.NewAddr("s4", "in")},
+			{From: msg.NewAddr("s3", "out"), To: msg.NewAddr("s4", "in")},
+		},
+		[]Conn{SelfConn(msg.NewAddr("s4", "out"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- p.Serve(t.Context()) }()
+
+	go func() {
+		for i := range 3 {
+			p.In() <- msg.New(i).To(msg.NewAddr("p", "in"))
+		}
+		close(p.In())
+	}()
+
+	// s4 receives each message from both s2 and s3
+	count := 0
+	timeout := time.After(time.Second)
+loop:
+	for {
+		select {
+		case _, ok := <-p.Out():
+			if !ok {
+				break loop
+			}
+			count++
+		case <-timeout:
+			t.Fatalf("timeout waiting for the pipeline to close its output after %d messages", count)
+		}
+	}
+	if count != 6 {
+		t.Errorf("got %d output messages, want 6", count)
+	}
+
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, suture.ErrDoNotRestart) {
+			t.Errorf("got Serve error %v, want ErrDoNotRestart", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Serve to return")
+	}
+}
+
+func TestPipelineWithBufferedConns(t *testing.T) {
+	// Every conn is buffered, so stages close while their messages may still be buffered
+	stages := []Stage{newPassthrough("s1"), newPassthrough("s2")}
+	p, err := NewPipeline(NewBase("p").WithInOut(0), pubsub.NewPubSub(), stages,
+		[]Conn{{From: msg.NewAddr("p", "in"), To: msg.NewAddr("s1", "in"), Buffer: 100}},
+		[]Conn{{From: msg.NewAddr("s1", "out"), To: msg.NewAddr("s2", "in"), Buffer: 100}},
+		[]Conn{{From: msg.NewAddr("s2", "out"), To: msg.NewAddr("p", "out"), Buffer: 100}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- p.Serve(t.Context()) }()
+
+	go func() {
+		for i := range 50 {
+			p.In() <- msg.New(i).To(msg.NewAddr("p", "in"))
+		}
+		close(p.In())
+	}()
+
+	count := 0
+	timeout := time.After(time.Second)
+loop:
+	for {
+		select {
+		case _, ok := <-p.Out():
+			if !ok {
+				break loop
+			}
+			count++
+		case <-timeout:
+			t.Fatalf("timeout waiting for the pipeline to close its output after %d messages", count)
+		}
+	}
+	if count != 50 {
+		t.Errorf("got %d output messages, want 50", count)
+	}
+	if err := <-errCh; !errors.Is(err, suture.ErrDoNotRestart) {
+		t.Errorf("got Serve error %v, want ErrDoNotRestart", err)
+	}
+}
+
+func TestNewPipelineValidation(t *testing.T) {
+	a := msg.NewAddr
+	tests := []struct {
+		name  string
+		conns []Conn
+		want  string
+	}{
+		{"cycle", []Conn{{From: a("s1", "out"), To: a("s2", "in")}, {From: a("s2", "out"), To: a("s1", "in")}}, "found cycle: s1 -> s2 -> s1"},
+		{"feedback cycle", []Conn{{From: a("s1", "out"), To: a("s2", "in")}, feedback(a("s2", "out"), a("s1", "in"))}, "found cycle: s1 -> s2 -> s1"},
+		{"unreachable stage", nil, `stage "s2" is neither an input nor downstream of one`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stages := []Stage{newPassthrough("s1"), newPassthrough("s2")}
+			inputs := []Conn{{From: a("p", "in"), To: a("s1", "in")}}
+			_, err := NewPipeline(NewBase("p").WithInOut(0), pubsub.NewPubSub(), stages, inputs, tt.conns, nil)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
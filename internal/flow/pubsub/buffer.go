@@ -0,0 +1,256 @@
+package pubsub
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"datapotamus.com/internal/flow/sublist"
+)
+
+// Determines what a buffered subscription does with a message
+// that is published to it while its buffer is full.
+type Overflow int
+
+const (
+	// Wait for room in the buffer, stalling the publisher as an unbuffered handler would
+	Block Overflow = iota
+	// Drop the published message
+	DropNewest
+	// Drop the oldest buffered message to make room for the published one
+	DropOldest
+	// Drop the published message and return ErrBufferFull from Pub
+	Error
+)
+
+var overflowNames = []string{"block", "drop-newest", "drop-oldest", "error"}
+
+func (o Overflow) String() string {
+	if o < 0 || int(o) >= len(overflowNames) {
+		return fmt.Sprintf("Overflow(%d)", int(o))
+	}
+	return overflowNames[o]
+}
+
+func (o Overflow) MarshalText() ([]byte, error) {
+	if o < 0 || int(o) >= len(overflowNames) {
+		return nil, fmt.Errorf("pubsub: unknown overflow policy %d", int(o))
+	}
+	return []byte(o.String()), nil
+}
+
+func (o *Overflow) UnmarshalText(text []byte) error {
+	for i, name := range overflowNames {
+		if string(text) == name {
+			*o = Overflow(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("pubsub: unknown overflow policy %q (expected one of %v)", text, overflowNames)
+}
+
+var (
+	// Returned from Pub when a subscriber with the Error policy has a full buffer
+	ErrBufferFull = errors.New("pubsub: subscriber buffer is full")
+	// Passed to drop handlers for messages dropped by the DropNewest and DropOldest
+	// policies, or that were still buffered when the subscription was cancelled.
+	ErrDropped = errors.New("pubsub: message dropped")
+)
+
+// A bounded buffer of messages for a single subscriber, delivered to
+// its handler on a dedicated goroutine so that publishers need not wait
+// for slow handlers (unless the overflow policy is Block).
+type buffer struct {
+	handler  any // the subscriber's handler, as stored in an unbuffered subscription
+	items    chan buffered
+	overflow Overflow
+	onDrop   func(subj string, message any, err error)
+	dropped  atomic.Int64
+	done     chan struct{}
+	once     sync.Once
+
+	mu      sync.Mutex
+	idle    *sync.Cond // signalled when pending reaches zero or the buffer is closed
+	pending int        // number of pushed messages that have not been handled or dropped
+	closed  bool
+}
+
+type buffered struct {
+	subj    string
+	message any
+	matches *sublist.SublistResult
+}
+
+func newBuffer(handler any, opts SubOptions) *buffer {
+	b := &buffer{
+		handler:  handler,
+		items:    make(chan buffered, opts.BufferSize),
+		overflow: opts.Overflow,
+		onDrop:   opts.OnDrop,
+		done:     make(chan struct{}),
+	}
+	b.idle = sync.NewCond(&b.mu)
+	go b.run()
+	return b
+}
+
+// Delivers buffered messages to the handler until the buffer is closed.
+func (b *buffer) run() {
+	for {
+		select {
+		case item := <-b.items:
+			invoke(b.handler, item.subj, item.message, item.matches)
+			b.finish()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// Adds a message to the buffer according to the overflow policy.
+func (b *buffer) push(item buffered) error {
+	// The buffer may be closed and drained while the message is enqueued, so
+	// drain it again afterwards so that the message is not stranded.
+	defer b.drainIfClosed()
+
+	b.mu.Lock()
+	b.pending++
+	b.mu.Unlock()
+
+	select {
+	case <-b.done:
+		b.drop(item, ErrDropped)
+		return nil
+	default:
+	}
+
+	switch b.overflow {
+	case Block:
+		select {
+		case b.items <- item:
+		case <-b.done:
+			b.drop(item, ErrDropped)
+		}
+	case DropNewest, Error:
+		select {
+		case b.items <- item:
+		default:
+			if b.overflow == Error {
+				b.drop(item, ErrBufferFull)
+				return ErrBufferFull
+			}
+			b.drop(item, ErrDropped)
+		}
+	case DropOldest:
+		for {
+			select {
+			case b.items <- item:
+				return nil
+			default:
+			}
+			select {
+			case old := <-b.items:
+				b.drop(old, ErrDropped)
+			default:
+			}
+		}
+	default:
+		panic(fmt.Sprintf("pubsub: unknown overflow policy %d", int(b.overflow)))
+	}
+	return nil
+}
+
+func (b *buffer) drop(item buffered, err error) {
+	b.dropped.Add(1)
+	if b.onDrop != nil {
+		b.onDrop(item.subj, item.message, err)
+	}
+	b.finish()
+}
+
+// Records that a pushed message has been handled or dropped.
+func (b *buffer) finish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.pending--; b.pending == 0 {
+		b.idle.Broadcast()
+	}
+}
+
+// Waits until every message pushed so far has been handled or dropped,
+// or the buffer is closed.
+func (b *buffer) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.pending > 0 && !b.closed {
+		b.idle.Wait()
+	}
+}
+
+// Stops delivery, dropping any messages that are still buffered.
+func (b *buffer) close() {
+	b.once.Do(func() {
+		close(b.done)
+		b.mu.Lock()
+		b.closed = true
+		b.idle.Broadcast()
+		b.mu.Unlock()
+		b.drainIfClosed()
+	})
+}
+
+// Drops the buffered messages if the buffer is closed.
+func (b *buffer) drainIfClosed() {
+	select {
+	case <-b.done:
+	default:
+		return
+	}
+	for {
+		select {
+		case item := <-b.items:
+			b.drop(item, ErrDropped)
+		default:
+			return
+		}
+	}
+}
+
+// Delivery statistics for a buffered subscription
+type BufferStats struct {
+	ID       string // ID of the subscription
+	Subject  string
+	Queue    string // Queue group, if any
+	FuncName string // Function in which the subscription was created
+	Len      int    // Number of buffered messages
+	Cap      int    // Buffer size
+	Dropped  int64  // Number of messages dropped, including those rejected by the Error policy
+}
+
+// Returns delivery statistics for each buffered subscription.
+func Buffers(ps *PubSub) []BufferStats {
+	var subs []*sublist.Subscription
+	ps.subs.All(&subs)
+	var stats []BufferStats
+	for _, sub := range subs {
+		b, ok := sub.Value.(*buffer)
+		if !ok {
+			continue
+		}
+		stats = append(stats, b.stats(sub))
+	}
+	return stats
+}
+
+func (b *buffer) stats(sub *sublist.Subscription) BufferStats {
+	return BufferStats{
+		ID:       sub.ID,
+		Subject:  string(sub.Subject),
+		Queue:    string(sub.Queue),
+		FuncName: sub.FuncName,
+		Len:      len(b.items),
+		Cap:      cap(b.items),
+		Dropped:  b.dropped.Load(),
+	}
+}
@@ -0,0 +1,197 @@
+package pubsub
+
+import (
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Subscribes a handler that blocks on the first message until released,
+// then publishes the given messages and releases the handler, returning
+// the messages it received, the dropped messages, and the Pub errors.
+func overflow(t *testing.T, policy Overflow, size int, messages []int) (got, dropped []int, errs []error) {
+	t.Helper()
+	ps := NewPubSub()
+	started, release := make(chan struct{}), make(chan struct{})
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	wg.Add(len(messages))
+	cancel := Sub(ps, "subj", func(subj string, m int) {
+		if m == messages[0] {
+			close(started)
+			<-release
+		}
+		mu.Lock()
+		got = append(got, m)
+		mu.Unlock()
+		wg.Done()
+	}, WithBuffer(size, policy), WithOnDrop(func(subj string, m any, err error) {
+		mu.Lock()
+		dropped = append(dropped, m.(int))
+		mu.Unlock()
+		wg.Done()
+	}))
+	defer cancel()
+
+	errs = append(errs, Pub(ps, "subj", messages[0]))
+	<-started
+	for _, m := range messages[1:] {
+		errs = append(errs, Pub(ps, "subj", m))
+	}
+	close(release)
+	wg.Wait()
+	return got, dropped, errs
+}
+
+func TestBufferOverflow(t *testing.T) {
+	messages := []int{0, 1, 2, 3, 4}
+	tests := []struct {
+		policy  Overflow
+		got     []int
+		dropped []int
+	}{
+		{DropNewest, []int{0, 1, 2}, []int{3, 4}},
+		{DropOldest, []int{0, 3, 4}, []int{1, 2}},
+		{Error, []int{0, 1, 2}, []int{3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			got, dropped, errs := overflow(t, tt.policy, 2, messages)
+			if !slices.Equal(got, tt.got) {
+				t.Errorf("got messages %v, want %v", got, tt.got)
+			}
+			if !slices.Equal(dropped, tt.dropped) {
+				t.Errorf("got dropped messages %v, want %v", dropped, tt.dropped)
+			}
+			for i, err := range errs {
+				wantErr := tt.policy == Error && slices.Contains(tt.dropped, messages[i])
+				if errors.Is(err, ErrBufferFull) != wantErr {
+					t.Errorf("message %d: got Pub error %v", messages[i], err)
+				}
+			}
+		})
+	}
+}
+
+func TestBufferBlockDoesNotStallOtherSubscribers(t *testing.T) {
+	ps := NewPubSub()
+	release := make(chan struct{})
+	defer close(release)
+	cancelSlow := Sub(ps, "subj", func(subj string, m int) { <-release }, WithBuffer(1, Block))
+	defer cancelSlow()
+	fast := SubChan[int](ps, t.Context(), "subj", 10)
+
+	// The slow subscriber's goroutine holds the first message and its buffer holds the
+	// second, so publishing only stalls once both are occupied.
+	done := make(chan struct{})
+	go func() {
+		Pub(ps, "subj", 1)
+		Pub(ps, "subj", 2)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("publisher stalled on a slow buffered subscriber")
+	}
+	for _, want := range []int{1, 2} {
+		if got := <-fast; got != want {
+			t.Errorf("got %d, want %d", got, want)
+		}
+	}
+
+	stats := Buffers(ps)
+	if len(stats) != 1 || stats[0].Cap != 1 || stats[0].Dropped != 0 {
+		t.Errorf("unexpected buffer stats %+v", stats)
+	}
+}
+
+func TestOverflowText(t *testing.T) {
+	for _, o := range []Overflow{Block, DropNewest, DropOldest, Error} {
+		text, err := o.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Overflow
+		if err := got.UnmarshalText(text); err != nil || got != o {
+			t.Errorf("round trip of %v: got %v, %v", o, got, err)
+		}
+	}
+	var o Overflow
+	if err := o.UnmarshalText([]byte("drop-all")); err == nil {
+		t.Error("expected an error for an unknown policy")
+	}
+}
+
+func TestBufferFlush(t *testing.T) {
+	ps := NewPubSub()
+	var mu sync.Mutex
+	var got []int
+	var flush func()
+	cancel := Sub(ps, "subj", func(subj string, m int) {
+		time.Sleep(time.Millisecond)
+		mu.Lock()
+		got = append(got, m)
+		mu.Unlock()
+	}, WithBuffer(10, Block), WithFlush(&flush))
+	defer cancel()
+
+	for m := range 5 {
+		Pub(ps, "subj", m)
+	}
+	flush()
+	mu.Lock()
+	defer mu.Unlock()
+	if !slices.Equal(got, []int{0, 1, 2, 3, 4}) {
+		t.Errorf("got messages %v after flushing, want all of them", got)
+	}
+}
+
+func TestBufferPushRacesClose(t *testing.T) {
+	for _, policy := range []Overflow{Block, DropNewest, DropOldest, Error} {
+		t.Run(policy.String(), func(t *testing.T) {
+			for range 200 {
+				// The handler holds the first message until the buffer is closed, so that
+				// the buffer fills up while the pushes race the close.
+				var handled, dropped atomic.Int64
+				release := make(chan struct{})
+				b := newBuffer(func(subj string, m any) {
+					<-release
+					handled.Add(1)
+				}, SubOptions{
+					BufferSize: 2,
+					Overflow:   policy,
+					OnDrop:     func(subj string, m any, err error) { dropped.Add(1) },
+				})
+				const n = 10
+				var wg sync.WaitGroup
+				start := make(chan struct{})
+				for range n {
+					wg.Go(func() {
+						<-start
+						b.push(buffered{subj: "subj", message: 1})
+					})
+				}
+				wg.Go(func() {
+					<-start
+					b.close()
+					close(release)
+				})
+				close(start)
+				wg.Wait()
+
+				// The delivery goroutine may still be handling a message it took before the close
+				deadline := time.Now().Add(time.Second)
+				for handled.Load()+dropped.Load() != n {
+					if time.Now().After(deadline) {
+						t.Fatalf("got %d messages handled or dropped, want %d", handled.Load()+dropped.Load(), n)
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package pubsub
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"math/rand/v2"
 	"runtime"
 
@@ -24,6 +26,15 @@ type SubOptions struct {
 	SkipCallers int    // Call stack depth to record caller information from for this subscription
 	Queue       []byte // Queue name for the sublist queue group
 	Debug       bool   // Whether or not this is a debug subscription
+
+	// Buffered subscriptions receive messages through their own bounded
+	// buffer and delivery goroutine, rather than on the publisher's goroutine.
+	Buffered   bool
+	BufferSize int                                       // Capacity of the buffer
+	Overflow   Overflow                                  // What to do when a message arrives while the buffer is full
+	OnDrop     func(subj string, message any, err error) // Called with each dropped message; may be nil
+	Flush      *func()                                   // If set, receives the buffer's flush function
+	Stats      *func() BufferStats                       // If set, receives a function returning the buffer's statistics
 }
 
 // Core subscribe function.
@@ -38,6 +49,16 @@ func sub(ps *PubSub, subj string, handler any, options ...SubOption) context.Can
 		opt(&opts)
 	}
 
+	// Buffered subscriptions store their buffer, which wraps the handler
+	var buf *buffer
+	if opts.Buffered {
+		buf = newBuffer(handler, opts)
+		handler = buf
+		if opts.Flush != nil {
+			*opts.Flush = buf.flush
+		}
+	}
+
 	// Create the underlyng Subscription object, giving it a unique ID
 	id := common.NewID()
 	sub := sublist.Subscription{Subject: []byte(subj), Value: handler, ID: id, Queue: opts.Queue, Debug: opts.Debug}
@@ -51,6 +72,9 @@ func sub(ps *PubSub, subj string, handler any, options ...SubOption) context.Can
 			sub.FuncName = fn.Name()
 		}
 	}
+	if buf != nil && opts.Stats != nil {
+		*opts.Stats = func() BufferStats { return buf.stats(&sub) }
+	}
 	err := ps.subs.Insert(&sub)
 	if err != nil {
 		panic(err) // only possible error is "invalid subject" which is programmer error.
@@ -61,6 +85,9 @@ func sub(ps *PubSub, subj string, handler any, options ...SubOption) context.Can
 		if err != nil && err != sublist.ErrNotFound {
 			panic(err) // only possible error is "invalid subject" which is programmer error.
 		}
+		if buf != nil {
+			buf.close()
+		}
 	}
 }
 
@@ -111,13 +138,34 @@ func SubChan[M any](ps *PubSub, ctx context.Context, subj string, bufSize int, o
 }
 
 // Publish a message onto the given subject.
-func Pub[M any](ps *PubSub, subj string, message M) {
+// Returns an error wrapping ErrBufferFull if any buffered subscriber
+// with the Error overflow policy could not accept the message.
+func Pub[M any](ps *PubSub, subj string, message M) error {
+	return Deliver(Match(ps, subj), message)
+}
+
+// The subscribers matching a subject at a point in time.
+// Publishing can be split into Match and Deliver so that callers can
+// inspect or coordinate the set of matching subscribers before delivery.
+type Matches struct {
+	subj   string
+	result *sublist.SublistResult
+}
+
+// Returns the subscribers currently matching the subject.
+func Match(ps *PubSub, subj string) Matches {
+	return Matches{subj: subj, result: ps.subs.Match(subj)}
+}
+
+// Delivers a message to previously matched subscribers. See [Pub].
+func Deliver[M any](matches Matches, message M) error {
 	// Matches is a *sublist.SublistResult type from the NATS server.
 	// - Psubs are plain subscribers
 	// - Qsubs are queue group subscribers
-	matches := ps.subs.Match(subj)
-	for _, sub := range matches.Psubs {
-		pub(subj, message, sub, matches)
+	subj, result := matches.subj, matches.result
+	var errs []error
+	for _, sub := range result.Psubs {
+		errs = append(errs, pub(subj, message, sub, result))
 	}
 
 	// TODO: Explore the "least loaded of 2 random options" idea, for which
@@ -130,22 +178,34 @@ func Pub[M any](ps *PubSub, subj string, message M) {
 	// >  just O(log n). But if (instead of choosing randomly) we choose the least loaded of k random bins, the maximum
 	// > is O(log log n / log k) with high probability, i.e., even with two random choices, it's basically O(log log n)
 	// > and each additional choice only reduces the load by a constant factor.
-	for _, subs := range matches.Qsubs {
+	for _, subs := range result.Qsubs {
 		// Publish to a random subscriber from each queue group
 		sub := subs[rand.IntN(len(subs))]
-		pub(subj, message, sub, matches)
+		errs = append(errs, pub(subj, message, sub, result))
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("pubsub: publish to %s: %w", subj, err)
 	}
+	return nil
 }
 
 // Publish a message onto the given subject for the given subscriber.
-func pub[M any](subj string, message M, sub *sublist.Subscription, matches *sublist.SublistResult) {
-	if sub.Debug {
+func pub[M any](subj string, message M, sub *sublist.Subscription, matches *sublist.SublistResult) error {
+	if b, ok := sub.Value.(*buffer); ok {
+		return b.push(buffered{subj, message, matches})
+	}
+	invoke(sub.Value, subj, message, matches)
+	return nil
+}
+
+// Invokes a subscription handler with the given message.
+func invoke(handler any, subj string, message any, matches *sublist.SublistResult) {
+	switch handler := handler.(type) {
+	case func(string, any, *sublist.SublistResult):
 		// DebugSub handlers are passed the subscriptions that matched this pub subject.
-		handler := sub.Value.(func(string, any, *sublist.SublistResult))
 		handler(subj, message, matches)
-	} else {
+	case func(string, any):
 		// Regular handlers are invoked with the subject and message.
-		handler := sub.Value.(func(string, any))
 		handler(subj, message)
 	}
 }
@@ -173,3 +233,45 @@ func WithQueueGroup(name string) SubOption {
 		s.Queue = []byte(name)
 	}
 }
+
+// Gives the subscriber its own buffer of the given size, which must be positive,
+// and a goroutine that delivers buffered messages to the handler in order.
+// The overflow policy determines what happens when the buffer is full.
+func WithBuffer(size int, overflow Overflow) SubOption {
+	if size <= 0 {
+		panic(fmt.Sprintf("pubsub: buffer size must be positive, got %d", size))
+	}
+	return func(s *SubOptions) {
+		s.Buffered = true
+		s.BufferSize = size
+		s.Overflow = overflow
+	}
+}
+
+// Sets *flush to a function that waits until every message published to a buffered
+// subscriber so far has been handled or dropped, such as before closing whatever the
+// handler delivers to. Unbuffered subscribers handle messages as they are published,
+// so *flush is left unchanged for them.
+func WithFlush(flush *func()) SubOption {
+	return func(s *SubOptions) {
+		s.Flush = flush
+	}
+}
+
+// Sets *stats to a function that returns the delivery statistics of a buffered
+// subscriber, as reported by Buffers. Like WithFlush, it leaves *stats unchanged
+// for unbuffered subscribers.
+func WithStats(stats *func() BufferStats) SubOption {
+	return func(s *SubOptions) {
+		s.Stats = stats
+	}
+}
+
+// Sets a function to be called with each message dropped by a buffered subscriber,
+// along with ErrBufferFull or ErrDropped. It is called on the publisher's goroutine,
+// or for messages still buffered when the subscription is cancelled, on the canceller's.
+func WithOnDrop(fn func(subj string, message any, err error)) SubOption {
+	return func(s *SubOptions) {
+		s.OnDrop = fn
+	}
+}
@@ -0,0 +1,143 @@
+package flow
+
+import (
+	"errors"
+	"slices"
+)
+
+// Connections of each kind, as passed to NewFlow
+type Conns struct {
+	Input []Conn
+	Stage []Conn
+	Flow  []Conn
+}
+
+// An Edit describes a change to the stages and connections of a flow.
+// Removals are applied before additions, so an edit can replace a stage
+// by removing it and adding a new stage with the same ID.
+type Edit struct {
+	RemoveStages []string
+	RemoveConns  Conns
+	AddStages    []Stage
+	AddConns     Conns
+}
+
+// Applies an edit to the flow atomically: the edited flow is validated as a whole
+// as if by NewFlow, and if it is invalid, the flow is left unchanged.
+//
+// If the flow is serving, removed stages are stopped and added stages are started
+// under the flow's supervisor, and only the subscriptions for removed conns and for
+// conns to removed stages are cancelled, so messages on unaffected paths keep flowing.
+// Messages queued at a removed stage are dropped, and deliveries that were in progress
+// along a removed conn are traced as failures.
+//
+// Pipelines cannot be reconfigured, since their close propagation depends on a fixed graph.
+// Reconfiguring a flow may change its ports, so a flow that is nested in another flow
+// should keep the ports that its parent connects to.
+func (f *Flow) Apply(e Edit) error {
+	return f.edit(func(*topology) Edit { return e })
+}
+
+// Adds a stage to the flow. See Apply.
+func (f *Flow) AddStage(s Stage) error {
+	return f.Apply(Edit{AddStages: []Stage{s}})
+}
+
+// Removes a stage from the flow, along with every conn whose address names it.
+// Conns with a wildcard 'from' address are kept, so one that only matches the removed
+// stage must be removed explicitly, in the same edit, by calling Apply. See Apply.
+func (f *Flow) RemoveStage(id string) error {
+	return f.edit(func(t *topology) Edit {
+		return Edit{
+			RemoveStages: []string{id},
+			RemoveConns: Conns{
+				Input: connsNaming(t.inputConns, id),
+				Stage: connsNaming(t.stageConns, id),
+				Flow:  connsNaming(t.flowConns, id),
+			},
+		}
+	})
+}
+
+// Adds conns to the flow. See Apply.
+func (f *Flow) AddConns(conns Conns) error {
+	return f.Apply(Edit{AddConns: conns})
+}
+
+// Removes conns from the flow. See Apply.
+func (f *Flow) RemoveConns(conns Conns) error {
+	return f.Apply(Edit{RemoveConns: conns})
+}
+
+// Applies the edit returned by the given function, which is called with the current topology.
+func (f *Flow) edit(edit func(*topology) Edit) error {
+	if f.completion != nil {
+		return errors.New("flow: pipelines cannot be reconfigured")
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	e := edit(f.topo)
+	topo, err := f.topo.edit(e)
+	if err != nil {
+		return err
+	}
+	f.topo = topo
+
+	r := f.run
+	if r == nil || r.ctx.Err() != nil {
+		return nil // the flow starts its stages and subscriptions when it is served
+	}
+
+	removed := map[string]bool{}
+	for _, id := range e.RemoveStages {
+		removed[id] = true
+		f.stopStage(id)
+	}
+
+	var stageConns, flowConns []Conn
+	r.stageSubs, stageConns = resubscribe(r.stageSubs, slices.Concat(topo.inputConns, topo.stageConns),
+		func(sub *subscription) bool { return !removed[sub.conn.To.Stage] })
+	r.flowSubs, flowConns = resubscribe(r.flowSubs, topo.flowConns,
+		func(*subscription) bool { return true })
+
+	for _, s := range e.AddStages {
+		f.startStage(s)
+	}
+	for _, conn := range stageConns {
+		f.subscribeStage(conn)
+	}
+	for _, conn := range flowConns {
+		f.subscribeFlow(conn)
+	}
+	return nil
+}
+
+// Cancels the subscriptions whose conns are no longer present or that should not be kept,
+// returning the remaining subscriptions along with the conns that still need subscribing.
+func resubscribe(subs []*subscription, conns []Conn, keep func(*subscription) bool) ([]*subscription, []Conn) {
+	conns = slices.Clone(conns)
+	var kept []*subscription
+	for _, sub := range subs {
+		i := slices.Index(conns, sub.conn)
+		if i >= 0 && keep(sub) {
+			kept = append(kept, sub)
+			conns = slices.Delete(conns, i, i+1)
+		} else {
+			sub.cancel()
+		}
+	}
+	return kept, conns
+}
+
+// Returns the conns whose 'from' or 'to' address names the given stage
+func connsNaming(conns []Conn, id string) []Conn {
+	var named []Conn
+	for _, conn := range conns {
+		if conn.From.Stage == id || conn.To.Stage == id {
+			named = append(named, conn)
+		}
+	}
+	return named
+}
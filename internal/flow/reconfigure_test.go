@@ -0,0 +1,103 @@
+package flow
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+)
+
+// Sends a message to the flow's "in" port and returns the sorted output ports it reaches.
+func roundTrip(t *testing.T, f *Flow, want int) []string {
+	t.Helper()
+	f.In() <- msg.New("doc").To(msg.NewAddr(f.ID(), "in"))
+	var ports []string
+	timeout := time.After(time.Second)
+	for range want {
+		select {
+		case m := <-f.Out():
+			ports = append(ports, m.Port)
+		case <-timeout:
+			t.Fatalf("timeout waiting for output, got %v", ports)
+		}
+	}
+	select {
+	case m := <-f.Out():
+		t.Fatalf("unexpected output %v", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+	slices.Sort(ports)
+	return ports
+}
+
+func TestFlowReconfigure(t *testing.T) {
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0), pubsub.NewPubSub(), []Stage{newPassthrough("s1")},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in")}},
+		nil,
+		[]Conn{{From: a("s1", "out"), To: a("f", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Serve(t.Context())
+
+	if got := roundTrip(t, f, 1); !slices.Equal(got, []string{"out"}) {
+		t.Errorf("got outputs on %v before adding s2", got)
+	}
+
+	// An invalid edit leaves the flow unchanged
+	err = f.Apply(Edit{
+		AddStages: []Stage{newPassthrough("s2")},
+		AddConns:  Conns{Stage: []Conn{{From: a("s1", "out"), To: a("s3", "in")}}},
+	})
+	if err == nil || !strings.Contains(err.Error(), `'to' stage does not exist: "s3"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Tee s1's output through a new stage to a new flow output
+	err = f.Apply(Edit{
+		AddStages: []Stage{newPassthrough("s2")},
+		AddConns: Conns{
+			Stage: []Conn{{From: a("s1", "out"), To: a("s2", "in")}},
+			Flow:  []Conn{{From: a("s2", "out"), To: a("f", "copy")}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Ports().HasOut("copy") {
+		t.Errorf("expected flow output port %q after adding it", "copy")
+	}
+	if got := roundTrip(t, f, 2); !slices.Equal(got, []string{"copy", "out"}) {
+		t.Errorf("got outputs on %v after adding s2", got)
+	}
+
+	// Removing the stage also removes its conns and the flow port they declared
+	if err := f.RemoveStage("s2"); err != nil {
+		t.Fatal(err)
+	}
+	if f.Ports().HasOut("copy") {
+		t.Errorf("unexpected flow output port %q after removing s2", "copy")
+	}
+	if got := roundTrip(t, f, 1); !slices.Equal(got, []string{"out"}) {
+		t.Errorf("got outputs on %v after removing s2", got)
+	}
+
+	if err := f.RemoveStage("s2"); err == nil || !strings.Contains(err.Error(), `cannot remove stage "s2"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestPipelineRejectsReconfigure(t *testing.T) {
+	p, err := NewPipeline(NewBase("p").WithInOut(0), pubsub.NewPubSub(), []Stage{newPassthrough("s1")},
+		[]Conn{{From: msg.NewAddr("p", "in"), To: msg.NewAddr("s1", "in")}}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.AddStage(newPassthrough("s2")); err == nil {
+		t.Error("expected an error reconfiguring a pipeline")
+	}
+}
@@ -0,0 +1,109 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"datapotamus.com/internal/common"
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/validator"
+)
+
+// Stage configs validate themselves by recording problems on the validator.
+type Config interface {
+	Validate(v *validator.Validator)
+}
+
+// A Kind describes a type of stage that can be constructed from a declarative config.
+type Kind struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Ports declared by stages of this kind, including the error port
+	Ports flow.Ports `json:"ports"`
+	// The zero value of the kind's config struct, which documents its fields
+	Config any `json:"config"`
+
+	build func(base *flow.Base, config json.RawMessage) (flow.Stage, error)
+}
+
+// A Registry maps stage kind names to their descriptions and constructors.
+type Registry struct {
+	kinds map[string]Kind
+}
+
+func New() *Registry {
+	return &Registry{kinds: map[string]Kind{}}
+}
+
+// Registers a stage kind together with a typed constructor. The config is decoded
+// strictly from JSON and validated before the constructor is called.
+// Registering the same kind name twice is a programmer error and panics.
+func Register[C Config, S flow.Stage](r *Registry, kind Kind, build func(*flow.Base, C) (S, error)) {
+	if kind.Name == "" {
+		panic("registry: kind name must not be empty")
+	}
+	if _, ok := r.kinds[kind.Name]; ok {
+		panic(fmt.Sprintf("registry: kind %q already registered", kind.Name))
+	}
+	var zero C
+	kind.Config = zero
+	kind.Ports = kind.Ports.WithErrorPort()
+	kind.build = func(base *flow.Base, config json.RawMessage) (flow.Stage, error) {
+		var cfg C
+		if len(config) > 0 {
+			if err := common.DecodeJSONStrict(config, &cfg); err != nil {
+				return nil, fmt.Errorf("config: %w", err)
+			}
+		}
+		var v validator.Validator
+		cfg.Validate(&v)
+		if v.HasErrors() {
+			return nil, &ConfigError{Kind: kind.Name, Validator: v}
+		}
+		return build(base, cfg)
+	}
+	r.kinds[kind.Name] = kind
+}
+
+// Returns the kind with the given name, if it is registered.
+func (r *Registry) Lookup(name string) (Kind, bool) {
+	k, ok := r.kinds[name]
+	return k, ok
+}
+
+// Returns all registered kinds, sorted by name.
+func (r *Registry) Kinds() []Kind {
+	var kinds []Kind
+	for _, name := range slices.Sorted(maps.Keys(r.kinds)) {
+		kinds = append(kinds, r.kinds[name])
+	}
+	return kinds
+}
+
+// Constructs a stage of the given kind from its base and raw JSON config.
+func (r *Registry) New(kind string, base *flow.Base, config json.RawMessage) (flow.Stage, error) {
+	k, ok := r.kinds[kind]
+	if !ok {
+		return nil, fmt.Errorf("unknown stage kind %q", kind)
+	}
+	return k.build(base, config)
+}
+
+// Returned when a stage config fails validation.
+// The embedded validator can be rendered directly as an API response.
+type ConfigError struct {
+	Kind      string
+	Validator validator.Validator
+}
+
+func (e *ConfigError) Error() string {
+	var problems []string
+	problems = append(problems, e.Validator.Errors...)
+	for _, key := range slices.Sorted(maps.Keys(e.Validator.FieldErrors)) {
+		problems = append(problems, fmt.Sprintf("%s: %s", key, e.Validator.FieldErrors[key]))
+	}
+	return fmt.Sprintf("invalid %s config: %s", e.Kind, strings.Join(problems, "; "))
+}
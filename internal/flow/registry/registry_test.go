@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/validator"
+)
+
+type nopConfig struct {
+	Count int `json:"count"`
+}
+
+func (c nopConfig) Validate(v *validator.Validator) {
+	v.CheckField(c.Count > 0, "count", "must be greater than zero")
+}
+
+type nop struct {
+	flow.Base
+	count int
+}
+
+func (s *nop) Serve(ctx context.Context) error {
+	<-ctx.Done()
+	return nil
+}
+
+func newTestRegistry() *Registry {
+	r := New()
+	Register(r, Kind{Name: "nop"}, func(base *flow.Base, cfg nopConfig) (*nop, error) {
+		return &nop{*base, cfg.Count}, nil
+	})
+	return r
+}
+
+func TestRegistryNew(t *testing.T) {
+	r := newTestRegistry()
+
+	s, err := r.New("nop", flow.NewBase("a").WithInOut(0), []byte(`{"count": 3}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID() != "a" || s.(*nop).count != 3 {
+		t.Errorf("unexpected stage: %#v", s)
+	}
+
+	_, err = r.New("nop", flow.NewBase("a"), []byte(`{"count": 0}`))
+	var cfgErr *ConfigError
+	if !errors.As(err, &cfgErr) || cfgErr.Validator.FieldErrors["count"] == "" {
+		t.Errorf("expected a config validation error for count, got %v", err)
+	}
+
+	_, err = r.New("nop", flow.NewBase("a"), []byte(`{"cuont": 1}`))
+	if err == nil {
+		t.Error("expected an error for an unknown config field")
+	}
+
+	_, err = r.New("missing", flow.NewBase("a"), nil)
+	if err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+}
+
+func TestRegistryDuplicateKindPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("expected duplicate registration to panic")
+		}
+	}()
+	r := newTestRegistry()
+	Register(r, Kind{Name: "nop"}, func(base *flow.Base, cfg nopConfig) (*nop, error) {
+		return nil, nil
+	})
+}
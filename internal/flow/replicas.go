@@ -0,0 +1,81 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+
+	"datapotamus.com/internal/flow/msg"
+	"github.com/thejerf/suture/v4"
+)
+
+// Replicas is a stage that runs as several interchangeable instances, which
+// is useful for scaling CPU-heavy or slow I/O stages.
+//
+// A flow starts every replica under its supervisor and subscribes their inputs to
+// each conn as one pubsub queue group, so that every message sent to the stage is
+// delivered to exactly one replica. The outputs of every replica are published under
+// the stage's ID, and for pipelines, the stage closes once every replica has closed.
+//
+// Replicas only run inside a flow. Its channel methods return those of the first
+// replica, which allows it to be validated like any other stage.
+type Replicas struct {
+	stages []Stage
+}
+
+// Returns a stage made of the given replicas, which must share an ID and ports.
+func NewReplicas(stages ...Stage) (*Replicas, error) {
+	if len(stages) == 0 {
+		return nil, errors.New("flow: replicas: at least one replica is required")
+	}
+	first := stages[0]
+	for _, s := range stages[1:] {
+		if s.ID() != first.ID() {
+			return nil, fmt.Errorf("flow: replicas: replica id %q differs from %q", s.ID(), first.ID())
+		}
+		if !maps.Equal(s.Ports().In, first.Ports().In) || !maps.Equal(s.Ports().Out, first.Ports().Out) {
+			return nil, fmt.Errorf("flow: replicas: replicas of %q declare different ports", first.ID())
+		}
+	}
+	return &Replicas{stages: stages}, nil
+}
+
+// Returns the replicas
+func (r *Replicas) Stages() []Stage {
+	return r.stages
+}
+
+func (r *Replicas) ID() string {
+	return r.stages[0].ID()
+}
+
+func (r *Replicas) In() chan<- msg.MsgTo {
+	return r.stages[0].In()
+}
+
+func (r *Replicas) Out() <-chan msg.MsgFrom {
+	return r.stages[0].Out()
+}
+
+func (r *Replicas) Trace() <-chan TraceEvent {
+	return r.stages[0].Trace()
+}
+
+func (r *Replicas) Ports() Ports {
+	return r.stages[0].Ports()
+}
+
+// Replicas are started individually by the flow containing them, so serving them
+// directly is an error.
+func (r *Replicas) Serve(ctx context.Context) error {
+	return errors.Join(suture.ErrDoNotRestart, fmt.Errorf("flow: replicas of %q only run inside a flow", r.ID()))
+}
+
+// Returns the instances of a stage: its replicas, or the stage itself.
+func instances(s Stage) []Stage {
+	if r, ok := s.(*Replicas); ok {
+		return r.stages
+	}
+	return []Stage{s}
+}
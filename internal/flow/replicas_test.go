@@ -0,0 +1,158 @@
+package flow
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"github.com/thejerf/suture/v4"
+)
+
+func TestReplicasInPipeline(t *testing.T) {
+	a := msg.NewAddr
+	r, err := NewReplicas(newPassthrough("s2"), newPassthrough("s2"), newPassthrough("s2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := NewPipeline(NewBase("p").WithInOut(0), pubsub.NewPubSub(), []Stage{newPassthrough("s1"), r},
+		[]Conn{{From: a("p", "in"), To: a("s1", "in")}},
+		[]Conn{{From: a("s1", "out"), To: a("s2", "in")}},
+		[]Conn{{From: a("s2", "out"), To: a("p", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(t.Context())
+
+	const n = 30
+	go func() {
+		for i := range n {
+			p.In() <- msg.New(i).To(a("p", "in"))
+		}
+		close(p.In())
+	}()
+
+	// Each message goes through exactly one replica, and the pipeline
+	// closes its output once every replica has closed.
+	var got []int
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case m, ok := <-p.Out():
+			if !ok {
+				done = true
+				break
+			}
+			if m.Addr != a("p", "out") {
+				t.Errorf("unexpected output address %v", m.Addr)
+			}
+			got = append(got, m.Data.(int))
+		case <-timeout:
+			t.Fatalf("timeout after %d outputs", len(got))
+		}
+	}
+	slices.Sort(got)
+	for i, v := range got {
+		if i != v {
+			t.Fatalf("got outputs %v, want each of 0..%d once", got, n-1)
+		}
+	}
+	if len(got) != n {
+		t.Errorf("got %d outputs, want %d", len(got), n)
+	}
+}
+
+func TestNewReplicasValidation(t *testing.T) {
+	if _, err := NewReplicas(); err == nil {
+		t.Error("expected an error for zero replicas")
+	}
+	if _, err := NewReplicas(newPassthrough("a"), newPassthrough("b")); err == nil || !strings.Contains(err.Error(), `replica id "b" differs from "a"`) {
+		t.Errorf("unexpected error: %v", err)
+	}
+	other := newPassthrough("a")
+	other.WithPorts(Ports{In: map[string]Port{"x": {}}})
+	if _, err := NewReplicas(newPassthrough("a"), other); err == nil || !strings.Contains(err.Error(), "declare different ports") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// A test stage that forwards each message tagged with the index of its replica
+type tagger struct {
+	Base
+	replica int
+}
+
+type tagged struct {
+	replica int
+	data    any
+}
+
+func (s *tagger) Serve(ctx context.Context) error {
+	for {
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceSend("out", m.Msg, tagged{s.replica, m.Data})
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func TestPartitionedConnPreservesKeyOrder(t *testing.T) {
+	a := msg.NewAddr
+	type item struct{ key, seq int }
+	var replicas []Stage
+	for i := range 4 {
+		replicas = append(replicas, &tagger{*NewBase("s1").WithInOut(0).WithPorts(passthroughPorts), i})
+	}
+	r, err := NewReplicas(replicas...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byKey := PartitionBy("key", func(m msg.Msg) (string, error) {
+		return fmt.Sprint(m.Data.(item).key), nil
+	})
+	p, err := NewPipeline(NewBase("p").WithInOut(0), pubsub.NewPubSub(), []Stage{r},
+		[]Conn{{From: a("p", "in"), To: a("s1", "in"), Partition: byKey}},
+		nil,
+		[]Conn{{From: a("s1", "out"), To: a("p", "out")}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go p.Serve(t.Context())
+	go func() {
+		for seq := range 20 {
+			for key := range 5 {
+				p.In() <- msg.New(item{key, seq}).To(a("p", "in"))
+			}
+		}
+		close(p.In())
+	}()
+
+	replicaOf, lastSeq := map[int]int{}, map[int]int{}
+	count := 0
+	for m := range p.Out() {
+		count++
+		tg := m.Data.(tagged)
+		it := tg.data.(item)
+		if r, ok := replicaOf[it.key]; ok && r != tg.replica {
+			t.Errorf("key %d went to replicas %d and %d", it.key, r, tg.replica)
+		}
+		replicaOf[it.key] = tg.replica
+		if last, ok := lastSeq[it.key]; ok && it.seq != last+1 {
+			t.Errorf("key %d: got seq %d after %d", it.key, it.seq, last)
+		}
+		lastSeq[it.key] = it.seq
+	}
+	if count != 100 {
+		t.Errorf("got %d outputs, want 100", count)
+	}
+}
@@ -0,0 +1,431 @@
+// Package schema implements the subset of JSON Schema used to describe the data
+// that flows through stage ports.
+//
+// The supported keywords are type, enum, properties, required, additionalProperties,
+// items, minItems, maxItems, minLength, maxLength, pattern, minimum, maximum, allOf,
+// anyOf, oneOf, and not, along with the $schema, $id, title, and description annotations.
+// Schemas with other keywords are rejected rather than partly understood, so that a schema
+// never validates less than it appears to. Patterns use Go's regexp syntax.
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// A JSON Schema. The zero value and nil match any value.
+type Schema struct {
+	// Annotations, which do not affect validation
+	SchemaURI   string `json:"$schema,omitempty"`
+	ID          string `json:"$id,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+
+	Type Types `json:"type,omitempty"`
+	Enum []any `json:"enum,omitempty"`
+
+	// Objects
+	Properties           map[string]*Schema `json:"properties,omitempty"`
+	Required             []string           `json:"required,omitempty"`
+	AdditionalProperties *Schema            `json:"additionalProperties,omitempty"`
+
+	// Arrays
+	Items    *Schema `json:"items,omitempty"`
+	MinItems *int    `json:"minItems,omitempty"`
+	MaxItems *int    `json:"maxItems,omitempty"`
+
+	// Strings
+	MinLength *int   `json:"minLength,omitempty"`
+	MaxLength *int   `json:"maxLength,omitempty"`
+	Pattern   string `json:"pattern,omitempty"`
+
+	// Numbers
+	Minimum *float64 `json:"minimum,omitempty"`
+	Maximum *float64 `json:"maximum,omitempty"`
+
+	// Combinators
+	AllOf []*Schema `json:"allOf,omitempty"`
+	AnyOf []*Schema `json:"anyOf,omitempty"`
+	OneOf []*Schema `json:"oneOf,omitempty"`
+	Not   *Schema   `json:"not,omitempty"`
+
+	never bool // set for the false schema, which matches no value
+}
+
+// The names of the JSON types
+var typeNames = []string{"null", "boolean", "object", "array", "number", "string", "integer"}
+
+// Parses a schema from JSON.
+func Parse(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Returns a schema that matches values of the given JSON types.
+func OfType(types ...string) *Schema {
+	return &Schema{Type: types}
+}
+
+func (s *Schema) UnmarshalJSON(data []byte) error {
+	var b bool
+	if json.Unmarshal(data, &b) == nil {
+		*s = Schema{never: !b}
+		return nil
+	}
+	type plain Schema
+	var p plain
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return err
+	}
+	*s = Schema(p)
+	for _, t := range s.Type {
+		if !slices.Contains(typeNames, t) {
+			return fmt.Errorf("schema: unknown type %q", t)
+		}
+	}
+	for _, n := range []*int{s.MinItems, s.MaxItems, s.MinLength, s.MaxLength} {
+		if n != nil && *n < 0 {
+			return errors.New("schema: minimum and maximum counts must not be negative")
+		}
+	}
+	if s.Pattern != "" {
+		if _, err := compile(s.Pattern); err != nil {
+			return fmt.Errorf("schema: pattern: %w", err)
+		}
+	}
+	return nil
+}
+
+// Compiled patterns by source, which are shared by all schemas, so that schemas built
+// in Go as well as parsed ones compile each pattern once
+var patterns sync.Map
+
+func compile(pattern string) (*regexp.Regexp, error) {
+	if re, ok := patterns.Load(pattern); ok {
+		return re.(*regexp.Regexp), nil
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	patterns.Store(pattern, re)
+	return re, nil
+}
+
+func (s *Schema) MarshalJSON() ([]byte, error) {
+	if s.never {
+		return []byte("false"), nil
+	}
+	type plain Schema
+	return json.Marshal((*plain)(s))
+}
+
+// The allowed types of a schema, which encode as a single name or an array of names.
+type Types []string
+
+func (t *Types) UnmarshalJSON(data []byte) error {
+	var name string
+	if json.Unmarshal(data, &name) == nil {
+		*t = Types{name}
+		return nil
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return errors.New("schema: type must be a string or an array of strings")
+	}
+	*t = names
+	return nil
+}
+
+func (t Types) MarshalJSON() ([]byte, error) {
+	if len(t) == 1 {
+		return json.Marshal(t[0])
+	}
+	return json.Marshal([]string(t))
+}
+
+func (t Types) String() string {
+	if len(t) == 1 {
+		return t[0]
+	}
+	return "one of " + strings.Join(t, ", ")
+}
+
+// Reports whether a value of the given kind matches one of the types.
+func (t Types) allow(kind string, v any) bool {
+	for _, name := range t {
+		switch {
+		case name == kind:
+			return true
+		case name == "integer" && kind == "number":
+			if f := v.(float64); f == math.Trunc(f) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Reports whether values of some type could match both sets of types.
+func (t Types) overlap(other Types) bool {
+	for _, a := range t {
+		for _, b := range other {
+			if a == b || a == "integer" && b == "number" || a == "number" && b == "integer" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Describes why a value does not match a schema
+type ValidationError struct {
+	// JSON Pointer to the part of the value that does not match, which is empty for the whole value
+	Path    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	if e.Path == "" {
+		return "schema: " + e.Message
+	}
+	return fmt.Sprintf("schema: at %s: %s", e.Path, e.Message)
+}
+
+func fail(path, format string, args ...any) error {
+	return &ValidationError{path, fmt.Sprintf(format, args...)}
+}
+
+// Appends a reference token to a JSON Pointer
+func pointer(path, token string) string {
+	return path + "/" + strings.NewReplacer("~", "~0", "/", "~1").Replace(token)
+}
+
+// Checks that the value matches the schema, returning a ValidationError for the first
+// mismatch. Values are checked as they would be encoded as JSON: Go numbers are numbers,
+// and values of types other than those produced by encoding/json are encoded first.
+func (s *Schema) Validate(v any) error {
+	return s.validate(v, "")
+}
+
+func (s *Schema) validate(v any, path string) error {
+	if s == nil {
+		return nil
+	}
+	if s.never {
+		return fail(path, "no value is allowed")
+	}
+	v, err := normalize(v)
+	if err != nil {
+		return fail(path, "value cannot be encoded as JSON: %v", err)
+	}
+	kind := kindOf(v)
+	if len(s.Type) > 0 && !s.Type.allow(kind, v) {
+		return fail(path, "expected %s, got %s", s.Type, kind)
+	}
+	if s.Enum != nil && !slices.ContainsFunc(s.Enum, func(e any) bool { return equal(e, v) }) {
+		return fail(path, "value is not one of the allowed values")
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		for _, name := range s.Required {
+			if _, ok := v[name]; !ok {
+				return fail(path, "missing required property %q", name)
+			}
+		}
+		for _, name := range slices.Sorted(maps.Keys(v)) {
+			prop, ok := s.Properties[name]
+			if !ok {
+				prop = s.AdditionalProperties
+			}
+			if err := prop.validate(v[name], pointer(path, name)); err != nil {
+				return err
+			}
+		}
+	case []any:
+		if s.MinItems != nil && len(v) < *s.MinItems {
+			return fail(path, "expected at least %d items, got %d", *s.MinItems, len(v))
+		}
+		if s.MaxItems != nil && len(v) > *s.MaxItems {
+			return fail(path, "expected at most %d items, got %d", *s.MaxItems, len(v))
+		}
+		for i, item := range v {
+			if err := s.Items.validate(item, pointer(path, fmt.Sprint(i))); err != nil {
+				return err
+			}
+		}
+	case string:
+		n := utf8.RuneCountInString(v)
+		if s.MinLength != nil && n < *s.MinLength {
+			return fail(path, "expected at least %d characters, got %d", *s.MinLength, n)
+		}
+		if s.MaxLength != nil && n > *s.MaxLength {
+			return fail(path, "expected at most %d characters, got %d", *s.MaxLength, n)
+		}
+		if s.Pattern != "" {
+			re, err := compile(s.Pattern)
+			if err != nil {
+				return fail(path, "invalid pattern %q: %v", s.Pattern, err)
+			}
+			if !re.MatchString(v) {
+				return fail(path, "string does not match pattern %q", s.Pattern)
+			}
+		}
+	case float64:
+		if s.Minimum != nil && v < *s.Minimum {
+			return fail(path, "expected at least %v, got %v", *s.Minimum, v)
+		}
+		if s.Maximum != nil && v > *s.Maximum {
+			return fail(path, "expected at most %v, got %v", *s.Maximum, v)
+		}
+	}
+
+	for _, sub := range s.AllOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if s.AnyOf != nil && !slices.ContainsFunc(s.AnyOf, func(sub *Schema) bool { return sub.validate(v, path) == nil }) {
+		return fail(path, "value does not match any schema in anyOf")
+	}
+	if s.OneOf != nil {
+		matches := 0
+		for _, sub := range s.OneOf {
+			if sub.validate(v, path) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fail(path, "value matches %d schemas in oneOf, want exactly one", matches)
+		}
+	}
+	if s.Not != nil && s.Not.validate(v, path) == nil {
+		return fail(path, "value matches the schema in not")
+	}
+	return nil
+}
+
+// Returns the value as encoding/json would decode it into an interface, converting
+// Go numbers to float64 and encoding values of other types as JSON and decoding them.
+// Maps and slices are converted lazily, as their elements are validated.
+func normalize(v any) (any, error) {
+	switch v := v.(type) {
+	case nil, bool, string, float64, map[string]any, []any:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case int8:
+		return float64(v), nil
+	case int16:
+		return float64(v), nil
+	case int32:
+		return float64(v), nil
+	case int64:
+		return float64(v), nil
+	case uint:
+		return float64(v), nil
+	case uint8:
+		return float64(v), nil
+	case uint16:
+		return float64(v), nil
+	case uint32:
+		return float64(v), nil
+	case uint64:
+		return float64(v), nil
+	case float32:
+		return float64(v), nil
+	case json.Number:
+		return v.Float64()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	if err := json.Unmarshal(data, &out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Returns the JSON type of a normalized value
+func kindOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case float64:
+		return "number"
+	default:
+		return "string"
+	}
+}
+
+// Reports whether two values have the same JSON encoding, which
+// is canonical since encoding/json sorts the keys of maps.
+func equal(a, b any) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(ja, jb)
+}
+
+// Checks whether data matching the output schema could match the input schema,
+// returning an error if it obviously could not. The check compares types and enums,
+// and the properties that the output schema requires of objects, so it finds mismatched
+// shapes without attempting to decide whether one schema implies another.
+func CheckCompatible(out, in *Schema) error {
+	return checkCompatible(out, in, "")
+}
+
+func checkCompatible(out, in *Schema, path string) error {
+	if out == nil || in == nil || out.never {
+		return nil
+	}
+	if in.never {
+		return fail(path, "input allows no values")
+	}
+	if len(out.Type) > 0 && len(in.Type) > 0 && !out.Type.overlap(in.Type) {
+		return fail(path, "output is %s, but input expects %s", out.Type, in.Type)
+	}
+	if out.Enum != nil && in.Enum != nil && !slices.ContainsFunc(out.Enum, func(e any) bool {
+		return slices.ContainsFunc(in.Enum, func(f any) bool { return equal(e, f) })
+	}) {
+		return fail(path, "no output value is one of the values allowed by the input")
+	}
+
+	// The remaining checks apply to outputs that are always objects
+	if !slices.Equal(out.Type, Types{"object"}) {
+		return nil
+	}
+	for _, name := range in.Required {
+		if _, ok := out.Properties[name]; !ok && out.AdditionalProperties != nil && out.AdditionalProperties.never {
+			return fail(path, "input requires property %q, which the output does not allow", name)
+		}
+	}
+	for _, name := range out.Required {
+		if err := checkCompatible(out.Properties[name], in.Properties[name], pointer(path, name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package schema
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func mustParse(t *testing.T, s string) *Schema {
+	t.Helper()
+	sch, err := Parse([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sch
+}
+
+func TestValidate(t *testing.T) {
+	type point struct {
+		X int `json:"x"`
+	}
+	tests := []struct {
+		name   string
+		schema string
+		value  any
+		want   string // substring of the error, or empty if the value is valid
+	}{
+		{"any", `{}`, []any{1, "a"}, ""},
+		{"true", `true`, nil, ""},
+		{"false", `false`, nil, "no value is allowed"},
+		{"type", `{"type": "string"}`, 1.0, "expected string, got number"},
+		{"type array", `{"type": ["string", "null"]}`, nil, ""},
+		{"integer", `{"type": "integer"}`, 2, ""},
+		{"not an integer", `{"type": "integer"}`, 2.5, "expected integer, got number"},
+		{"enum", `{"enum": ["a", 1]}`, 1, ""},
+		{"not in enum", `{"enum": ["a", 1]}`, "b", "not one of the allowed values"},
+		{"required", `{"type": "object", "required": ["x"]}`, map[string]any{"y": 1.0}, `missing required property "x"`},
+		{"property", `{"properties": {"x": {"type": "string"}}}`, map[string]any{"x": 1.0}, "at /x: expected string, got number"},
+		{"additional properties", `{"properties": {"x": {}}, "additionalProperties": false}`, map[string]any{"x": 1.0, "a/b": 2.0}, "at /a~1b: no value is allowed"},
+		{"items", `{"items": {"type": "number"}}`, []any{1.0, "2"}, "at /1: expected number, got string"},
+		{"min items", `{"minItems": 2}`, []any{1.0}, "at least 2 items"},
+		{"max length", `{"maxLength": 2}`, "héllo", "at most 2 characters, got 5"},
+		{"pattern", `{"pattern": "^[a-z]+$"}`, "abc1", "does not match pattern"},
+		{"minimum", `{"minimum": 0}`, -1, "expected at least 0, got -1"},
+		{"any of", `{"anyOf": [{"type": "string"}, {"type": "number"}]}`, true, "does not match any schema in anyOf"},
+		{"one of", `{"oneOf": [{"type": "number"}, {"minimum": 0}]}`, 1, "matches 2 schemas in oneOf"},
+		{"not", `{"not": {"type": "null"}}`, nil, "matches the schema in not"},
+		{"go struct", `{"properties": {"x": {"type": "integer", "maximum": 5}}}`, point{X: 7}, "at /x: expected at most 5, got 7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := mustParse(t, tt.schema).Validate(tt.value)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateGoSchemaPattern(t *testing.T) {
+	s := &Schema{Type: Types{"string"}, Pattern: "^[a-z]+$"}
+	if err := s.Validate("abc"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if err := s.Validate("abc1"); err == nil || !strings.Contains(err.Error(), "does not match pattern") {
+		t.Errorf("got error %v, want a pattern mismatch", err)
+	}
+	bad := &Schema{Pattern: "("}
+	if err := bad.Validate("abc"); err == nil || !strings.Contains(err.Error(), "invalid pattern") {
+		t.Errorf("got error %v, want an invalid pattern error", err)
+	}
+}
+
+func TestParseRejectsUnsupportedSchemas(t *testing.T) {
+	tests := []struct {
+		name, schema, want string
+	}{
+		{"unknown keyword", `{"format": "email"}`, `unknown field "format"`},
+		{"nested unknown keyword", `{"properties": {"x": {"$ref": "#/x"}}}`, `unknown field "$ref"`},
+		{"unknown type", `{"type": "float"}`, `unknown type "float"`},
+		{"bad pattern", `{"pattern": "("}`, "pattern:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.schema))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSchemaRoundTrip(t *testing.T) {
+	const s = `{"type":"object","properties":{"x":{"type":["string","null"]}},"additionalProperties":false}`
+	data, err := json.Marshal(mustParse(t, s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != s {
+		t.Errorf("got %s, want %s", data, s)
+	}
+}
+
+func TestCheckCompatible(t *testing.T) {
+	tests := []struct {
+		name    string
+		out, in string
+		want    string // substring of the error, or empty if the schemas are compatible
+	}{
+		{"same type", `{"type": "string"}`, `{"type": "string"}`, ""},
+		{"integer to number", `{"type": "integer"}`, `{"type": "number"}`, ""},
+		{"unconstrained output", `{}`, `{"type": "string"}`, ""},
+		{"disjoint types", `{"type": "array"}`, `{"type": "object"}`, "output is array, but input expects object"},
+		{"disjoint enums", `{"enum": ["a"]}`, `{"enum": ["b"]}`, "no output value"},
+		{"missing property", `{"type": "object", "additionalProperties": false}`, `{"required": ["x"]}`, `input requires property "x"`},
+		{"open object", `{"type": "object"}`, `{"required": ["x"]}`, ""},
+		{"property types", `{"type": "object", "required": ["x"], "properties": {"x": {"type": "string"}}}`,
+			`{"properties": {"x": {"type": "number"}}}`, "at /x: output is string, but input expects number"},
+		{"optional property", `{"type": "object", "properties": {"x": {"type": "string"}}}`,
+			`{"properties": {"x": {"type": "number"}}}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckCompatible(mustParse(t, tt.out), mustParse(t, tt.in))
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("unexpected error: %v", err)
+				}
+			} else if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
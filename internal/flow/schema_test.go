@@ -0,0 +1,105 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"datapotamus.com/internal/flow/schema"
+)
+
+// Returns a passthrough stage with the given input and output schemas
+func newTypedPassthrough(id string, in, out *schema.Schema) *passthrough {
+	base := NewBase(id).WithInOut(0).
+		WithSchemas(map[string]*schema.Schema{"in": in}, map[string]*schema.Schema{"out": out}).
+		WithPorts(passthroughPorts)
+	return &passthrough{*base}
+}
+
+func TestNewFlowWarnsAboutIncompatibleSchemas(t *testing.T) {
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0), pubsub.NewPubSub(),
+		[]Stage{
+			newTypedPassthrough("s1", nil, schema.OfType("array")),
+			newTypedPassthrough("s2", schema.OfType("object"), nil),
+			newTypedPassthrough("s3", schema.OfType("array", "null"), nil),
+		},
+		nil,
+		[]Conn{{From: a("s1", "out"), To: a("s2", "in")}, {From: a("s1", "out"), To: a("s3", "in")}},
+		nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	warnings := f.Warnings()
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "output is array, but input expects object") {
+		t.Errorf("got warnings %q, want one about s1 -> s2", warnings)
+	}
+}
+
+func TestSchemaRejectsInvalidMessages(t *testing.T) {
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0), pubsub.NewPubSub(),
+		[]Stage{newTypedPassthrough("s1", schema.OfType("string"), nil)},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in")}},
+		nil,
+		[]Conn{SelfConn(a("s1", "out")), SelfConn(a("s1", ErrorPort))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sch := f.Ports().In["in"].Schema; sch == nil {
+		t.Error("flow input port does not have the schema of the stage input port")
+	}
+	go f.Serve(t.Context())
+
+	for _, data := range []any{1, "ok"} {
+		f.In() <- msg.New(data).To(a("f", "in"))
+		select {
+		case m := <-f.Out():
+			switch data {
+			case "ok":
+				if m.Port != "out" {
+					t.Errorf("got valid message on port %q, want out", m.Port)
+				}
+			default:
+				failed, ok := m.Data.(FailedMsg)
+				var verr *schema.ValidationError
+				if m.Port != ErrorPort || !ok || failed.Stage != "s1" || !errors.As(failed.Error, &verr) {
+					t.Errorf("got %v on port %q, want a schema error on the error port", m.Data, m.Port)
+				}
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for output")
+		}
+	}
+}
+
+func TestSchemaRejectionWithUnreadTrace(t *testing.T) {
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(0).WithTrace(0), pubsub.NewPubSub(),
+		[]Stage{newTypedPassthrough("s1", schema.OfType("string"), nil)},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in")}},
+		nil,
+		[]Conn{SelfConn(a("s1", "out")), SelfConn(a("s1", ErrorPort))})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() { errCh <- f.Serve(ctx) }()
+
+	// Read the input's receipt and route, but not the trace of its rejection, so that
+	// tracing the rejection only returns once the flow is stopping.
+	f.In() <- msg.New(1).To(a("f", "in"))
+	nextTrace[TraceRecv](t, f)
+	nextTrace[TraceRoute](t, f)
+	cancel()
+	select {
+	case <-errCh:
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Serve to return")
+	}
+}
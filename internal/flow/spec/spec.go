@@ -0,0 +1,375 @@
+package spec
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"datapotamus.com/internal/common"
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"datapotamus.com/internal/flow/registry"
+	"datapotamus.com/internal/flow/schema"
+	"datapotamus.com/internal/stages"
+	"github.com/thejerf/suture/v4"
+)
+
+// The flow spec format version understood by this package.
+// Specs with any other version are rejected rather than half-understood.
+const Version = 1
+
+// A Flow spec is a declarative, serializable description of a flow:
+// its stages, the flow inputs, the connections between stages, and the flow outputs.
+// It is the file format counterpart of the arguments to flow.NewFlow.
+type Flow struct {
+	Version int    `json:"version"`
+	ID      string `json:"id"`
+	Buffer  int    `json:"buffer,omitempty"` // size of the flow's in/out channels
+	Trace   int    `json:"trace,omitempty"`  // if positive, enables trace channels of this size for the flow and its stages
+	// how the flow handles stage failures; defaults to restarting with suture's default backoff
+	OnFailure *FailurePolicy `json:"onFailure,omitempty"`
+	// if positive, reports stages that take longer than this to process a message (see flow.WithWatchdog)
+	WatchdogMillis int64   `json:"watchdogMillis,omitempty"`
+	Stages         []Stage `json:"stages"`
+	Inputs         []Conn  `json:"inputs,omitempty"`  // flow-to-stage input connections
+	Conns          []Conn  `json:"conns,omitempty"`   // stage-to-stage connections
+	Outputs        []Conn  `json:"outputs,omitempty"` // stage-to-flow output connections
+}
+
+// A Stage spec names a stage kind and provides its kind-specific config,
+// which is decoded and validated by the registry entry for that kind.
+type Stage struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Buffer   int    `json:"buffer,omitempty"`   // size of the stage's in/out channels
+	Replicas int    `json:"replicas,omitempty"` // if greater than one, run this many instances (see flow.Replicas)
+	// overrides the flow's failure policy for this stage
+	OnFailure *FailurePolicy `json:"onFailure,omitempty"`
+	// if set, retries the messages the stage fails to process
+	Retry *RetryPolicy `json:"retry,omitempty"`
+	// if positive, fails messages the stage takes longer than this to process (see flow.Base.WithDeadline).
+	// With retries, the deadline applies to each attempt.
+	DeadlineMillis int64 `json:"deadlineMillis,omitempty"`
+	// JSON Schemas for the data of the stage's ports, overriding those of its kind
+	Schemas *Schemas        `json:"schemas,omitempty"`
+	Config  json.RawMessage `json:"config,omitempty"`
+}
+
+// Schemas for the input and output ports of a stage, by port name (see flow.Port).
+// Messages whose data does not match the schema of their input port are sent to the
+// stage's error port instead, and conns between incompatible ports are reported as
+// warnings by the built flow.
+type Schemas struct {
+	In  map[string]*schema.Schema `json:"in,omitempty"`
+	Out map[string]*schema.Schema `json:"out,omitempty"`
+}
+
+// Checks that each schema is for a port of the stage
+func (s *Schemas) check(ports flow.Ports) error {
+	for _, name := range slices.Sorted(maps.Keys(s.In)) {
+		if !ports.HasIn(name) {
+			return fmt.Errorf("schemas: stage has no input port %q", name)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(s.Out)) {
+		if !ports.HasOut(name) {
+			return fmt.Errorf("schemas: stage has no output port %q", name)
+		}
+	}
+	return nil
+}
+
+// A FailurePolicy spec configures how a flow handles stage failures (see flow.FailurePolicy).
+// The optional restart settings correspond to the fields of suture.Spec; unset fields use
+// suture's defaults.
+type FailurePolicy struct {
+	Action               flow.FailureAction `json:"action"` // "restart", "terminate", or "isolate"
+	FailureThreshold     float64            `json:"failureThreshold,omitempty"`
+	FailureDecaySeconds  float64            `json:"failureDecaySeconds,omitempty"`
+	FailureBackoffMillis int64              `json:"failureBackoffMillis,omitempty"`
+}
+
+func (p *FailurePolicy) validate() error {
+	if p.FailureThreshold < 0 || p.FailureDecaySeconds < 0 || p.FailureBackoffMillis < 0 {
+		return errors.New("restart settings must not be negative")
+	}
+	return nil
+}
+
+// Returns the flow failure policy, with a suture.Spec if any restart settings are set.
+func (p *FailurePolicy) policy() flow.FailurePolicy {
+	policy := flow.FailurePolicy{Action: p.Action}
+	if p.FailureThreshold != 0 || p.FailureDecaySeconds != 0 || p.FailureBackoffMillis != 0 {
+		policy.Spec = &suture.Spec{
+			FailureThreshold: p.FailureThreshold,
+			FailureDecay:     p.FailureDecaySeconds,
+			FailureBackoff:   time.Duration(p.FailureBackoffMillis) * time.Millisecond,
+		}
+	}
+	return policy
+}
+
+// A RetryPolicy spec configures the retries of a stage's failed messages (see stages.Retry).
+type RetryPolicy struct {
+	MaxAttempts          int     `json:"maxAttempts"` // including the first attempt
+	InitialBackoffMillis int64   `json:"initialBackoffMillis,omitempty"`
+	MaxBackoffMillis     int64   `json:"maxBackoffMillis,omitempty"`
+	Multiplier           float64 `json:"multiplier,omitempty"` // defaults to 2
+	Jitter               float64 `json:"jitter,omitempty"`     // fraction of each backoff that is randomized
+}
+
+func (p *RetryPolicy) policy() stages.RetryPolicy {
+	return stages.RetryPolicy{
+		MaxAttempts:    p.MaxAttempts,
+		InitialBackoff: time.Duration(p.InitialBackoffMillis) * time.Millisecond,
+		MaxBackoff:     time.Duration(p.MaxBackoffMillis) * time.Millisecond,
+		Multiplier:     p.Multiplier,
+		Jitter:         p.Jitter,
+	}
+}
+
+type Conn struct {
+	From     msg.Addr        `json:"from"`
+	To       msg.Addr        `json:"to"`
+	Buffer   int             `json:"buffer,omitempty"`   // if positive, buffer deliveries along the conn
+	Overflow pubsub.Overflow `json:"overflow,omitempty"` // "block", "drop-newest", "drop-oldest", or "error"
+	// jq filter computing a key for each message, which is hashed to choose a replica
+	// of the 'to' stage so that messages with the same key are processed in order.
+	Partition string `json:"partition,omitempty"`
+	// marks the conn as a feedback edge closing a cycle (see flow.Conn.Feedback),
+	// which must be buffered with a non-blocking overflow policy
+	Feedback      bool `json:"feedback,omitempty"`
+	MaxIterations int  `json:"maxIterations,omitempty"` // for feedback conns, how often a message may loop
+}
+
+// Parses and validates a flow spec from JSON.
+func Parse(data []byte) (*Flow, error) {
+	var f Flow
+	if err := common.DecodeJSONStrict(data, &f); err != nil {
+		return nil, fmt.Errorf("spec: %w", err)
+	}
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+	return &f, nil
+}
+
+// Reads, parses, and validates a flow spec from a JSON file.
+func ParseFile(path string) (*Flow, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("spec: %w", err)
+	}
+	return Parse(data)
+}
+
+// Checks the structural validity of the spec: the version is supported,
+// IDs are present and unique, and connections refer to declared stages.
+// Port-level validation happens when the flow is built.
+func (f *Flow) Validate() error {
+	if f.Version != Version {
+		return fmt.Errorf("spec: unsupported version %d (expected %d)", f.Version, Version)
+	}
+	if f.ID == "" {
+		return errors.New("spec: flow id must not be empty")
+	}
+	if f.OnFailure != nil {
+		if err := f.OnFailure.validate(); err != nil {
+			return fmt.Errorf("spec: onFailure: %w", err)
+		}
+	}
+	if f.WatchdogMillis < 0 {
+		return errors.New("spec: watchdogMillis must not be negative")
+	}
+	if f.Buffer < 0 {
+		return errors.New("spec: buffer must not be negative")
+	}
+	if f.Trace < 0 {
+		return errors.New("spec: trace must not be negative")
+	}
+	ids := map[string]bool{}
+	for i, s := range f.Stages {
+		switch {
+		case s.ID == "":
+			return fmt.Errorf("spec: stages[%d]: id must not be empty", i)
+		case s.Type == "":
+			return fmt.Errorf("spec: stage %q: type must not be empty", s.ID)
+		case ids[s.ID]:
+			return fmt.Errorf("spec: stage %q: duplicate stage id", s.ID)
+		case s.Buffer < 0:
+			return fmt.Errorf("spec: stage %q: buffer must not be negative", s.ID)
+		case s.Replicas < 0:
+			return fmt.Errorf("spec: stage %q: replicas must not be negative", s.ID)
+		case s.DeadlineMillis < 0:
+			return fmt.Errorf("spec: stage %q: deadlineMillis must not be negative", s.ID)
+		}
+		if s.OnFailure != nil {
+			if err := s.OnFailure.validate(); err != nil {
+				return fmt.Errorf("spec: stage %q: onFailure: %w", s.ID, err)
+			}
+		}
+		ids[s.ID] = true
+	}
+	exists := func(stage string) bool { return stage == "*" || ids[stage] }
+	for i, c := range f.Inputs {
+		if c.From.Stage != f.ID {
+			return fmt.Errorf("spec: inputs[%d]: 'from' stage must be the flow id %q, not %q", i, f.ID, c.From.Stage)
+		}
+		if !exists(c.To.Stage) {
+			return fmt.Errorf("spec: inputs[%d]: 'to' stage does not exist: %q", i, c.To.Stage)
+		}
+	}
+	for i, c := range f.Conns {
+		if !exists(c.From.Stage) {
+			return fmt.Errorf("spec: conns[%d]: 'from' stage does not exist: %q", i, c.From.Stage)
+		}
+		if !exists(c.To.Stage) {
+			return fmt.Errorf("spec: conns[%d]: 'to' stage does not exist: %q", i, c.To.Stage)
+		}
+	}
+	for i, c := range f.Outputs {
+		if !exists(c.From.Stage) {
+			return fmt.Errorf("spec: outputs[%d]: 'from' stage does not exist: %q", i, c.From.Stage)
+		}
+	}
+	return nil
+}
+
+// Builds a flow from the spec, constructing each stage from the registry.
+// The options are applied after those derived from the spec.
+func (f *Flow) Build(ps *pubsub.PubSub, reg *registry.Registry, options ...flow.Option) (*flow.Flow, error) {
+	if err := f.Validate(); err != nil {
+		return nil, err
+	}
+
+	var stages []flow.Stage
+	for _, s := range f.Stages {
+		stage, err := f.newStage(s, reg)
+		if err != nil {
+			return nil, fmt.Errorf("spec: stage %q (%s): %w", s.ID, s.Type, err)
+		}
+		stages = append(stages, stage)
+	}
+
+	inputs, err := conns(f.Inputs)
+	if err != nil {
+		return nil, fmt.Errorf("spec: inputs: %w", err)
+	}
+	stageConns, err := conns(f.Conns)
+	if err != nil {
+		return nil, fmt.Errorf("spec: conns: %w", err)
+	}
+	outputs, err := conns(f.Outputs)
+	if err != nil {
+		return nil, fmt.Errorf("spec: outputs: %w", err)
+	}
+
+	var opts []flow.Option
+	if f.OnFailure != nil {
+		opts = append(opts, flow.WithFailurePolicy(f.OnFailure.policy()))
+	}
+	for _, s := range f.Stages {
+		if s.OnFailure != nil {
+			opts = append(opts, flow.WithStageFailurePolicy(s.ID, s.OnFailure.policy()))
+		}
+	}
+	if f.WatchdogMillis > 0 {
+		opts = append(opts, flow.WithWatchdog(time.Duration(f.WatchdogMillis)*time.Millisecond))
+	}
+
+	opts = append(opts, options...)
+
+	base := flow.NewBase(f.ID).WithInOut(f.Buffer)
+	if f.Trace > 0 {
+		base.WithTrace(f.Trace)
+	}
+	fl, err := flow.NewFlow(base, ps, stages, inputs, stageConns, outputs, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("spec: %w", err)
+	}
+	return fl, nil
+}
+
+// Constructs a stage from the registry, with retries and replicas if requested.
+func (f *Flow) newStage(s Stage, reg *registry.Registry) (flow.Stage, error) {
+	replicas := make([]flow.Stage, max(s.Replicas, 1))
+	for i := range replicas {
+		base := f.newBase(s.ID, s.Buffer).WithDescription(s.description())
+		if s.Schemas != nil {
+			base.WithSchemas(s.Schemas.In, s.Schemas.Out)
+		}
+		if s.DeadlineMillis > 0 {
+			base.WithDeadline(time.Duration(s.DeadlineMillis) * time.Millisecond)
+		}
+		if s.Retry != nil && base.Trace() == nil {
+			base.WithTrace(0) // read by the retry stage
+		}
+		stage, err := reg.New(s.Type, base, s.Config)
+		if err != nil {
+			return nil, err
+		}
+		if s.Schemas != nil {
+			if err := s.Schemas.check(stage.Ports()); err != nil {
+				return nil, err
+			}
+		}
+		if s.Retry != nil {
+			base := f.newBase(s.ID, s.Buffer).WithDescription(s.description())
+			if stage, err = stages.NewRetry(base, stage, s.Retry.policy()); err != nil {
+				return nil, err
+			}
+		}
+		replicas[i] = stage
+	}
+	if len(replicas) == 1 {
+		return replicas[0], nil
+	}
+	return flow.NewReplicas(replicas...)
+}
+
+// The longest config summary in a stage description, in bytes
+const maxSummary = 60
+
+// Describes the stage by its type and a summary of its config, for exported graphs.
+func (s Stage) description() flow.Description {
+	d := flow.Description{Kind: s.Type}
+	var b bytes.Buffer
+	if len(s.Config) > 0 && json.Compact(&b, s.Config) == nil && b.String() != "{}" {
+		d.Summary = b.String()
+		if len(d.Summary) > maxSummary {
+			d.Summary = strings.ToValidUTF8(d.Summary[:maxSummary], "") + "…"
+		}
+	}
+	return d
+}
+
+// Returns the base for a stage, which has a trace channel if the spec enables tracing.
+func (f *Flow) newBase(id string, buffer int) *flow.Base {
+	base := flow.NewBase(id).WithInOut(buffer)
+	if f.Trace > 0 {
+		base.WithTrace(f.Trace)
+	}
+	return base
+}
+
+func conns(cs []Conn) ([]flow.Conn, error) {
+	out := make([]flow.Conn, len(cs))
+	for i, c := range cs {
+		out[i] = flow.Conn{From: c.From, To: c.To, Buffer: c.Buffer, Overflow: c.Overflow, Feedback: c.Feedback, MaxIterations: c.MaxIterations}
+		if c.Partition != "" {
+			p, err := stages.JQPartition(c.Partition)
+			if err != nil {
+				return nil, fmt.Errorf("%v -> %v: partition: %w", c.From, c.To, err)
+			}
+			out[i].Partition = p
+		}
+	}
+	return out, nil
+}
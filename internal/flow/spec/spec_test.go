@@ -0,0 +1,166 @@
+package spec_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"datapotamus.com/internal/flow/spec"
+	"datapotamus.com/internal/stages"
+	"github.com/google/go-cmp/cmp"
+)
+
+const validSpec = `{
+	"version": 1,
+	"id": "flow1",
+	"stages": [
+		{"id": "s1", "type": "jq", "config": {"filter": ".[]", "timeoutMillis": 250}},
+		{"id": "s2", "type": "delay", "config": {"millis": 0}}
+	],
+	"inputs": [
+		{"from": {"stage": "flow1", "port": "docs"}, "to": {"stage": "s1", "port": "in"}}
+	],
+	"conns": [
+		{"from": {"stage": "s1", "port": "out"}, "to": {"stage": "s2", "port": "in"}}
+	],
+	"outputs": [
+		{"from": {"stage": "s2", "port": "out"}, "to": {"stage": "s2", "port": "out"}}
+	]
+}`
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name, spec, want string
+	}{
+		{"bad version", `{"version": 2, "id": "f"}`, "unsupported version 2"},
+		{"unknown field", `{"version": 1, "id": "f", "stagez": []}`, `unknown field "stagez"`},
+		{"missing id", `{"version": 1}`, "flow id must not be empty"},
+		{"negative replicas", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "jq", "replicas": -1}]}`, `stage "a": replicas must not be negative`},
+		{"negative deadline", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "jq", "deadlineMillis": -1}]}`, `stage "a": deadlineMillis must not be negative`},
+		{"negative flow buffer", `{"version": 1, "id": "f", "buffer": -1}`, `buffer must not be negative`},
+		{"negative trace", `{"version": 1, "id": "f", "trace": -1}`, `trace must not be negative`},
+		{"duplicate stage", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "jq"}, {"id": "a", "type": "jq"}]}`, `stage "a": duplicate stage id`},
+		{"missing to stage", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "jq"}],
+			"conns": [{"from": {"stage": "a", "port": "out"}, "to": {"stage": "b", "port": "in"}}]}`, `'to' stage does not exist: "b"`},
+		{"invalid schema", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "jq", "schemas": {"in": {"in": {"type": "float"}}}}]}`, `unknown type "float"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := spec.Parse([]byte(tt.spec))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildErrors(t *testing.T) {
+	tests := []struct {
+		name, spec, want string
+	}{
+		{"unknown type", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "nope"}]}`, `stage "a" (nope): unknown stage kind "nope"`},
+		{"bad config key", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "delay", "config": {"milis": 1}}]}`, `stage "a" (delay): config: json: unknown field "milis"`},
+		{"invalid config", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "jq", "config": {"filter": "."}}]}`, `stage "a" (jq): invalid jq config: timeoutMillis: must be greater than zero`},
+		{"cycle", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "delay"}], "conns": [{"from": {"stage": "a", "port": "out"}, "to": {"stage": "a", "port": "in"}}]}`, `found cycle: a -> a`},
+		{"blocking feedback", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "delay"}], "conns": [{"from": {"stage": "a", "port": "out"}, "to": {"stage": "a", "port": "in"}, "feedback": true, "maxIterations": 3, "buffer": 10}]}`, `feedback conn must not block`},
+		{"schema for a missing port", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "delay", "schemas": {"in": {"nope": {}}}}]}`, `stage "a" (delay): schemas: stage has no input port "nope"`},
+		{"invalid retry", `{"version": 1, "id": "f", "stages": [{"id": "a", "type": "delay", "retry": {"maxAttempts": 0}}]}`, `stage "a" (delay): retry: max attempts must be at least 1`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := spec.Parse([]byte(tt.spec))
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Build(pubsub.NewPubSub(), stages.NewRegistry())
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("got error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBuildAndRun(t *testing.T) {
+	f, err := spec.Parse([]byte(validSpec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl, err := f.Build(pubsub.NewPubSub(), stages.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := t.Context()
+	go fl.Serve(ctx)
+
+	fl.In() <- msg.New([]any{1, 2}).To(msg.NewAddr("flow1", "docs"))
+
+	var got []any
+	for len(got) < 2 {
+		select {
+		case m := <-fl.Out():
+			got = append(got, m.Data)
+		case <-time.After(time.Second):
+			t.Fatalf("timeout waiting for output; got %v", got)
+		}
+	}
+	if !cmp.Equal(got, []any{1, 2}) {
+		t.Errorf("got %v, want [1 2]", got)
+	}
+}
+
+func TestBuildWarnsAboutIncompatibleSchemas(t *testing.T) {
+	f, err := spec.Parse([]byte(`{
+		"version": 1,
+		"id": "f",
+		"stages": [
+			{"id": "s1", "type": "delay", "schemas": {"out": {"out": {"type": "string"}}}},
+			{"id": "s2", "type": "jq", "schemas": {"in": {"in": {"type": "object"}}}, "config": {"filter": ".", "timeoutMillis": 250}}
+		],
+		"conns": [{"from": {"stage": "s1", "port": "out"}, "to": {"stage": "s2", "port": "in"}}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl, err := f.Build(pubsub.NewPubSub(), stages.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if warnings := fl.Warnings(); len(warnings) != 1 || !strings.Contains(warnings[0], "output is string, but input expects object") {
+		t.Errorf("got warnings %q, want one about s1 -> s2", warnings)
+	}
+}
+
+func TestBuildRetryWithoutTrace(t *testing.T) {
+	// Stages only have trace channels if the spec enables tracing, except for the
+	// stages wrapped by retries, which read them
+	f, err := spec.Parse([]byte(`{
+		"version": 1,
+		"id": "f",
+		"stages": [{"id": "s1", "type": "delay", "config": {"millis": 0}, "retry": {"maxAttempts": 2}}],
+		"inputs": [{"from": {"stage": "f", "port": "in"}, "to": {"stage": "s1", "port": "in"}}],
+		"outputs": [{"from": {"stage": "s1", "port": "out"}, "to": {"stage": "f", "port": "out"}}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fl, err := f.Build(pubsub.NewPubSub(), stages.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fl.Trace() != nil {
+		t.Error("got a trace channel for a spec that does not enable tracing")
+	}
+	go fl.Serve(t.Context())
+	fl.In() <- msg.New(1).To(msg.NewAddr("f", "in"))
+	select {
+	case m := <-fl.Out():
+		if m.Data != 1 {
+			t.Errorf("got %v, want 1", m.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for output")
+	}
+}
@@ -2,17 +2,70 @@ package flow
 
 import (
 	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
 	"time"
 
 	"datapotamus.com/internal/common"
 	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/schema"
 )
 
-// todo: stage instances should specify their ports and should allow validation.
-// Validate that no port is present in both inputs and outputs for a stage, allowing for a
+type TraceEvent any // for now; later maybe Time() time.Time
+
+// Describes a single stage port
+type Port struct {
+	Description string `json:"description"`
+	// If set, describes the data of the port's messages. Flows reject messages whose data
+	// does not match the schema of the input port they are delivered to, and warn about
+	// conns from output ports whose schema is incompatible with that of the input port.
+	Schema *schema.Schema `json:"schema,omitempty"`
+}
+
+// Port descriptors for a stage, indexed by port name.
+// No port name may be both an input and an output, which allows for a
 // uniform port coordinate system of Addr{stage, port} inspired by Clojure's async.flow.
+type Ports struct {
+	In  map[string]Port `json:"in"`
+	Out map[string]Port `json:"out"`
+}
 
-type TraceEvent any // for now; later maybe Time() time.Time
+func (p Ports) HasIn(name string) bool {
+	_, ok := p.In[name]
+	return ok
+}
+
+func (p Ports) HasOut(name string) bool {
+	_, ok := p.Out[name]
+	return ok
+}
+
+// Name of the output port on which stages built on Base send the messages they
+// failed to process, each wrapped in a FailedMsg. Like any other output, it can be
+// connected to stages that log, repair, or retry the failed messages.
+const ErrorPort = "error"
+
+// Returns the ports with the standard error output port added.
+func (p Ports) WithErrorPort() Ports {
+	out := maps.Clone(p.Out)
+	if out == nil {
+		out = map[string]Port{}
+	}
+	out[ErrorPort] = Port{Description: "messages that failed to process, with the error"}
+	return Ports{In: p.In, Out: out}
+}
+
+// Returns an error if any port name is both an input and an output.
+func (p Ports) Validate() error {
+	for _, name := range slices.Sorted(maps.Keys(p.In)) {
+		if p.HasOut(name) {
+			return fmt.Errorf("port %q is both an input and an output", name)
+		}
+	}
+	return nil
+}
 
 type Stage interface {
 	// Stage ID, which must be unique within its flow.
@@ -32,18 +85,23 @@ type Stage interface {
 	// every second. Another example is the Flow stage, since it cannot know whether
 	// a stage inside it has the same flavor as the "random source" described above.
 	//
-	// For more well-behaved flows, however, it should be possible to detect completion
+	// For more well-behaved flows, however, it is possible to detect completion
 	// by looking at the Trace outputs and seeing whether all messages derived from
-	// the input messages have either succeeded or failed.
+	// the input messages have either succeeded or failed. See the tracker package.
 	//
-	// Idea for the future: Make a flow.Pipeline type for completable DAG processing
-	// with specified input and output stages, so we can close those and wait for the
-	// output stages to close before closing the Pipeline.
+	// For completable DAG processing, a Pipeline closes its input stages when its
+	// own input is closed and propagates closes downstream, closing its Out channel
+	// once its output stages have closed theirs. Stages that should work in pipelines
+	// must close their Out channel once their In channel is closed.
 	Out() <-chan msg.MsgFrom
 
 	// Returns a possibly-nil channel for trace messages from this stage
 	Trace() <-chan TraceEvent
 
+	// Returns the input and output ports declared by this stage.
+	// Flows only allow connections from declared outputs to declared inputs.
+	Ports() Ports
+
 	// Runs the stage, returning an error in case of unexpected failure.
 	Serve(ctx context.Context) error
 }
@@ -64,6 +122,19 @@ type Base struct {
 	// ID of the stage
 	id string
 
+	// Declared ports of the stage
+	ports Ports
+
+	// Schemas for the data of the stage's ports, by port name
+	schemas struct{ in, out map[string]*schema.Schema }
+
+	// Human-readable description of the stage
+	description Description
+
+	// Per-message processing deadline, and the messages being processed if it is set
+	deadline   time.Duration
+	processing *processing
+
 	// This is a public field intended for use by the embedding stage but
 	// not outside of it. Consumers of the stage should access stage chans
 	// only through the Stage interface.
@@ -72,8 +143,9 @@ type Base struct {
 
 // Construct a new Base with nil channels. Channels can
 // be configured by the base.With[In|Out|Trace] methods.
+// The base declares only the error output port until ports are set.
 func NewBase(id string) *Base {
-	return &Base{id, Chans{}}
+	return &Base{id: id, ports: Ports{}.WithErrorPort()}
 }
 
 // Fluent construction methods
@@ -96,6 +168,57 @@ func (s *Base) WithTrace(sz int) *Base {
 	return s
 }
 
+// Sets the declared ports of the stage, adding the error output port
+// and any schemas set with WithSchemas.
+func (s *Base) WithPorts(ports Ports) *Base {
+	s.ports = ports.WithErrorPort()
+	s.applySchemas()
+	return s
+}
+
+// Sets the schemas of the stage's input and output ports by port name, overriding any
+// schemas the ports declare. The schemas also apply to ports set later by WithPorts, so
+// they can be set before the base is passed to the stage's constructor.
+func (s *Base) WithSchemas(in, out map[string]*schema.Schema) *Base {
+	s.schemas.in, s.schemas.out = in, out
+	s.applySchemas()
+	return s
+}
+
+func (s *Base) applySchemas() {
+	apply := func(ports map[string]Port, schemas map[string]*schema.Schema) map[string]Port {
+		if len(schemas) == 0 {
+			return ports
+		}
+		ports = maps.Clone(ports)
+		for name, sch := range schemas {
+			if port, ok := ports[name]; ok {
+				port.Schema = sch
+				ports[name] = port
+			}
+		}
+		return ports
+	}
+	s.ports.In = apply(s.ports.In, s.schemas.in)
+	s.ports.Out = apply(s.ports.Out, s.schemas.out)
+}
+
+// Sets the description of the stage, which is shown in exported graphs.
+func (s *Base) WithDescription(d Description) *Base {
+	s.description = d
+	return s
+}
+
+// Describes a stage for people, such as in exported graphs
+type Description struct {
+	Kind    string `json:"kind"`              // kind of stage, such as "jq"
+	Summary string `json:"summary,omitempty"` // short summary of its configuration
+}
+
+func (s *Base) Description() Description {
+	return s.description
+}
+
 // Partly implement the Stage interface
 func (s *Base) ID() string {
 	return s.id
@@ -113,6 +236,10 @@ func (s *Base) Trace() <-chan TraceEvent {
 	return s.Ch.Trace
 }
 
+func (s *Base) Ports() Ports {
+	return s.ports
+}
+
 // Event types emitted onto stage "trace" ports
 type (
 	// recorded right before the message was sent by the stage
@@ -120,25 +247,43 @@ type (
 		Time     time.Time
 		ParentID msg.ID
 		Msg      msg.Msg
+		Port     string // output port the message is sent on
+		Stage    string // path of the stage that recorded the event, set by the flow forwarding it
 	}
 
 	// recorded right after the message was received by the stage
 	TraceRecv struct {
-		Time time.Time
-		ID   msg.ID
+		Time  time.Time
+		ID    msg.ID
+		Stage string
 	}
 
-	// message processing failed. not sure how we should count things like snooze/retry etc.
+	// message processing failed. A failure that will be retried is traced as a
+	// TraceRetry instead, so each message has at most one outcome.
 	TraceFailure struct {
 		Time  time.Time
 		ID    msg.ID
 		Error error
+		Stage string
 	}
 
 	// messages successfully processed
 	TraceSuccess struct {
-		Time time.Time
-		ID   msg.ID
+		Time  time.Time
+		ID    msg.ID
+		Stage string
+	}
+
+	// recorded instead of a TraceFailure when processing of the message failed and will
+	// be attempted again after the delay. The message remains in flight until its last
+	// attempt succeeds or fails, so that lineage shows every attempt of the same message.
+	TraceRetry struct {
+		Time    time.Time
+		ID      msg.ID
+		Attempt int // the attempt that failed, starting at 1
+		Error   error
+		Delay   time.Duration
+		Stage   string
 	}
 
 	// created a new merge node independent of any messages
@@ -146,34 +291,161 @@ type (
 		Time      time.Time
 		ParentIDs []msg.ID
 		ID        msg.ID
+		Stage     string
+	}
+
+	// recorded by a flow right before it delivers a message to the stages connected
+	// to its source address. Each delivery is later followed by a TraceSuccess or
+	// TraceFailure from the receiving stage, which lets observers detect completion.
+	TraceRoute struct {
+		Time  time.Time
+		ID    msg.ID
+		Count int
+	}
+
+	// recorded by a flow when one of its stages fails, along with the action taken
+	// according to the stage's failure policy
+	TraceStageFailure struct {
+		Time   time.Time
+		Stage  string // path of the stage within the outermost flow
+		Error  error
+		Action FailureAction
 	}
 )
 
+// Returns the event with its stage set to the given path, if it is a stage event whose
+// stage is not yet set. Flows set the stage of the events they forward from their stages,
+// so that observers of a flow's trace channel can attribute the events of each stage,
+// including the stages of nested flows. Events a flow records itself, such as the outcomes
+// of its own inputs, are attributed to the flow by the flow it is nested in, if any.
+func withStage(e TraceEvent, path string) TraceEvent {
+	switch e := e.(type) {
+	case TraceSendFrom:
+		if e.Stage == "" {
+			e.Stage = path
+		}
+		return e
+	case TraceRecv:
+		if e.Stage == "" {
+			e.Stage = path
+		}
+		return e
+	case TraceFailure:
+		if e.Stage == "" {
+			e.Stage = path
+		}
+		return e
+	case TraceSuccess:
+		if e.Stage == "" {
+			e.Stage = path
+		}
+		return e
+	case TraceRetry:
+		if e.Stage == "" {
+			e.Stage = path
+		}
+		return e
+	case TraceMerge:
+		if e.Stage == "" {
+			e.Stage = path
+		}
+		return e
+	}
+	return e
+}
+
 // Create a child message with the provided parent and data, and send it on the given port.
 // I think passing the zero message as the parent will do the right thing and create a root.
+// If the parent was failed at the stage's deadline, nothing is sent.
 func (s *Base) TraceSend(port string, parent msg.Msg, data any) {
+	pm, expired := s.processing.get(parent.ID)
+	if expired {
+		return
+	}
+	if pm != nil {
+		pm.mu.Lock()
+		defer pm.mu.Unlock()
+		if pm.expired {
+			return
+		}
+	}
+	s.send(port, parent, data)
+}
+
+func (s *Base) send(port string, parent msg.Msg, data any) {
 	child := parent.Child(data)
 	if s.Ch.Trace != nil {
-		s.Ch.Trace <- TraceSendFrom{time.Now(), parent.ID, child}
+		s.Ch.Trace <- TraceSendFrom{Time: time.Now(), ParentID: parent.ID, Msg: child, Port: port}
 	}
 	s.Ch.Out <- child.From(msg.NewAddr(s.id, port))
 }
 
+// A message that a stage failed to process, as sent on its error port
+type FailedMsg struct {
+	// The original message
+	Msg msg.Msg
+	// The error that the stage failed with
+	Error error
+	// ID of the stage that failed to process the message
+	Stage string
+	// Number of times the stage has attempted to process the message
+	Attempt int
+}
+
+// Encodes the error as its message, since most errors have no exported fields,
+// or as null if there is no error.
+func (f FailedMsg) MarshalJSON() ([]byte, error) {
+	var errText *string
+	if f.Error != nil {
+		text := f.Error.Error()
+		errText = &text
+	}
+	return json.Marshal(struct {
+		Msg     msg.Msg
+		Error   *string
+		Stage   string
+		Attempt int
+	}{f.Msg, errText, f.Stage, f.Attempt})
+}
+
+// Sends a message that the stage failed to process on its error port and traces the
+// failure of the original message. The failed message is the parent of the one sent,
+// so trackers wait for whatever handles the failure.
+func (s *Base) TraceSendError(m msg.Msg, err error, attempt int) {
+	s.finish(m.ID, func() {
+		s.send(ErrorPort, m, FailedMsg{m, err, s.id, attempt})
+		s.traceFailure(m.ID, err)
+	})
+}
+
 func (s *Base) TraceRecv(id msg.ID) {
 	if s.Ch.Trace != nil {
-		s.Ch.Trace <- TraceRecv{time.Now(), id}
+		s.Ch.Trace <- TraceRecv{Time: time.Now(), ID: id}
 	}
 }
 
+// Outcomes of messages that were failed at the stage's deadline are not traced again.
 func (s *Base) TraceFailure(id msg.ID, err error) {
+	s.finish(id, func() { s.traceFailure(id, err) })
+}
+
+func (s *Base) traceFailure(id msg.ID, err error) {
 	if s.Ch.Trace != nil {
-		s.Ch.Trace <- TraceFailure{time.Now(), id, err}
+		s.Ch.Trace <- TraceFailure{Time: time.Now(), ID: id, Error: err}
 	}
 }
 
 func (s *Base) TraceSuccess(id msg.ID) {
+	s.finish(id, func() {
+		if s.Ch.Trace != nil {
+			s.Ch.Trace <- TraceSuccess{Time: time.Now(), ID: id}
+		}
+	})
+}
+
+func (s *Base) TraceRoute(id msg.ID, count int) {
 	if s.Ch.Trace != nil {
-		s.Ch.Trace <- TraceSuccess{time.Now(), id}
+		s.Ch.Trace <- TraceRoute{time.Now(), id, count}
 	}
 }
 
@@ -184,7 +456,29 @@ func (s *Base) TraceMerge(parentIDs []msg.ID) msg.ID {
 	}
 	id := msg.ID(common.NewID())
 	if s.Ch.Trace != nil {
-		s.Ch.Trace <- TraceMerge{time.Now(), parentIDs, id}
+		s.Ch.Trace <- TraceMerge{Time: time.Now(), ParentIDs: parentIDs, ID: id}
 	}
 	return id
 }
+
+// Sends a message merged from the given parents on the given port and returns it. The
+// message's ID is that of a merge node over the parents (see TraceMerge), and it carries
+// the merged tokens of the parents and the largest of their iterations. Its send is traced
+// without a parent, since the merge node records its derivation, and should be traced
+// before the outcomes of the parents.
+func (s *Base) TraceSendMerged(port string, parents []msg.Msg, data any) msg.Msg {
+	ids := make([]msg.ID, len(parents))
+	for i, p := range parents {
+		ids[i] = p.ID
+	}
+	m := msg.NewWithID(s.TraceMerge(ids), data)
+	for _, p := range parents {
+		m = m.MergeTokens(p.Tokens)
+		m.Iteration = max(m.Iteration, p.Iteration)
+	}
+	if s.Ch.Trace != nil {
+		s.Ch.Trace <- TraceSendFrom{Time: time.Now(), Msg: m, Port: port}
+	}
+	s.Ch.Out <- m.From(msg.NewAddr(s.id, port))
+	return m
+}
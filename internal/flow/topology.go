@@ -0,0 +1,292 @@
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"datapotamus.com/internal/flow/schema"
+	"datapotamus.com/internal/flow/sublist"
+)
+
+// The stages and connections of a flow. A topology is not modified once it has been
+// validated; reconfiguring a flow replaces its topology with an edited copy.
+type topology struct {
+	id         string           // ID of the flow
+	stagesById map[string]Stage // Stages indexed by their ID
+	inputConns []Conn           // Input connections from the flow to stages
+	stageConns []Conn           // Connections between stages
+	flowConns  []Conn           // Output connections from stages to the flow
+	ports      Ports            // Flow ports, declared by the input and flow conns
+	warnings   []string         // Problems that do not prevent the flow from running
+}
+
+// Returns a validated topology for the flow with the given ID.
+func newTopology(id string, stages []Stage, inputConns []Conn, stageConns []Conn, flowConns []Conn) (*topology, error) {
+	// Create maps from stage ID to input and output channel
+	stagesById := map[string]Stage{}
+	for _, s := range stages {
+		for _, inst := range instances(s) {
+			if inst.In() == nil {
+				panic(fmt.Sprintf("flow: stage %q: stage In() channel must not be nil", s.ID()))
+			}
+			if inst.Out() == nil {
+				panic(fmt.Sprintf("flow: stage %q: stage Out() channel must not be nil", s.ID()))
+			}
+		}
+		if _, ok := stagesById[s.ID()]; ok {
+			return nil, fmt.Errorf("flow: duplicate stage id: %q", s.ID())
+		}
+		if s.ID() == id {
+			return nil, fmt.Errorf("flow: stage id must differ from the flow id: %q", s.ID())
+		}
+		if err := s.Ports().Validate(); err != nil {
+			return nil, fmt.Errorf("flow: stage %q: %w", s.ID(), err)
+		}
+		stagesById[s.ID()] = s
+	}
+
+	t := &topology{
+		id:         id,
+		stagesById: stagesById,
+		inputConns: inputConns,
+		stageConns: stageConns,
+		flowConns:  flowConns,
+	}
+
+	for _, conn := range slices.Concat(inputConns, stageConns, flowConns) {
+		if conn.Buffer < 0 {
+			return nil, fmt.Errorf("conn %v -> %v: buffer must not be negative", conn.From, conn.To)
+		}
+		if conn.Partition != nil && conn.Partition.Key == nil {
+			return nil, fmt.Errorf("conn %v -> %v: partition must have a key function", conn.From, conn.To)
+		}
+	}
+
+	// Validate that input conns go from the flow's own address to real input ports,
+	// and declare their sources as the input ports of the flow.
+	ins := map[string]Port{}
+	for _, conn := range inputConns {
+		if conn.From.Stage != id || hasWildcard(conn.From) {
+			return nil, fmt.Errorf("input conn %v -> %v: 'from' address must be a port of flow %q", conn.From, conn.To, id)
+		}
+		if conn.Feedback {
+			return nil, fmt.Errorf("input conn %v -> %v: only stage conns can be feedback conns", conn.From, conn.To)
+		}
+		if err := t.validateTo(conn.To); err != nil {
+			return nil, fmt.Errorf("input conn %v -> %v: %w", conn.From, conn.To, err)
+		}
+		// A flow input port takes the schema of the first stage input port it is connected to
+		if _, ok := ins[conn.From.Port]; !ok {
+			ins[conn.From.Port] = Port{
+				Description: fmt.Sprintf("to %s.%s", conn.To.Stage, conn.To.Port),
+				Schema:      t.stagesById[conn.To.Stage].Ports().In[conn.To.Port].Schema,
+			}
+		}
+	}
+
+	// Validate that stage conns go from real output ports to real input ports.
+	var forward []Conn
+	for _, conn := range stageConns {
+		if err := t.validateFrom(conn.From); err != nil {
+			return nil, fmt.Errorf("stage conn %v -> %v: %w", conn.From, conn.To, err)
+		}
+		if err := t.validateTo(conn.To); err != nil {
+			return nil, fmt.Errorf("stage conn %v -> %v: %w", conn.From, conn.To, err)
+		}
+		if err := validateFeedback(conn); err != nil {
+			return nil, fmt.Errorf("stage conn %v -> %v: %w", conn.From, conn.To, err)
+		}
+		if !conn.Feedback {
+			forward = append(forward, conn)
+		}
+		t.checkSchemas(conn)
+	}
+
+	// Validate that every cycle in the stage graph passes through a feedback conn.
+	if cycle := findCycle(slices.Sorted(maps.Keys(stagesById)), t.downstream(forward)); cycle != nil {
+		return nil, fmt.Errorf("flow: stage graph must be acyclic apart from feedback conns, found cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	// Validate that flow conns come from real output ports, and
+	// declare their destinations as the output ports of the flow.
+	outs := map[string]Port{}
+	for _, conn := range flowConns {
+		if err := t.validateFrom(conn.From); err != nil {
+			return nil, fmt.Errorf("flow conn %v -> %v: %w", conn.From, conn.To, err)
+		}
+		if conn.Feedback {
+			return nil, fmt.Errorf("flow conn %v -> %v: only stage conns can be feedback conns", conn.From, conn.To)
+		}
+		if conn.To.Port != "*" {
+			port := Port{Description: fmt.Sprintf("from %s.%s", conn.From.Stage, conn.From.Port)}
+			if !hasWildcard(conn.From) {
+				port.Schema = t.stagesById[conn.From.Stage].Ports().Out[conn.From.Port].Schema
+			}
+			outs[conn.To.Port] = port
+		}
+	}
+	t.ports = Ports{In: ins, Out: outs}
+	if err := t.ports.Validate(); err != nil {
+		return nil, fmt.Errorf("flow: %w", err)
+	}
+	return t, nil
+}
+
+// Returns the stages sorted by ID
+func (t *topology) stages() []Stage {
+	var stages []Stage
+	for _, id := range slices.Sorted(maps.Keys(t.stagesById)) {
+		stages = append(stages, t.stagesById[id])
+	}
+	return stages
+}
+
+// Returns a validated copy of the topology with the edit applied.
+func (t *topology) edit(e Edit) (*topology, error) {
+	stagesById := maps.Clone(t.stagesById)
+	for _, id := range e.RemoveStages {
+		if _, ok := stagesById[id]; !ok {
+			return nil, fmt.Errorf("flow: cannot remove stage %q: stage does not exist", id)
+		}
+		delete(stagesById, id)
+	}
+	stages := slices.Collect(maps.Values(stagesById))
+	stages = append(stages, e.AddStages...)
+
+	inputConns, err := removeConns(t.inputConns, e.RemoveConns.Input, "input")
+	if err != nil {
+		return nil, err
+	}
+	stageConns, err := removeConns(t.stageConns, e.RemoveConns.Stage, "stage")
+	if err != nil {
+		return nil, err
+	}
+	flowConns, err := removeConns(t.flowConns, e.RemoveConns.Flow, "flow")
+	if err != nil {
+		return nil, err
+	}
+
+	return newTopology(t.id, stages,
+		slices.Concat(inputConns, e.AddConns.Input),
+		slices.Concat(stageConns, e.AddConns.Stage),
+		slices.Concat(flowConns, e.AddConns.Flow))
+}
+
+// Returns the conns with one occurrence of each removed conn deleted.
+func removeConns(conns []Conn, remove []Conn, kind string) ([]Conn, error) {
+	conns = slices.Clone(conns)
+	for _, r := range remove {
+		i := slices.Index(conns, r)
+		if i < 0 {
+			return nil, fmt.Errorf("flow: cannot remove %s conn %v -> %v: conn does not exist", kind, r.From, r.To)
+		}
+		conns = slices.Delete(conns, i, i+1)
+	}
+	return conns, nil
+}
+
+// Checks that a 'from' address names a real output port. Wildcards
+// are allowed, and must match the output port of at least one stage.
+func (t *topology) validateFrom(from msg.Addr) error {
+	if !hasWildcard(from) {
+		s, ok := t.stagesById[from.Stage]
+		if !ok {
+			return fmt.Errorf("'from' stage does not exist: %q", from.Stage)
+		}
+		if !s.Ports().HasOut(from.Port) {
+			return fmt.Errorf("'from' port %q is not an output of stage %q", from.Port, from.Stage)
+		}
+		return nil
+	}
+	if !sublist.IsValidSubject(t.subjectFor(from)) {
+		return fmt.Errorf("'from' address is not a valid pattern: %v", from)
+	}
+	if len(t.stagesMatching(from)) == 0 {
+		return fmt.Errorf("'from' pattern does not match any stage output port: %v", from)
+	}
+	return nil
+}
+
+// Checks that a 'to' address names a real input port. Wildcards are not allowed.
+func (t *topology) validateTo(to msg.Addr) error {
+	if hasWildcard(to) {
+		return fmt.Errorf("'to' address must not contain wildcards: %v", to)
+	}
+	s, ok := t.stagesById[to.Stage]
+	if !ok {
+		return fmt.Errorf("'to' stage does not exist: %q", to.Stage)
+	}
+	if !s.Ports().HasIn(to.Port) {
+		return fmt.Errorf("'to' port %q is not an input of stage %q", to.Port, to.Stage)
+	}
+	return nil
+}
+
+// Adds a warning for each output port matched by a stage conn whose schema is
+// incompatible with the schema of the conn's input port.
+func (t *topology) checkSchemas(conn Conn) {
+	in := t.stagesById[conn.To.Stage].Ports().In[conn.To.Port].Schema
+	if in == nil {
+		return
+	}
+	for _, from := range t.sources(conn.From) {
+		out := t.stagesById[from.Stage].Ports().Out[from.Port].Schema
+		if err := schema.CheckCompatible(out, in); err != nil {
+			t.warnings = append(t.warnings, fmt.Sprintf("stage conn %v -> %v: %v", from, conn.To, err))
+		}
+	}
+}
+
+// Checks the settings of a feedback conn, and that other conns have none.
+func validateFeedback(conn Conn) error {
+	switch {
+	case !conn.Feedback && conn.MaxIterations != 0:
+		return errors.New("max iterations can only be set on feedback conns")
+	case !conn.Feedback:
+		return nil
+	case conn.Buffer == 0:
+		return errors.New("feedback conn must be buffered")
+	case conn.Overflow == pubsub.Block:
+		return errors.New("feedback conn must not block when its buffer is full")
+	case conn.MaxIterations <= 0:
+		return errors.New("feedback conn must have a positive max iterations")
+	}
+	return nil
+}
+
+func hasWildcard(addr msg.Addr) bool {
+	isWildcard := func(s string) bool { return s == "*" || s == ">" }
+	return isWildcard(addr.Stage) || isWildcard(addr.Port)
+}
+
+func (t *topology) subjectFor(addr msg.Addr) string {
+	return subjectFor(t.id, addr)
+}
+
+func subjectFor(flowID string, addr msg.Addr) string {
+	return fmt.Sprintf("flow.%s.stage.%s.port.%s", flowID, addr.Stage, addr.Port)
+}
+
+// Returns the IDs of the stages that a message sent from the given address is delivered to,
+// once for each conn, along with the number of flow outputs it is sent to.
+func (t *topology) deliveries(from msg.Addr) (stages []string, outputs int) {
+	subj := t.subjectFor(from)
+	for _, conns := range [][]Conn{t.inputConns, t.stageConns} {
+		for _, conn := range conns {
+			if sublist.SubjectMatchesFilter(subj, t.subjectFor(conn.From)) {
+				stages = append(stages, conn.To.Stage)
+			}
+		}
+	}
+	for _, conn := range t.flowConns {
+		if sublist.SubjectMatchesFilter(subj, t.subjectFor(conn.From)) {
+			outputs++
+		}
+	}
+	return stages, outputs
+}
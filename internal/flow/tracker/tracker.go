@@ -0,0 +1,235 @@
+package tracker
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"sync"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+)
+
+// Summarizes the processing of every message derived from a tracked root input.
+// Succeeded and Failed count delivery outcomes, so a message that is delivered
+// to two stages contributes two outcomes. Flows count as stages here: a flow
+// succeeds each input once it has handed it to the stage it is addressed to.
+type Completion struct {
+	ID        msg.ID
+	Succeeded int
+	Failed    int
+}
+
+// A Tracker consumes flow trace events and reports when every message derived from a
+// tracked root input has either succeeded or failed, even in flows that never close.
+//
+// A message is resolved once the flow has routed it (see flow.TraceRoute) and each
+// of its deliveries has a success or failure. A root is complete once every message
+// derived from it, directly or through merge nodes, is resolved.
+//
+// Events from different stages may be observed out of order, since each stage's trace
+// channel is forwarded separately. This is safe because a stage always traces the
+// messages it sends before it traces the outcome of the message they derive from,
+// and a flow always traces a route before delivering the message it routes.
+//
+// Only messages derived from tracked roots are fully cleaned up on completion, so the
+// tracker should observe flows in which every input is tracked.
+type Tracker struct {
+	mu    sync.Mutex
+	nodes map[msg.ID]*node
+	roots map[msg.ID]*root
+}
+
+// Per-message state
+type node struct {
+	roots     map[msg.ID]bool // roots this message derives from; empty until linked
+	children  []msg.ID        // messages and merge nodes derived from this one
+	routed    bool            // whether the number of expected deliveries is known
+	expected  int             // number of deliveries
+	succeeded int
+	failed    int
+}
+
+func (n *node) resolved() bool {
+	return n.routed && n.succeeded+n.failed >= n.expected
+}
+
+// Per-root state
+type root struct {
+	open      int // number of unresolved messages derived from this root
+	succeeded int
+	failed    int
+	done      chan Completion
+}
+
+func New() *Tracker {
+	return &Tracker{
+		nodes: map[msg.ID]*node{},
+		roots: map[msg.ID]*root{},
+	}
+}
+
+// Starts tracking a root input, which must be called before the input is sent to
+// the flow. The returned channel receives a single Completion and is then closed.
+func (t *Tracker) Track(id msg.ID) <-chan Completion {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	r := &root{done: make(chan Completion, 1)}
+	t.roots[id] = r
+
+	// The root is "routed" by the caller to the flow, which will succeed or fail it.
+	n := t.node(id)
+	n.routed = true
+	n.expected++
+	t.link(n, []msg.ID{id})
+	return r.done
+}
+
+// Observes trace events until the context is done or the channel is closed.
+func (t *Tracker) Run(ctx context.Context, events <-chan flow.TraceEvent) {
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			t.Observe(e)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Updates the tracker with a single trace event.
+func (t *Tracker) Observe(e flow.TraceEvent) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	switch e := e.(type) {
+	case flow.TraceSendFrom:
+		t.derive(e.Msg.ID, e.ParentID)
+	case flow.TraceMerge:
+		for _, parentID := range e.ParentIDs {
+			t.derive(e.ID, parentID)
+		}
+	case flow.TraceRoute:
+		t.update(e.ID, func(n *node) {
+			n.routed = true
+			n.expected += e.Count
+		})
+	case flow.TraceSuccess:
+		t.count(e.ID, func(r *root) { r.succeeded++ })
+		t.update(e.ID, func(n *node) { n.succeeded++ })
+	case flow.TraceFailure:
+		t.count(e.ID, func(r *root) { r.failed++ })
+		t.update(e.ID, func(n *node) { n.failed++ })
+	}
+}
+
+// Returns the node for the given ID, creating it if needed.
+func (t *Tracker) node(id msg.ID) *node {
+	n := t.nodes[id]
+	if n == nil {
+		n = &node{roots: map[msg.ID]bool{}}
+		t.nodes[id] = n
+	}
+	return n
+}
+
+// Records that the message or merge node with the given ID derives from the parent.
+func (t *Tracker) derive(id, parentID msg.ID) {
+	if parentID == "" {
+		return // an untracked root created by a source stage
+	}
+	parent := t.node(parentID)
+	parent.children = append(parent.children, id)
+	if len(parent.roots) > 0 {
+		t.link(t.node(id), slices.Collect(maps.Keys(parent.roots)))
+	}
+}
+
+// Associates the node and its known descendants with the given roots,
+// carrying over any outcomes that were observed before it was linked.
+// Linking never completes a root, since it can only add unresolved messages.
+func (t *Tracker) link(n *node, roots []msg.ID) {
+	var added []msg.ID
+	for _, id := range roots {
+		r := t.roots[id]
+		if r == nil || n.roots[id] {
+			continue
+		}
+		n.roots[id] = true
+		added = append(added, id)
+		r.succeeded += n.succeeded
+		r.failed += n.failed
+		if !n.resolved() {
+			r.open++
+		}
+	}
+	if len(added) == 0 {
+		return
+	}
+	for _, childID := range n.children {
+		t.link(t.node(childID), added)
+	}
+}
+
+// Applies a change to a node, updating the open counts of its roots.
+func (t *Tracker) update(id msg.ID, change func(*node)) {
+	n := t.node(id)
+	wasResolved := n.resolved()
+	change(n)
+	if wasResolved == n.resolved() {
+		return
+	}
+	for rootID := range n.roots {
+		r := t.roots[rootID]
+		if r == nil {
+			continue
+		}
+		if n.resolved() {
+			r.open--
+		} else {
+			r.open++
+		}
+		t.checkDone(rootID)
+	}
+}
+
+// Applies a change to the summary of each root of a linked node.
+func (t *Tracker) count(id msg.ID, change func(*root)) {
+	for rootID := range t.node(id).roots {
+		if r := t.roots[rootID]; r != nil {
+			change(r)
+		}
+	}
+}
+
+// Completes the root if none of its messages are unresolved.
+func (t *Tracker) checkDone(id msg.ID) {
+	r := t.roots[id]
+	if r == nil || r.open > 0 {
+		return
+	}
+	r.done <- Completion{ID: id, Succeeded: r.succeeded, Failed: r.failed}
+	close(r.done)
+	delete(t.roots, id)
+	t.forget(id, id)
+}
+
+// Deletes the nodes derived only from the given root.
+func (t *Tracker) forget(id, rootID msg.ID) {
+	n := t.nodes[id]
+	if n == nil {
+		return
+	}
+	delete(n.roots, rootID)
+	if len(n.roots) > 0 {
+		return // still part of another root's tree
+	}
+	delete(t.nodes, id)
+	for _, childID := range n.children {
+		t.forget(childID, rootID)
+	}
+}
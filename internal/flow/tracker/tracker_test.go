@@ -0,0 +1,173 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+	"datapotamus.com/internal/stages"
+)
+
+func expectCompletion(t *testing.T, done <-chan Completion, want Completion) {
+	t.Helper()
+	select {
+	case got := <-done:
+		if got != want {
+			t.Errorf("got completion %+v, want %+v", got, want)
+		}
+	default:
+		t.Errorf("expected completion %+v", want)
+	}
+}
+
+func expectPending(t *testing.T, done <-chan Completion) {
+	t.Helper()
+	select {
+	case got := <-done:
+		t.Errorf("unexpected early completion %+v", got)
+	default:
+	}
+}
+
+func TestTrackerOutOfOrderEvents(t *testing.T) {
+	tr := New()
+	root := msg.New("root")
+	child := root.Child("child")
+	grandchild := child.Child("grandchild")
+	done := tr.Track(root.ID)
+
+	// The flow hands the root to stage A and succeeds it. A sends a child before succeeding.
+	tr.Observe(flow.TraceRoute{ID: root.ID, Count: 1})
+	tr.Observe(flow.TraceSuccess{ID: root.ID})
+	tr.Observe(flow.TraceSendFrom{ParentID: root.ID, Msg: child})
+	tr.Observe(flow.TraceSuccess{ID: root.ID})
+	expectPending(t, done)
+
+	// Stage B's events for the child arrive before the flow routes it,
+	// and B sends a grandchild that goes nowhere.
+	tr.Observe(flow.TraceSendFrom{ParentID: child.ID, Msg: grandchild})
+	tr.Observe(flow.TraceFailure{ID: child.ID, Error: errors.New("oops")})
+	expectPending(t, done)
+	tr.Observe(flow.TraceRoute{ID: child.ID, Count: 1})
+	expectPending(t, done)
+	tr.Observe(flow.TraceRoute{ID: grandchild.ID, Count: 0})
+	expectCompletion(t, done, Completion{ID: root.ID, Succeeded: 2, Failed: 1})
+
+	if len(tr.nodes) != 0 || len(tr.roots) != 0 {
+		t.Errorf("expected completed roots to be forgotten, got %d nodes and %d roots", len(tr.nodes), len(tr.roots))
+	}
+}
+
+func TestTrackerMerge(t *testing.T) {
+	tr := New()
+	a, b := msg.New("a"), msg.New("b")
+	doneA, doneB := tr.Track(a.ID), tr.Track(b.ID)
+	for _, m := range []msg.Msg{a, b} {
+		tr.Observe(flow.TraceRoute{ID: m.ID, Count: 1})
+		tr.Observe(flow.TraceSuccess{ID: m.ID})
+	}
+
+	// A batching stage merges a and b, then succeeds both.
+	merged := msg.NewWithID("merged", nil)
+	tr.Observe(flow.TraceMerge{ParentIDs: []msg.ID{a.ID, b.ID}, ID: merged.ID})
+	tr.Observe(flow.TraceSuccess{ID: a.ID})
+	tr.Observe(flow.TraceSuccess{ID: b.ID})
+	expectPending(t, doneA)
+	expectPending(t, doneB)
+
+	tr.Observe(flow.TraceRoute{ID: merged.ID, Count: 1})
+	tr.Observe(flow.TraceSuccess{ID: merged.ID})
+	expectCompletion(t, doneA, Completion{ID: a.ID, Succeeded: 3})
+	expectCompletion(t, doneB, Completion{ID: b.ID, Succeeded: 3})
+}
+
+func TestTrackerWithFlow(t *testing.T) {
+	newBase := func(id string) *flow.Base { return flow.NewBase(id).WithInOut(0).WithTrace(0) }
+	s1, err := stages.NewJQ(newBase("s1"), ".[]", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := stages.NewDelay(newBase("s2"), 0)
+	f, err := flow.NewFlow(newBase("f"), pubsub.NewPubSub(), []flow.Stage{s1, s2},
+		[]flow.Conn{{From: msg.NewAddr("f", "in"), To: msg.NewAddr("s1", "in")}},
+		[]flow.Conn{{From: msg.NewAddr("s1", "out"), To: msg.NewAddr("s2", "in")}},
+		[]flow.Conn{flow.SelfConn(msg.NewAddr("s2", "out"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := t.Context()
+	go f.Serve(ctx)
+	tr := New()
+	go tr.Run(ctx, f.Trace())
+
+	// Outputs need a consumer for processing to complete
+	go func() {
+		for range f.Out() {
+		}
+	}()
+
+	m := msg.New([]any{1, 2, 3})
+	done := tr.Track(m.ID)
+	f.In() <- m.To(msg.NewAddr("f", "in"))
+
+	select {
+	case c := <-done:
+		// flow + s1 for the root, and s2 for each of the three children
+		want := Completion{ID: m.ID, Succeeded: 5}
+		if c != want {
+			t.Errorf("got completion %+v, want %+v", c, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for completion")
+	}
+}
+
+func TestTrackerWithBatch(t *testing.T) {
+	newBase := func(id string) *flow.Base { return flow.NewBase(id).WithInOut(0).WithTrace(0) }
+	s1, err := stages.NewBatch(newBase("s1"), stages.BatchLimits{MaxCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := flow.NewFlow(newBase("f"), pubsub.NewPubSub(), []flow.Stage{s1},
+		[]flow.Conn{{From: msg.NewAddr("f", "in"), To: msg.NewAddr("s1", "in")}},
+		nil,
+		[]flow.Conn{flow.SelfConn(msg.NewAddr("s1", "out"))})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := t.Context()
+	go f.Serve(ctx)
+	tr := New()
+	go tr.Run(ctx, f.Trace())
+	go func() {
+		for range f.Out() {
+		}
+	}()
+
+	a, b := msg.New("a"), msg.New("b")
+	doneA, doneB := tr.Track(a.ID), tr.Track(b.ID)
+	f.In() <- a.To(msg.NewAddr("f", "in"))
+	f.In() <- b.To(msg.NewAddr("f", "in"))
+	for _, done := range []<-chan Completion{doneA, doneB} {
+		select {
+		case c := <-done:
+			// flow + s1 for the root, and nothing for the batch, which goes to the flow output
+			if c.Succeeded != 2 || c.Failed != 0 {
+				t.Errorf("got completion %+v, want 2 successes", c)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timeout waiting for completion")
+		}
+	}
+	dctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if report, err := f.Drain(dctx); err != nil {
+		t.Errorf("drain failed with %v: %+v", err, report)
+	}
+}
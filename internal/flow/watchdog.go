@@ -0,0 +1,137 @@
+package flow
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+)
+
+// A message that a stage has been processing for longer than the flow's watchdog allows
+type StuckMsg struct {
+	Stage string // path of the stage within the outermost flow
+	ID    msg.ID
+	Since time.Time // when the stage received the message
+}
+
+// Recorded by a flow's watchdog the first time it finds a stage stuck on a message
+// (see WithWatchdog)
+type TraceStageStuck struct {
+	Time  time.Time
+	Stage string
+	ID    msg.ID
+	Since time.Time
+}
+
+// Sets how long a stage may process a message before the flow's watchdog reports it as
+// stuck, by tracing a TraceStageStuck and listing it in Stuck. The watchdog covers the
+// stages of nested flows, and only applies to the outermost flow. It relies on trace
+// events, so stages without a trace channel are never reported. A message that a stage
+// fails at its deadline (see Base.WithDeadline) is no longer considered in progress.
+func WithWatchdog(after time.Duration) Option {
+	return func(f *Flow) {
+		f.stuckAfter = after
+	}
+}
+
+// A message traced as received by a stage, keyed by stage path and message ID
+type receivedMsg struct {
+	stage string
+	id    msg.ID
+}
+
+type recv struct {
+	time     time.Time
+	reported bool // whether the watchdog has reported the message as stuck
+}
+
+// Records that the stage at the given path received a message. A message that is
+// received again, such as when it is retried, is timed from its latest receipt.
+func (c *inflight) recv(stage string, id msg.ID, t time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.received[receivedMsg{stage, id}] = &recv{time: t}
+}
+
+// Records the outcome of a message received by the stage at the given path.
+func (c *inflight) finish(stage string, id msg.ID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.received, receivedMsg{stage, id})
+}
+
+// Forgets the messages received by the stage at the given path and by the stages
+// nested in it, which will not trace their outcomes once the stage is stopped.
+func (c *inflight) forget(stage string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.received {
+		if key.stage == stage || strings.HasPrefix(key.stage, stage+"/") {
+			delete(c.received, key)
+		}
+	}
+}
+
+// Returns the messages received before the cutoff that have no outcome, oldest first,
+// along with those among them that have not been returned as new before.
+func (c *inflight) stuck(cutoff time.Time) (stuck, fresh []StuckMsg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, r := range c.received {
+		if !r.time.Before(cutoff) {
+			continue
+		}
+		m := StuckMsg{Stage: key.stage, ID: key.id, Since: r.time}
+		stuck = append(stuck, m)
+		if !r.reported {
+			r.reported = true
+			fresh = append(fresh, m)
+		}
+	}
+	oldest := func(a, b StuckMsg) int {
+		return cmp.Or(a.Since.Compare(b.Since), strings.Compare(a.Stage, b.Stage), strings.Compare(string(a.ID), string(b.ID)))
+	}
+	slices.SortFunc(stuck, oldest)
+	slices.SortFunc(fresh, oldest)
+	return stuck, fresh
+}
+
+// Returns the messages that stages have been processing for longer than the watchdog
+// allows, oldest first, or nil if the flow is not serving or has no watchdog.
+func (f *Flow) Stuck() []StuckMsg {
+	f.mu.RLock()
+	c := f.inflight
+	f.mu.RUnlock()
+	if c == nil || f.stuckAfter <= 0 || f.path != "" {
+		return nil
+	}
+	stuck, _ := c.stuck(time.Now().Add(-f.stuckAfter))
+	return stuck
+}
+
+// Periodically reports the messages that stages are newly stuck on, until the context is done.
+func (f *Flow) watch(ctx context.Context, c *inflight) {
+	ticker := time.NewTicker(max(f.stuckAfter/2, drainPollInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case now := <-ticker.C:
+			_, stuck := c.stuck(now.Add(-f.stuckAfter))
+			if f.Ch.Trace == nil {
+				continue
+			}
+			for _, m := range stuck {
+				select {
+				case f.Ch.Trace <- TraceStageStuck{now, m.Stage, m.ID, m.Since}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
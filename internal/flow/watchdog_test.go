@@ -0,0 +1,33 @@
+package flow
+
+import (
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/pubsub"
+)
+
+func TestWatchdogReportsStuckStages(t *testing.T) {
+	a := msg.NewAddr
+	f, err := NewFlow(NewBase("f").WithInOut(10).WithTrace(0), pubsub.NewPubSub(), []Stage{newSlow("s1", time.Hour)},
+		[]Conn{{From: a("f", "in"), To: a("s1", "in")}},
+		nil,
+		[]Conn{SelfConn(a("s1", "out"))},
+		WithWatchdog(20*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go f.Serve(t.Context())
+
+	in := msg.New("x")
+	start := time.Now()
+	f.In() <- in.To(a("f", "in"))
+	e := nextTrace[TraceStageStuck](t, f)
+	if e.Stage != "s1" || e.ID != in.ID || e.Time.Sub(start) < 20*time.Millisecond {
+		t.Errorf("got %+v, want s1 reported as stuck on the input after 20ms", e)
+	}
+	if stuck := f.Stuck(); len(stuck) != 1 || stuck[0].Stage != "s1" || stuck[0].ID != in.ID {
+		t.Errorf("got stuck messages %+v, want the input at s1", stuck)
+	}
+}
@@ -0,0 +1,146 @@
+package stages
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/validator"
+	"github.com/thejerf/suture/v4"
+)
+
+// Batch groups messages into batches, sending each batch as a single message whose data
+// is the array of the batched messages' data, in the order they were received. The batch
+// message is merged from the batched messages (see flow.Base.TraceSendMerged), so it
+// carries their merged tokens and lineage traces it back to each of them. The batched
+// messages succeed once their batch is sent.
+//
+// Messages held in a batch are in flight, so a flow with a partial batch only drains or
+// checkpoints once the batch is sent, and the batch is lost if the stage stops first.
+type Batch struct {
+	flow.Base
+	limits BatchLimits
+}
+
+// Determines when a Batch stage sends its current batch. At least one limit must be set.
+type BatchLimits struct {
+	// If positive, the number of messages in a full batch
+	MaxCount int
+	// If positive, the most bytes of JSON-encoded data in a batch. A message that would
+	// take the batch over the limit is put in the next batch, and a message that is over
+	// the limit on its own is sent in a batch by itself.
+	MaxBytes int
+	// If positive, how long the first message of a batch waits for the batch to be sent
+	MaxWait time.Duration
+}
+
+func NewBatch(base *flow.Base, limits BatchLimits) (*Batch, error) {
+	switch {
+	case limits.MaxCount < 0 || limits.MaxBytes < 0 || limits.MaxWait < 0:
+		return nil, errors.New("batch: limits must not be negative")
+	case limits.MaxCount == 0 && limits.MaxBytes == 0 && limits.MaxWait == 0:
+		return nil, errors.New("batch: at least one limit must be set")
+	}
+	return &Batch{*base.WithPorts(batchPorts), limits}, nil
+}
+
+// Declarative configuration for the batch stage
+type BatchConfig struct {
+	MaxCount      int   `json:"maxCount,omitempty"`
+	MaxBytes      int   `json:"maxBytes,omitempty"`
+	MaxWaitMillis int64 `json:"maxWaitMillis,omitempty"`
+}
+
+func (c BatchConfig) Validate(v *validator.Validator) {
+	v.CheckField(c.MaxCount >= 0, "maxCount", "must not be negative")
+	v.CheckField(c.MaxBytes >= 0, "maxBytes", "must not be negative")
+	v.CheckField(c.MaxWaitMillis >= 0, "maxWaitMillis", "must not be negative")
+	v.Check(c.MaxCount > 0 || c.MaxBytes > 0 || c.MaxWaitMillis > 0, "at least one of maxCount, maxBytes, and maxWaitMillis must be set")
+}
+
+func NewBatchFromConfig(base *flow.Base, cfg BatchConfig) (*Batch, error) {
+	return NewBatch(base, BatchLimits{cfg.MaxCount, cfg.MaxBytes, time.Duration(cfg.MaxWaitMillis) * time.Millisecond})
+}
+
+// The batch being collected by a Batch stage
+type batch struct {
+	msgs  []msg.Msg
+	bytes int
+	timer *time.Timer // set while a batch with a MaxWait is open
+}
+
+func (s *Batch) Serve(ctx context.Context) error {
+	var b batch
+	defer func() {
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+	}()
+	for {
+		var timeout <-chan time.Time
+		if b.timer != nil {
+			timeout = b.timer.C
+		}
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				// Input is done, so send what is left and finish.
+				s.send(&b)
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceRecv(m.ID)
+			s.add(&b, m.Msg)
+		case <-timeout:
+			s.send(&b)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Adds a message to the batch, sending the batch as the limits require.
+func (s *Batch) add(b *batch, m msg.Msg) {
+	size := 0
+	if s.limits.MaxBytes > 0 {
+		data, err := json.Marshal(m.Data)
+		if err != nil {
+			s.TraceSendError(m, fmt.Errorf("batch: measuring data: %w", err), 1)
+			return
+		}
+		size = len(data)
+		if len(b.msgs) > 0 && b.bytes+size > s.limits.MaxBytes {
+			s.send(b)
+		}
+	}
+	if len(b.msgs) == 0 && s.limits.MaxWait > 0 {
+		b.timer = time.NewTimer(s.limits.MaxWait)
+	}
+	b.msgs = append(b.msgs, m)
+	b.bytes += size
+	if (s.limits.MaxCount > 0 && len(b.msgs) >= s.limits.MaxCount) || (s.limits.MaxBytes > 0 && b.bytes >= s.limits.MaxBytes) {
+		s.send(b)
+	}
+}
+
+// Sends the batch, if it has any messages, and starts a new one.
+func (s *Batch) send(b *batch) {
+	if b.timer != nil {
+		b.timer.Stop()
+	}
+	if len(b.msgs) > 0 {
+		data := make([]any, len(b.msgs))
+		for i, m := range b.msgs {
+			data[i] = m.Data
+		}
+		s.TraceSendMerged("out", b.msgs, data)
+		for _, m := range b.msgs {
+			s.TraceSuccess(m.ID)
+		}
+	}
+	*b = batch{}
+}
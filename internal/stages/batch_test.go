@@ -0,0 +1,99 @@
+package stages
+
+import (
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/token"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBatchLimits(t *testing.T) {
+	tests := []struct {
+		name   string
+		limits BatchLimits
+		values []any
+		want   [][]any
+	}{
+		{"count", BatchLimits{MaxCount: 2}, []any{1, 2, 3, 4, 5}, [][]any{{1, 2}, {3, 4}, {5}}},
+		{"bytes", BatchLimits{MaxBytes: 6}, []any{"ab", "cd", "efgh", "i"}, [][]any{{"ab"}, {"cd"}, {"efgh"}, {"i"}}},
+		{"bytes fill", BatchLimits{MaxBytes: 4}, []any{1, 2, 3, 4, 55555, 6}, [][]any{{1, 2, 3, 4}, {55555}, {6}}},
+		{"count or bytes", BatchLimits{MaxCount: 3, MaxBytes: 4}, []any{1, 2, 3, 4, 5}, [][]any{{1, 2, 3}, {4, 5}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewBatch(flow.NewBase("b").WithInOut(0), tt.limits)
+			if err != nil {
+				t.Fatal(err)
+			}
+			go s.Serve(t.Context())
+			go func() {
+				for _, v := range tt.values {
+					s.In() <- msg.New(v).To(msg.NewAddr("b", "in"))
+				}
+				close(s.In())
+			}()
+			var got [][]any
+			for m := range s.Out() {
+				got = append(got, m.Data.([]any))
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected batches (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestBatchMaxWait(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		s, err := NewBatch(flow.NewBase("b").WithInOut(0), BatchLimits{MaxCount: 10, MaxWait: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(t.Context())
+
+		start := time.Now()
+		s.In() <- msg.New(1).To(msg.NewAddr("b", "in"))
+		time.Sleep(500 * time.Millisecond)
+		s.In() <- msg.New(2).To(msg.NewAddr("b", "in"))
+		m := <-s.Out()
+		if elapsed := time.Since(start); elapsed != time.Second {
+			t.Errorf("got batch after %v, want 1s", elapsed)
+		}
+		if diff := cmp.Diff([]any{1, 2}, m.Data); diff != "" {
+			t.Errorf("unexpected batch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestBatchMergesMessages(t *testing.T) {
+	s, err := NewBatch(flow.NewBase("b").WithInOut(0).WithTrace(10), BatchLimits{MaxCount: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(t.Context())
+
+	split := token.Value(42).Split(2)
+	a := msg.New("a").MergeTokens(token.Tokens{"t": split[0]})
+	b := msg.New("b").MergeTokens(token.Tokens{"t": split[1]})
+	b.Iteration = 2
+	s.In() <- a.To(msg.NewAddr("b", "in"))
+	s.In() <- b.To(msg.NewAddr("b", "in"))
+	m := <-s.Out()
+	if m.Tokens["t"] != 42 || m.Iteration != 2 {
+		t.Errorf("got tokens %v and iteration %d, want the merged tokens and iteration 2", m.Tokens, m.Iteration)
+	}
+
+	var merge flow.TraceMerge
+	for merge.ID == "" {
+		if e, ok := (<-s.Trace()).(flow.TraceMerge); ok {
+			merge = e
+		}
+	}
+	if merge.ID != m.ID || !cmp.Equal(merge.ParentIDs, []msg.ID{a.ID, b.ID}) {
+		t.Errorf("got merge %+v, want the batch merged from %v and %v", merge, a.ID, b.ID)
+	}
+}
@@ -5,6 +5,8 @@ import (
 	"time"
 
 	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/validator"
+	"github.com/thejerf/suture/v4"
 )
 
 type Delay struct {
@@ -13,19 +15,43 @@ type Delay struct {
 }
 
 func NewDelay(base *flow.Base, duration time.Duration) *Delay {
-	return &Delay{*base, duration}
+	return &Delay{*base.WithPorts(delayPorts), duration}
+}
+
+// Declarative configuration for the delay stage
+type DelayConfig struct {
+	Millis int64 `json:"millis"`
+}
+
+func (c DelayConfig) Validate(v *validator.Validator) {
+	v.CheckField(c.Millis >= 0, "millis", "must not be negative")
+}
+
+func NewDelayFromConfig(base *flow.Base, cfg DelayConfig) (*Delay, error) {
+	return NewDelay(base, time.Duration(cfg.Millis)*time.Millisecond), nil
 }
 
 func (s *Delay) Serve(ctx context.Context) error {
 	for {
 		select {
 		case m, ok := <-s.Ch.In:
-			s.TraceRecv(m.ID)
 			if !ok {
+				// Input is done, so the stage is finished and should not be restarted.
 				close(s.Ch.Out)
-				return nil
+				return suture.ErrDoNotRestart
+			}
+			mctx := s.TraceRecvContext(ctx, m.Msg)
+			select {
+			case <-time.After(s.duration):
+			case <-mctx.Done():
+				if ctx.Err() != nil {
+					return nil
+				}
+				// The message's deadline passed. It is failed once, whether by the
+				// stage's deadline handling or here.
+				s.TraceSendError(m.Msg, context.Cause(mctx), 1)
+				continue
 			}
-			time.Sleep(s.duration)
 			s.TraceSend("out", m.Msg, m.Data)
 			s.TraceSuccess(m.ID)
 		case <-ctx.Done():
@@ -1,6 +1,7 @@
 package stages
 
 import (
+	"errors"
 	"testing"
 	"testing/synctest"
 	"time"
@@ -79,3 +80,21 @@ func TestDelayStage(t *testing.T) {
 		})
 	})
 }
+
+func TestDelayStageDeadline(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		delay := NewDelay(flow.NewBase("test-delay").WithIn(1).WithOut(1).WithDeadline(50*time.Millisecond), time.Second)
+		go delay.Serve(t.Context())
+
+		start := time.Now()
+		delay.In() <- msg.New("x").To(msg.NewAddr("test-delay", "in"))
+		m := <-delay.Out()
+		failed, ok := m.Data.(flow.FailedMsg)
+		if m.Port != flow.ErrorPort || !ok || !errors.Is(failed.Error, flow.ErrDeadlineExceeded) {
+			t.Errorf("got %v on port %q, want a deadline error on the error port", m.Data, m.Port)
+		}
+		if elapsed := time.Since(start); elapsed != 50*time.Millisecond {
+			t.Errorf("got error output after %v, want 50ms", elapsed)
+		}
+	})
+}
@@ -0,0 +1,169 @@
+package stages
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"github.com/thejerf/suture/v4"
+)
+
+// Func is a stage that runs a Go function on the data of each message and sends each of
+// its results on the "out" port. Messages whose data does not have the function's input
+// type, or for which the function returns an error or panics, are sent to the error port.
+//
+// The function's context is done once the stage stops or the message's deadline passes
+// (see flow.Base.WithDeadline). Funcs are constructed by NewMap, NewFilter, and NewFlatMap.
+type Func struct {
+	flow.Base
+	fn          func(ctx context.Context, data any) ([]any, error)
+	concurrency int
+}
+
+// Returns a stage that sends the result of fn for each message.
+func NewMap[In, Out any](base *flow.Base, fn func(ctx context.Context, data In) (Out, error)) *Func {
+	return newFunc(base, "map", mapPorts, func(ctx context.Context, data any) ([]any, error) {
+		in, err := dataAs[In](data)
+		if err != nil {
+			return nil, err
+		}
+		out, err := fn(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		return []any{out}, nil
+	})
+}
+
+// Returns a stage that passes on the data of each message for which fn returns true.
+func NewFilter[T any](base *flow.Base, fn func(ctx context.Context, data T) (bool, error)) *Func {
+	return newFunc(base, "filter", filterPorts, func(ctx context.Context, data any) ([]any, error) {
+		in, err := dataAs[T](data)
+		if err != nil {
+			return nil, err
+		}
+		keep, err := fn(ctx, in)
+		if err != nil || !keep {
+			return nil, err
+		}
+		return []any{in}, nil
+	})
+}
+
+// Returns a stage that sends each of the results of fn for each message.
+func NewFlatMap[In, Out any](base *flow.Base, fn func(ctx context.Context, data In) ([]Out, error)) *Func {
+	return newFunc(base, "flatmap", flatMapPorts, func(ctx context.Context, data any) ([]any, error) {
+		in, err := dataAs[In](data)
+		if err != nil {
+			return nil, err
+		}
+		outs, err := fn(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		results := make([]any, len(outs))
+		for i, out := range outs {
+			results[i] = out
+		}
+		return results, nil
+	})
+}
+
+func newFunc(base *flow.Base, kind string, ports flow.Ports, fn func(ctx context.Context, data any) ([]any, error)) *Func {
+	if base.Description() == (flow.Description{}) {
+		base.WithDescription(flow.Description{Kind: kind})
+	}
+	return &Func{*base.WithPorts(ports), fn, 1}
+}
+
+// Sets the number of messages the stage may process at once, which defaults to one.
+// With more than one, the results of different messages may be sent out of order.
+func (s *Func) WithConcurrency(n int) *Func {
+	s.concurrency = max(n, 1)
+	return s
+}
+
+// Returns the data as a value of type T, or an error if it has another type.
+func dataAs[T any](data any) (T, error) {
+	v, ok := data.(T)
+	if !ok {
+		return v, fmt.Errorf("data is %T, want %v", data, reflect.TypeFor[T]())
+	}
+	return v, nil
+}
+
+// The results of the function for a message
+type funcResult struct {
+	msg     msg.Msg
+	results []any
+	err     error
+}
+
+func (s *Func) Serve(ctx context.Context) error {
+	// Workers run the function and hand their results to this goroutine, which sends them,
+	// so that workers never block on the stage's channels once it stops.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	results := make(chan funcResult)
+	in, active := s.Ch.In, 0
+	for {
+		// Take a message only once there is a free slot, to preserve backpressure
+		recv := in
+		if active == s.concurrency {
+			recv = nil
+		}
+		select {
+		case m, ok := <-recv:
+			if !ok {
+				// Input is done, so the stage is finished once its messages are.
+				in = nil
+				break
+			}
+			mctx := s.TraceRecvContext(ctx, m.Msg)
+			active++
+			wg.Go(func() {
+				r := funcResult{msg: m.Msg}
+				r.results, r.err = s.call(mctx, m.Data)
+				select {
+				case results <- r:
+				case <-ctx.Done():
+				}
+			})
+		case r := <-results:
+			active--
+			s.send(r)
+		case <-ctx.Done():
+			return nil
+		}
+		if in == nil && active == 0 {
+			close(s.Ch.Out)
+			return suture.ErrDoNotRestart
+		}
+	}
+}
+
+// Traces the outcome of a message given the function's results.
+func (s *Func) send(r funcResult) {
+	if r.err != nil {
+		s.TraceSendError(r.msg, r.err, 1)
+		return
+	}
+	for _, result := range r.results {
+		s.TraceSend("out", r.msg, result)
+	}
+	s.TraceSuccess(r.msg.ID)
+}
+
+// Calls the function, turning a panic into an error, since it runs outside the
+// goroutine supervised by the flow.
+func (s *Func) call(ctx context.Context, data any) (results []any, err error) {
+	defer func() {
+		if pv := recover(); pv != nil {
+			err = fmt.Errorf("%s: panic: %v", s.Description().Kind, pv)
+		}
+	}()
+	return s.fn(ctx, data)
+}
@@ -0,0 +1,146 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+)
+
+// Sends each value through the stage, closes its input, and returns the outputs.
+func runFunc(t *testing.T, s *Func, values ...any) []msg.MsgFrom {
+	t.Helper()
+	go s.Serve(t.Context())
+	go func() {
+		for _, v := range values {
+			s.In() <- msg.New(v).To(msg.NewAddr(s.ID(), "in"))
+		}
+		close(s.In())
+	}()
+	var outs []msg.MsgFrom
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case m, ok := <-s.Out():
+			if !ok {
+				return outs
+			}
+			outs = append(outs, m)
+		case <-timeout:
+			t.Fatal("timeout waiting for the stage to close its output")
+		}
+	}
+}
+
+func TestFuncStages(t *testing.T) {
+	double := NewMap(flow.NewBase("double").WithInOut(0), func(ctx context.Context, n int) (int, error) {
+		if n < 0 {
+			return 0, errors.New("negative")
+		}
+		return 2 * n, nil
+	})
+	even := NewFilter(flow.NewBase("even").WithInOut(0), func(ctx context.Context, n int) (bool, error) {
+		return n%2 == 0, nil
+	})
+	words := NewFlatMap(flow.NewBase("words").WithInOut(0), func(ctx context.Context, s string) ([]string, error) {
+		return strings.Fields(s), nil
+	})
+	tests := []struct {
+		name   string
+		s      *Func
+		values []any
+		want   []any // output data, with errors as the text of a failed message's error
+	}{
+		{"map", double, []any{1, -1, "x"}, []any{2, "negative", "data is string, want int"}},
+		{"filter", even, []any{1, 2, 3, 4}, []any{2, 4}},
+		{"flatmap", words, []any{"a b", "", "c"}, []any{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []any
+			for _, m := range runFunc(t, tt.s, tt.values...) {
+				if f, ok := m.Data.(flow.FailedMsg); ok {
+					got = append(got, f.Error.Error())
+				} else {
+					got = append(got, m.Data)
+				}
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got outputs %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got outputs %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+	if d := double.Description(); d.Kind != "map" {
+		t.Errorf("got description %+v, want kind map", d)
+	}
+}
+
+func TestFuncRecoversPanics(t *testing.T) {
+	s := NewMap(flow.NewBase("s").WithInOut(0), func(ctx context.Context, v any) (any, error) {
+		panic("oops")
+	})
+	outs := runFunc(t, s, 1)
+	if len(outs) != 1 || outs[0].Port != flow.ErrorPort || !strings.Contains(outs[0].Data.(flow.FailedMsg).Error.Error(), "panic: oops") {
+		t.Errorf("got outputs %v, want a panic error on the error port", outs)
+	}
+}
+
+func TestFuncConcurrency(t *testing.T) {
+	var running, peak atomic.Int32
+	s := NewMap(flow.NewBase("s").WithInOut(0), func(ctx context.Context, v any) (any, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(10 * time.Millisecond)
+		return v, nil
+	}).WithConcurrency(3)
+	if outs := runFunc(t, s, 1, 2, 3, 4, 5, 6, 7, 8, 9); len(outs) != 9 {
+		t.Errorf("got %d outputs, want 9", len(outs))
+	}
+	if p := peak.Load(); p != 3 {
+		t.Errorf("got at most %d concurrent calls, want 3", p)
+	}
+}
+
+func TestFuncWaitsForWorkersWhenStopped(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	s := NewMap(flow.NewBase("m").WithInOut(0), func(ctx context.Context, n int) (int, error) {
+		close(started)
+		<-release
+		return n, nil
+	})
+	ctx, cancel := context.WithCancel(t.Context())
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Serve(ctx) }()
+	s.In() <- msg.New(1).To(msg.NewAddr("m", "in"))
+	<-started
+
+	// The stage stops while its worker is running and nothing reads its output
+	cancel()
+	select {
+	case <-errCh:
+		t.Fatal("Serve returned while a worker was running")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("got Serve error %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for Serve to return once its worker finished")
+	}
+}
@@ -0,0 +1,284 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/token"
+	"datapotamus.com/internal/validator"
+	"github.com/itchyny/gojq"
+	"github.com/thejerf/suture/v4"
+)
+
+// Join matches the messages on its "left" and "right" ports by key. Each message is
+// retained until the retention limits evict it, and is joined with each message with
+// the same key that is retained on the other side, in either order of arrival.
+//
+// A joined message is merged from its left and right messages (see
+// flow.Base.TraceSendMerged), so lineage traces it back to both, and its data is an
+// object with the "left" and "right" messages' data. A message that joins several others
+// is merged into each of them, but its token shares are not duplicated, since duplicate
+// shares would cancel out (see Scatter): the shares of a message that joins others when
+// it arrives are split among those joins, and a message that joins none when it arrives
+// keeps its shares for the first join it is part of later. In a left outer join, a left
+// message that has not joined any right message by the time it is evicted is sent with a
+// null "right". Messages succeed once they are evicted, and messages whose key cannot be
+// computed are sent to the error port.
+//
+// Retained messages are in flight, so a flow only drains or checkpoints once they are
+// evicted. When the input closes, every retained message is evicted.
+type Join struct {
+	flow.Base
+	spec     JoinSpec
+	leftKey  *gojq.Code
+	rightKey *gojq.Code
+}
+
+// The kinds of joins a Join stage can perform
+type JoinType string
+
+const (
+	// Sends only matched pairs of messages
+	InnerJoin JoinType = "inner"
+	// Also sends the left messages that match no right message
+	LeftOuterJoin JoinType = "left-outer"
+)
+
+// Determines how a Join stage matches messages and how long it retains them.
+// At least one retention limit must be set.
+type JoinSpec struct {
+	Type JoinType
+	// jq filters whose first result on a message's data is its key, as with JQPartition
+	LeftKey, RightKey string
+	// If positive, how long each message is retained after it is received
+	MaxAge time.Duration
+	// If positive, the most messages retained on each side. Once a side is over the
+	// limit, its oldest message is evicted.
+	MaxCount int
+}
+
+func NewJoin(base *flow.Base, spec JoinSpec) (*Join, error) {
+	switch {
+	case spec.Type != InnerJoin && spec.Type != LeftOuterJoin:
+		return nil, fmt.Errorf("join: unknown join type %q", spec.Type)
+	case spec.MaxAge < 0 || spec.MaxCount < 0:
+		return nil, errors.New("join: retention limits must not be negative")
+	case spec.MaxAge == 0 && spec.MaxCount == 0:
+		return nil, errors.New("join: at least one retention limit must be set")
+	}
+	leftKey, err := compileJQ(spec.LeftKey)
+	if err != nil {
+		return nil, fmt.Errorf("join: left key: %w", err)
+	}
+	rightKey, err := compileJQ(spec.RightKey)
+	if err != nil {
+		return nil, fmt.Errorf("join: right key: %w", err)
+	}
+	return &Join{*base.WithPorts(joinPorts), spec, leftKey, rightKey}, nil
+}
+
+// Declarative configuration for the join stage
+type JoinConfig struct {
+	Type         string `json:"type"`
+	LeftKey      string `json:"leftKey"`
+	RightKey     string `json:"rightKey"`
+	MaxAgeMillis int64  `json:"maxAgeMillis,omitempty"`
+	MaxCount     int    `json:"maxCount,omitempty"`
+}
+
+func (c JoinConfig) Validate(v *validator.Validator) {
+	v.CheckField(validator.In(c.Type, string(InnerJoin), string(LeftOuterJoin)), "type", "must be inner or left-outer")
+	v.CheckField(validator.NotBlank(c.LeftKey), "leftKey", "must not be blank")
+	v.CheckField(validator.NotBlank(c.RightKey), "rightKey", "must not be blank")
+	v.CheckField(c.MaxAgeMillis >= 0, "maxAgeMillis", "must not be negative")
+	v.CheckField(c.MaxCount >= 0, "maxCount", "must not be negative")
+	v.Check(c.MaxAgeMillis > 0 || c.MaxCount > 0, "at least one of maxAgeMillis and maxCount must be set")
+}
+
+func NewJoinFromConfig(base *flow.Base, cfg JoinConfig) (*Join, error) {
+	return NewJoin(base, JoinSpec{
+		Type:     JoinType(cfg.Type),
+		LeftKey:  cfg.LeftKey,
+		RightKey: cfg.RightKey,
+		MaxAge:   time.Duration(cfg.MaxAgeMillis) * time.Millisecond,
+		MaxCount: cfg.MaxCount,
+	})
+}
+
+// A retained message
+type retained struct {
+	msg     msg.Msg
+	key     string
+	at      time.Time    // when the message was received
+	matched bool         // whether the message has been joined with another
+	tokens  token.Tokens // token shares not yet carried by a join
+}
+
+// Returns the message with the token shares it has not yet contributed to a join, which
+// it then no longer has.
+func (e *retained) take() msg.Msg {
+	m := e.msg
+	m.Tokens, e.tokens = e.tokens, nil
+	return m
+}
+
+// The messages retained from one input port
+type joinSide struct {
+	left  bool
+	queue []*retained            // in the order they were received
+	byKey map[string][]*retained // in the order they were received
+}
+
+// State of a running Join stage
+type joinRun struct {
+	left, right *joinSide
+	timer       *time.Timer // set while messages are retained with a MaxAge
+}
+
+func (s *Join) Serve(ctx context.Context) error {
+	r := &joinRun{
+		left:  &joinSide{left: true, byKey: map[string][]*retained{}},
+		right: &joinSide{byKey: map[string][]*retained{}},
+	}
+	defer func() {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+	}()
+	for {
+		var timeout <-chan time.Time
+		if r.timer != nil {
+			timeout = r.timer.C
+		}
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				// Input is done, so evict every message and finish.
+				s.evict(r.left, len(r.left.queue))
+				s.evict(r.right, len(r.right.queue))
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceRecv(m.ID)
+			s.add(r, m)
+		case <-timeout:
+			r.timer = nil
+			s.expire(r, time.Now())
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Joins a message with the retained messages of the other side and retains it.
+func (s *Join) add(r *joinRun, m msg.MsgTo) {
+	now := time.Now()
+	side, other, code, filter := r.left, r.right, s.leftKey, s.spec.LeftKey
+	switch m.Port {
+	case "left":
+	case "right":
+		side, other, code, filter = r.right, r.left, s.rightKey, s.spec.RightKey
+	default:
+		s.TraceSendError(m.Msg, fmt.Errorf("join: unknown input port %q", m.Port), 1)
+		return
+	}
+	key, err := jqKey(code, filter, m.Data)
+	if err != nil {
+		s.TraceSendError(m.Msg, fmt.Errorf("join: %s key: %w", m.Port, err), 1)
+		return
+	}
+
+	// Evict expired messages first, so that they are not joined
+	s.expire(r, now)
+	e := &retained{msg: m.Msg, key: key, at: now, tokens: m.Tokens}
+	matches := other.byKey[key]
+	if len(matches) > 0 {
+		// Split the message's token shares among its joins, as Scatter does
+		shares := map[string][]token.Value{}
+		for id, v := range m.Tokens {
+			shares[id] = v.Split(len(matches))
+		}
+		e.tokens = nil
+		for i, o := range matches {
+			em := e.msg
+			em.Tokens = token.Tokens{}
+			for id, vs := range shares {
+				em.Tokens[id] = vs[i]
+			}
+			if side.left {
+				s.send(em, o.take())
+			} else {
+				s.send(o.take(), em)
+			}
+			e.matched, o.matched = true, true
+		}
+	}
+	side.queue = append(side.queue, e)
+	side.byKey[key] = append(side.byKey[key], e)
+	if s.spec.MaxCount > 0 && len(side.queue) > s.spec.MaxCount {
+		s.evict(side, len(side.queue)-s.spec.MaxCount)
+	}
+	s.schedule(r)
+}
+
+// Sends the join of a left and a right message, which carries their tokens.
+func (s *Join) send(left, right msg.Msg) {
+	data := map[string]any{"left": left.Data, "right": right.Data}
+	s.TraceSendMerged("out", []msg.Msg{left, right}, data)
+}
+
+// Evicts the messages that are older than the MaxAge at time now.
+func (s *Join) expire(r *joinRun, now time.Time) {
+	if s.spec.MaxAge <= 0 {
+		return
+	}
+	for _, side := range []*joinSide{r.left, r.right} {
+		n := 0
+		for n < len(side.queue) && !now.Before(side.queue[n].at.Add(s.spec.MaxAge)) {
+			n++
+		}
+		s.evict(side, n)
+	}
+	s.schedule(r)
+}
+
+// Sets a timer for when the oldest retained message expires, if there is a MaxAge.
+func (s *Join) schedule(r *joinRun) {
+	if s.spec.MaxAge <= 0 {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	var oldest time.Time
+	for _, side := range []*joinSide{r.left, r.right} {
+		if len(side.queue) > 0 && (oldest.IsZero() || side.queue[0].at.Before(oldest)) {
+			oldest = side.queue[0].at
+		}
+	}
+	if !oldest.IsZero() {
+		r.timer = time.NewTimer(time.Until(oldest.Add(s.spec.MaxAge)))
+	}
+}
+
+// Evicts the n oldest messages of a side, sending unmatched left messages in a left
+// outer join, and succeeds them.
+func (s *Join) evict(side *joinSide, n int) {
+	for _, e := range side.queue[:n] {
+		side.byKey[e.key] = slices.DeleteFunc(side.byKey[e.key], func(o *retained) bool { return o == e })
+		if len(side.byKey[e.key]) == 0 {
+			delete(side.byKey, e.key)
+		}
+		if side.left && !e.matched && s.spec.Type == LeftOuterJoin {
+			s.TraceSend("out", e.msg, map[string]any{"left": e.msg.Data, "right": nil})
+		}
+		s.TraceSuccess(e.msg.ID)
+	}
+	side.queue = slices.Delete(side.queue, 0, n)
+}
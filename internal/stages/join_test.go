@@ -0,0 +1,195 @@
+package stages
+
+import (
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"github.com/google/go-cmp/cmp"
+)
+
+// A message to send to a port of a join stage
+type joinInput struct {
+	port string
+	data any
+}
+
+// Sends the inputs through the stage, closes its input, and returns the outputs' data.
+func runJoin(t *testing.T, s *Join, inputs ...joinInput) []any {
+	t.Helper()
+	go s.Serve(t.Context())
+	go func() {
+		for _, in := range inputs {
+			s.In() <- msg.New(in.data).To(msg.NewAddr(s.ID(), in.port))
+		}
+		close(s.In())
+	}()
+	var got []any
+	for _, m := range collect(t, s.Out()) {
+		got = append(got, m.Data)
+	}
+	return got
+}
+
+func pair(left, right any) map[string]any {
+	return map[string]any{"left": left, "right": right}
+}
+
+func TestJoin(t *testing.T) {
+	a1 := map[string]any{"speaker": "a", "text": "hi"}
+	b1 := map[string]any{"speaker": "b", "text": "hello"}
+	a2 := map[string]any{"speaker": "a", "text": "bye"}
+	alice := map[string]any{"id": "a", "name": "Alice"}
+	alice2 := map[string]any{"id": "a", "name": "Alicia"}
+	tests := []struct {
+		name   string
+		typ    JoinType
+		count  int
+		inputs []joinInput
+		want   []any
+	}{
+		{
+			"inner",
+			InnerJoin, 10,
+			[]joinInput{{"left", a1}, {"right", alice}, {"left", b1}, {"left", a2}},
+			[]any{pair(a1, alice), pair(a2, alice)},
+		},
+		{
+			"left outer",
+			LeftOuterJoin, 10,
+			[]joinInput{{"left", a1}, {"right", alice}, {"left", b1}, {"left", a2}},
+			[]any{pair(a1, alice), pair(a2, alice), pair(b1, nil)},
+		},
+		{
+			"several matches",
+			InnerJoin, 10,
+			[]joinInput{{"right", alice}, {"right", alice2}, {"left", a1}},
+			[]any{pair(a1, alice), pair(a1, alice2)},
+		},
+		{
+			"max count",
+			LeftOuterJoin, 1,
+			[]joinInput{{"left", a1}, {"left", a2}, {"right", alice}},
+			[]any{pair(a1, nil), pair(a2, alice)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec := JoinSpec{Type: tt.typ, LeftKey: ".speaker", RightKey: ".id", MaxCount: tt.count}
+			s, err := NewJoin(flow.NewBase("j").WithInOut(0), spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(tt.want, runJoin(t, s, tt.inputs...)); diff != "" {
+				t.Errorf("unexpected joins (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestJoinMaxAge(t *testing.T) {
+	synctest.Test(t, func(t *testing.T) {
+		spec := JoinSpec{Type: LeftOuterJoin, LeftKey: ".", RightKey: ".", MaxAge: time.Second}
+		s, err := NewJoin(flow.NewBase("j").WithInOut(0), spec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.Serve(t.Context())
+
+		start := time.Now()
+		s.In() <- msg.New("a").To(msg.NewAddr("j", "right"))
+		time.Sleep(2 * time.Second)
+		// The right message has expired, so the left message is sent unmatched once it expires
+		s.In() <- msg.New("a").To(msg.NewAddr("j", "left"))
+		m := <-s.Out()
+		if elapsed := time.Since(start); elapsed != 3*time.Second {
+			t.Errorf("got output after %v, want 3s", elapsed)
+		}
+		if diff := cmp.Diff(pair("a", nil), m.Data); diff != "" {
+			t.Errorf("unexpected output (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestJoinTracesMerge(t *testing.T) {
+	spec := JoinSpec{Type: InnerJoin, LeftKey: ".id", RightKey: ".id", MaxCount: 10}
+	s, err := NewJoin(flow.NewBase("j").WithInOut(0).WithTrace(20), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(t.Context())
+
+	left, right := msg.New(map[string]any{"id": 1}), msg.New(map[string]any{"id": 1})
+	s.In() <- left.To(msg.NewAddr("j", "left"))
+	s.In() <- right.To(msg.NewAddr("j", "right"))
+	m := <-s.Out()
+
+	var merge flow.TraceMerge
+	for merge.ID == "" {
+		if e, ok := (<-s.Trace()).(flow.TraceMerge); ok {
+			merge = e
+		}
+	}
+	if merge.ID != m.ID || !cmp.Equal(merge.ParentIDs, []msg.ID{left.ID, right.ID}) {
+		t.Errorf("got merge %+v, want the join merged from %v and %v", merge, left.ID, right.ID)
+	}
+
+	s.In() <- msg.New("x").To(msg.NewAddr("j", "left"))
+	if m := <-s.Out(); m.Port != flow.ErrorPort {
+		t.Errorf("got %v for a message without a key, want a message on the error port", m)
+	}
+}
+
+func TestScatterJoinGather(t *testing.T) {
+	sc, err := NewScatter(flow.NewBase("s").WithInOut(0), "t", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spec := JoinSpec{Type: InnerJoin, LeftKey: ".speaker", RightKey: ".id", MaxCount: 10}
+	j, err := NewJoin(flow.NewBase("j").WithInOut(0), spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGather(flow.NewBase("g").WithInOut(0), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sc.Serve(t.Context())
+	go j.Serve(t.Context())
+	go g.Serve(t.Context())
+
+	// Each scattered item joins both right messages, so the group is only complete once
+	// all four joins are gathered.
+	a1 := map[string]any{"speaker": "a", "text": "hi"}
+	a2 := map[string]any{"speaker": "a", "text": "bye"}
+	alice := map[string]any{"id": "a", "name": "Alice"}
+	alice2 := map[string]any{"id": "a", "name": "Alicia"}
+	j.In() <- msg.New(alice).To(msg.NewAddr("j", "right"))
+	j.In() <- msg.New(alice2).To(msg.NewAddr("j", "right"))
+	go func() {
+		sc.In() <- msg.New([]any{a1, a2}).To(msg.NewAddr("s", "in"))
+		close(sc.In())
+	}()
+	go func() {
+		for m := range sc.Out() {
+			j.In() <- m.Msg.To(msg.NewAddr("j", "left"))
+		}
+		close(j.In())
+	}()
+	go func() {
+		for m := range j.Out() {
+			g.In() <- m.Msg.To(msg.NewAddr("g", "in"))
+		}
+		close(g.In())
+	}()
+	outs := collect(t, g.Out())
+	if len(outs) != 1 {
+		t.Fatalf("got %d outputs, want 1", len(outs))
+	}
+	want := []any{pair(a1, alice), pair(a1, alice2), pair(a2, alice), pair(a2, alice2)}
+	if diff := cmp.Diff(want, outs[0].Data); diff != "" {
+		t.Errorf("unexpected gathered joins (-want +got):\n%s", diff)
+	}
+}
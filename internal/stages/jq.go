@@ -2,14 +2,19 @@ package stages
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"time"
 
 	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/validator"
 	"github.com/itchyny/gojq"
+	"github.com/thejerf/suture/v4"
 )
 
-// todo: where if anywhere should we use suture.ErrTerminateSupervisorTree to fail the whole flow on unexpected errors?
+// Stages report unexpected errors by returning them from Serve. Whether that restarts the
+// stage or terminates the flow is decided by the flow's failure policy (see flow.FailurePolicy).
 
 type JQ struct {
 	flow.Base
@@ -18,6 +23,17 @@ type JQ struct {
 }
 
 func NewJQ(base *flow.Base, filter string, timeout time.Duration) (*JQ, error) {
+	code, err := compileJQ(filter)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("jq config: TimeoutMillis should be greater than zero")
+	}
+	return &JQ{*base.WithPorts(jqPorts), code, timeout}, nil
+}
+
+func compileJQ(filter string) (*gojq.Code, error) {
 	query, err := gojq.Parse(filter)
 	if err != nil {
 		return nil, fmt.Errorf("jq: failed to parse filter: %w", err)
@@ -26,10 +42,22 @@ func NewJQ(base *flow.Base, filter string, timeout time.Duration) (*JQ, error) {
 	if err != nil {
 		return nil, fmt.Errorf("jq: failed to compile filter: %w", err)
 	}
-	if timeout <= 0 {
-		return nil, fmt.Errorf("jq config: TimeoutMillis should be greater than zero")
-	}
-	return &JQ{*base, code, timeout}, nil
+	return code, nil
+}
+
+// Declarative configuration for the jq stage
+type JQConfig struct {
+	Filter        string `json:"filter"`
+	TimeoutMillis int64  `json:"timeoutMillis"`
+}
+
+func (c JQConfig) Validate(v *validator.Validator) {
+	v.CheckField(validator.NotBlank(c.Filter), "filter", "must not be blank")
+	v.CheckField(c.TimeoutMillis > 0, "timeoutMillis", "must be greater than zero")
+}
+
+func NewJQFromConfig(base *flow.Base, cfg JQConfig) (*JQ, error) {
+	return NewJQ(base, cfg.Filter, time.Duration(cfg.TimeoutMillis)*time.Millisecond)
 }
 
 func (s *JQ) Serve(ctx context.Context) error {
@@ -37,24 +65,19 @@ func (s *JQ) Serve(ctx context.Context) error {
 		select {
 		case m, ok := <-s.Ch.In:
 			if !ok {
+				// Input is done, so the stage is finished and should not be restarted.
 				close(s.Ch.Out)
-				return nil
+				return suture.ErrDoNotRestart
 			}
-			fmt.Println("jq pre received")
-			s.TraceRecv(m.ID)
-			fmt.Println("jq received")
-			results, err := s.Query(ctx, m.Data)
+			mctx := s.TraceRecvContext(ctx, m.Msg)
+			results, err := s.Query(mctx, m.Data)
 			if err != nil {
-				s.TraceFailure(m.ID, err)
+				s.TraceSendError(m.Msg, err, 1)
 			} else {
 				for _, result := range results {
 					s.TraceSend("out", m.Msg, result)
 				}
 				s.TraceSuccess(m.ID)
-
-				// for merge nodes:
-				// id := s.TraceMerge(...)
-				// s.Send(msg.NewWithID(id, ...), "out")
 			}
 		case <-ctx.Done():
 			return nil
@@ -92,3 +115,33 @@ func (s *JQ) Query(ctx context.Context, data any) ([]any, error) {
 	}
 	return results, nil
 }
+
+// Returns a conn partition keyed by the first result of a jq filter on each message's data.
+// String results are used as keys directly, and other results are encoded as JSON.
+func JQPartition(filter string) (*flow.Partition, error) {
+	code, err := compileJQ(filter)
+	if err != nil {
+		return nil, err
+	}
+	return flow.PartitionBy(filter, func(m msg.Msg) (string, error) {
+		return jqKey(code, filter, m.Data)
+	}), nil
+}
+
+// Returns the first result of a jq filter on the data as a key. String results are used
+// as keys directly, and other results are encoded as JSON.
+func jqKey(code *gojq.Code, filter string, data any) (string, error) {
+	result, ok := code.Run(data).Next()
+	if !ok {
+		return "", fmt.Errorf("jq: key filter %q produced no result", filter)
+	}
+	switch result := result.(type) {
+	case error:
+		return "", result
+	case string:
+		return result, nil
+	default:
+		key, err := json.Marshal(result)
+		return string(key), err
+	}
+}
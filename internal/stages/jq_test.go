@@ -0,0 +1,64 @@
+package stages
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+)
+
+func TestJQPartition(t *testing.T) {
+	p, err := JQPartition(".user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		data any
+		want string
+	}{
+		{map[string]any{"user": "ada"}, "ada"},
+		{map[string]any{"user": 7}, "7"},
+		{map[string]any{"user": map[string]any{"id": 7}}, `{"id":7}`},
+		{map[string]any{}, "null"},
+	}
+	for _, tt := range tests {
+		got, err := p.Key(msg.New(tt.data))
+		if err != nil || got != tt.want {
+			t.Errorf("key of %v: got %q, %v, want %q", tt.data, got, err, tt.want)
+		}
+	}
+	if _, err := p.Key(msg.New("not an object")); err == nil {
+		t.Error("expected an error indexing a string")
+	}
+	if _, err := JQPartition(".["); err == nil {
+		t.Error("expected an error for an invalid filter")
+	}
+}
+
+func TestJQSendsFailuresToErrorPort(t *testing.T) {
+	s, err := NewJQ(flow.NewBase("jq").WithInOut(1), `error("bad input")`, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Ports().HasOut(flow.ErrorPort) {
+		t.Fatal("jq stage does not declare the error port")
+	}
+	go s.Serve(t.Context())
+
+	in := msg.New(map[string]any{"x": 1})
+	s.In() <- in.To(msg.NewAddr("jq", "in"))
+	select {
+	case m := <-s.Out():
+		if m.Addr != msg.NewAddr("jq", flow.ErrorPort) {
+			t.Fatalf("got message on %v, want the error port", m.Addr)
+		}
+		failed := m.Data.(flow.FailedMsg)
+		if failed.Msg.ID != in.ID || failed.Stage != "jq" || failed.Attempt != 1 || !strings.Contains(failed.Error.Error(), "bad input") {
+			t.Errorf("unexpected failed message %+v", failed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for the failed message")
+	}
+}
@@ -0,0 +1,105 @@
+package stages
+
+import (
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/registry"
+)
+
+// Port descriptors for the stages in this package
+var (
+	jqPorts = flow.Ports{
+		In:  map[string]flow.Port{"in": {Description: "values to run the filter on"}},
+		Out: map[string]flow.Port{"out": {Description: "one message per filter result"}},
+	}
+	delayPorts = flow.Ports{
+		In:  map[string]flow.Port{"in": {Description: "messages to delay"}},
+		Out: map[string]flow.Port{"out": {Description: "the same messages, after the delay"}},
+	}
+	batchPorts = flow.Ports{
+		In:  map[string]flow.Port{"in": {Description: "messages to batch"}},
+		Out: map[string]flow.Port{"out": {Description: "one message per batch, with the data of its messages as an array"}},
+	}
+	scatterPorts = flow.Ports{
+		In:  map[string]flow.Port{"in": {Description: "arrays to split"}},
+		Out: map[string]flow.Port{"out": {Description: "one message per item or chunk of items, with a share of a new token"}},
+	}
+	gatherPorts = flow.Ports{
+		In:  map[string]flow.Port{"in": {Description: "messages with shares of scattered tokens"}},
+		Out: map[string]flow.Port{"out": {Description: "one message per complete token, with the data of its messages as an array"}},
+	}
+	windowPorts = flow.Ports{
+		In:  map[string]flow.Port{"in": {Description: "messages to window"}},
+		Out: map[string]flow.Port{"out": {Description: "one message per window, with the window's key, bounds, count, and reduced result"}},
+	}
+	joinPorts = flow.Ports{
+		In: map[string]flow.Port{
+			"left":  {Description: "messages to join, such as the main stream"},
+			"right": {Description: "messages to join with the left messages, such as enrichment data"},
+		},
+		Out: map[string]flow.Port{"out": {Description: "one message per joined pair, with the data of each side"}},
+	}
+	mapPorts = flow.Ports{
+		In:  map[string]flow.Port{"in": {Description: "values to transform"}},
+		Out: map[string]flow.Port{"out": {Description: "the result for each value"}},
+	}
+	filterPorts = flow.Ports{
+		In:  map[string]flow.Port{"in": {Description: "values to filter"}},
+		Out: map[string]flow.Port{"out": {Description: "the values that pass the filter"}},
+	}
+	flatMapPorts = flow.Ports{
+		In:  map[string]flow.Port{"in": {Description: "values to expand"}},
+		Out: map[string]flow.Port{"out": {Description: "one message per result for each value"}},
+	}
+)
+
+// Registers the stage kinds in this package.
+func Register(r *registry.Registry) {
+	registry.Register(r, registry.Kind{
+		Name:        "jq",
+		Description: "Runs a jq filter on each message, emitting each result",
+		Ports:       jqPorts,
+	}, NewJQFromConfig)
+
+	registry.Register(r, registry.Kind{
+		Name:        "delay",
+		Description: "Delays each message by a fixed duration",
+		Ports:       delayPorts,
+	}, NewDelayFromConfig)
+
+	registry.Register(r, registry.Kind{
+		Name:        "batch",
+		Description: "Groups messages into batches by count, size in bytes, or wait time",
+		Ports:       batchPorts,
+	}, NewBatchFromConfig)
+
+	registry.Register(r, registry.Kind{
+		Name:        "scatter",
+		Description: "Splits arrays into messages that share a token, for gathering later",
+		Ports:       scatterPorts,
+	}, NewScatterFromConfig)
+
+	registry.Register(r, registry.Kind{
+		Name:        "gather",
+		Description: "Gathers the messages scattered from each array once all of them have arrived",
+		Ports:       gatherPorts,
+	}, NewGatherFromConfig)
+
+	registry.Register(r, registry.Kind{
+		Name:        "window",
+		Description: "Groups messages by key into tumbling, sliding, or session windows and reduces each window with a jq filter",
+		Ports:       windowPorts,
+	}, NewWindowFromConfig)
+
+	registry.Register(r, registry.Kind{
+		Name:        "join",
+		Description: "Joins the messages on two ports by key, as an inner or left outer join",
+		Ports:       joinPorts,
+	}, NewJoinFromConfig)
+}
+
+// Returns a new registry containing the stage kinds in this package.
+func NewRegistry() *registry.Registry {
+	r := registry.New()
+	Register(r)
+	return r
+}
@@ -0,0 +1,268 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"github.com/thejerf/suture/v4"
+)
+
+// Retry wraps a stage, delivering the messages it fails to process to it again
+// after an exponential backoff.
+//
+// A message is retried when the wrapped stage sends it to its error port and traces
+// its failure (see flow.Base.TraceSendError), as long as the error is retryable and
+// attempts remain. The failure is then traced as a flow.TraceRetry and the same message
+// is delivered again, so that lineage shows every attempt. Once the last attempt fails,
+// the failed message is sent on the error port with the number of attempts made.
+//
+// Retry learns the outcome of each message from the wrapped stage's trace events, so
+// the wrapped stage must have a trace channel. Retry forwards the events to its own
+// trace channel, if it has one.
+type Retry struct {
+	flow.Base
+	stage  flow.Stage
+	policy RetryPolicy
+}
+
+// Determines how often and how soon a Retry stage retries a failed message
+type RetryPolicy struct {
+	// Maximum number of attempts for each message, including the first
+	MaxAttempts int
+	// Delay before the first retry, which is multiplied by Multiplier for each
+	// later retry, up to MaxBackoff if it is positive.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Growth factor of the delay between retries. Defaults to 2 if zero.
+	Multiplier float64
+	// Fraction of each delay that is randomized, between 0 and 1. A jitter of 0.2
+	// waits for between 80% and 100% of the delay.
+	Jitter float64
+	// Reports whether a failure should be retried. If nil, every failure is retried.
+	Retryable func(err error) bool
+}
+
+// Returns a stage that retries the failed messages of the given stage, which must have
+// the same ID as the base.
+func NewRetry(base *flow.Base, stage flow.Stage, policy RetryPolicy) (*Retry, error) {
+	if base.ID() != stage.ID() {
+		return nil, fmt.Errorf("retry: base id %q differs from stage id %q", base.ID(), stage.ID())
+	}
+	if stage.Trace() == nil {
+		return nil, fmt.Errorf("retry: stage %q must have a trace channel", stage.ID())
+	}
+	if policy.Multiplier == 0 {
+		policy.Multiplier = 2
+	}
+	switch {
+	case policy.MaxAttempts < 1:
+		return nil, errors.New("retry: max attempts must be at least 1")
+	case policy.InitialBackoff < 0 || policy.MaxBackoff < 0:
+		return nil, errors.New("retry: backoff must not be negative")
+	case policy.Multiplier < 1:
+		return nil, errors.New("retry: multiplier must be at least 1")
+	case policy.Jitter < 0 || policy.Jitter > 1:
+		return nil, errors.New("retry: jitter must be between 0 and 1")
+	}
+	return &Retry{*base.WithPorts(stage.Ports()), stage, policy}, nil
+}
+
+// Saves the state of the retried stage, if it is stateful (see flow.Stateful).
+func (s *Retry) SaveState() ([]byte, error) {
+	if st, ok := s.stage.(flow.Stateful); ok {
+		return st.SaveState()
+	}
+	return nil, nil
+}
+
+// Restores the state of the retried stage, if it is stateful (see flow.Stateful).
+func (s *Retry) RestoreState(state []byte) error {
+	if st, ok := s.stage.(flow.Stateful); ok {
+		return st.RestoreState(state)
+	}
+	return errors.New("retry: the retried stage is not stateful")
+}
+
+// Returns the delay before retrying a message after the given attempt failed.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxBackoff > 0 {
+		d = min(d, float64(p.MaxBackoff))
+	}
+	d -= d * p.Jitter * rand.Float64()
+	return time.Duration(d)
+}
+
+func (p RetryPolicy) retryable(err error) bool {
+	return p.Retryable == nil || p.Retryable(err)
+}
+
+// A message delivered to the wrapped stage that has no outcome yet
+type attempt struct {
+	m     msg.MsgTo
+	n     int   // number of times the message has been delivered
+	retry error // if non-nil, the failure of the current attempt will be retried
+}
+
+// State of a running Retry stage, which is only accessed by its Serve loop
+type retryRun struct {
+	attempts map[msg.ID]*attempt
+	// Messages sent by the wrapped stage to its error port that have not been received
+	// from it yet, by ID. A nil value means the message is replaced by a retry.
+	failed  map[msg.ID]*flow.FailedMsg
+	retries chan msg.MsgTo
+	timers  map[msg.ID]*time.Timer // timers of the messages waiting to be retried, by ID
+}
+
+// Stops the timers of the messages waiting to be retried, so that they are not retried
+// once the stage has stopped.
+func (r *retryRun) stop() {
+	for _, t := range r.timers {
+		t.Stop()
+	}
+}
+
+func (s *Retry) Serve(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	errCh := make(chan error, 1)
+	go func() {
+		defer func() {
+			if pv := recover(); pv != nil {
+				errCh <- fmt.Errorf("panic: %v", pv)
+			}
+		}()
+		errCh <- s.stage.Serve(ctx)
+	}()
+
+	r := &retryRun{
+		attempts: map[msg.ID]*attempt{},
+		failed:   map[msg.ID]*flow.FailedMsg{},
+		retries:  make(chan msg.MsgTo),
+		timers:   map[msg.ID]*time.Timer{},
+	}
+	defer r.stop()
+	in, out, trace := s.Ch.In, s.stage.Out(), s.stage.Trace()
+	var queue []msg.MsgTo // messages to deliver to the wrapped stage
+	closed := false
+	for {
+		// Read more input only once the queue is empty, to preserve backpressure
+		var send chan<- msg.MsgTo
+		var next msg.MsgTo
+		recv := in
+		if len(queue) > 0 {
+			send, next, recv = s.stage.In(), queue[0], nil
+		}
+		select {
+		case send <- next:
+			queue = queue[1:]
+			r.attempts[next.ID].n++
+		case m, ok := <-recv:
+			if !ok {
+				in = nil
+				break
+			}
+			r.attempts[m.ID] = &attempt{m: m}
+			queue = append(queue, m)
+		case m := <-r.retries:
+			delete(r.timers, m.ID)
+			queue = append(queue, m)
+		case e := <-trace:
+			s.observe(ctx, r, e)
+		case m, ok := <-out:
+			// The wrapped stage traces each send before making it, so observing its
+			// pending trace events tells whether the message replaces a failure, even
+			// if its trace channel is buffered.
+			s.drainTrace(ctx, r, trace)
+			if !ok {
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			if f, ok := r.failed[m.ID]; ok {
+				delete(r.failed, m.ID)
+				if f == nil {
+					break
+				}
+				m.Data = *f
+			}
+			s.Ch.Out <- m
+		case err := <-errCh:
+			if !errors.Is(err, suture.ErrDoNotRestart) {
+				return err
+			}
+			errCh = nil // the stage is finished once it closes its output
+		case <-ctx.Done():
+			return nil
+		}
+
+		// Close the wrapped stage once input is done and no message can be retried.
+		if in == nil && !closed && len(queue) == 0 && len(r.attempts) == 0 {
+			close(s.stage.In())
+			closed = true
+		}
+	}
+}
+
+// Observes the trace events that the wrapped stage has sent without blocking.
+func (s *Retry) drainTrace(ctx context.Context, r *retryRun, trace <-chan flow.TraceEvent) {
+	for {
+		select {
+		case e := <-trace:
+			s.observe(ctx, r, e)
+		default:
+			return
+		}
+	}
+}
+
+// Updates the state of the stage from a trace event of the wrapped stage, and
+// forwards the event unless it is replaced by a retry.
+func (s *Retry) observe(ctx context.Context, r *retryRun, e flow.TraceEvent) {
+	switch ev := e.(type) {
+	case flow.TraceSendFrom:
+		f, ok := ev.Msg.Data.(flow.FailedMsg)
+		a := r.attempts[ev.ParentID]
+		if ev.Port != flow.ErrorPort || !ok || a == nil {
+			break
+		}
+		if a.n < s.policy.MaxAttempts && s.policy.retryable(f.Error) {
+			a.retry = f.Error
+			r.failed[ev.Msg.ID] = nil
+			return
+		}
+		f.Attempt = a.n
+		ev.Msg.Data = f
+		r.failed[ev.Msg.ID] = &f
+		e = ev
+	case flow.TraceFailure:
+		a := r.attempts[ev.ID]
+		if a == nil {
+			break
+		}
+		if a.retry == nil {
+			delete(r.attempts, ev.ID)
+			break
+		}
+		delay := s.policy.backoff(a.n)
+		e = flow.TraceRetry{Time: ev.Time, ID: ev.ID, Attempt: a.n, Error: a.retry, Delay: delay}
+		a.retry = nil
+		m := a.m
+		r.timers[ev.ID] = time.AfterFunc(delay, func() {
+			select {
+			case r.retries <- m:
+			case <-ctx.Done():
+			}
+		})
+	case flow.TraceSuccess:
+		delete(r.attempts, ev.ID)
+	}
+	if s.Ch.Trace != nil {
+		s.Ch.Trace <- e
+	}
+}
@@ -0,0 +1,154 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"github.com/thejerf/suture/v4"
+)
+
+var errFlaky = errors.New("flaky")
+
+// A test stage that fails each message until it has been delivered more than the given
+// number of times, with channels of the given size
+type flaky struct {
+	flow.Base
+	failures int
+	seen     map[msg.ID]int
+}
+
+func newFlaky(failures, buffer int) *flaky {
+	ports := flow.Ports{In: map[string]flow.Port{"in": {}}, Out: map[string]flow.Port{"out": {}}}
+	return &flaky{*flow.NewBase("s").WithInOut(buffer).WithTrace(buffer).WithPorts(ports), failures, map[msg.ID]int{}}
+}
+
+func (s *flaky) Serve(ctx context.Context) error {
+	for {
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceRecv(m.ID)
+			if s.seen[m.ID]++; s.seen[m.ID] <= s.failures {
+				s.TraceSendError(m.Msg, errFlaky, 1)
+			} else {
+				s.TraceSend("out", m.Msg, m.Data)
+				s.TraceSuccess(m.ID)
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Sends a message through a Retry stage and returns its outputs and trace events.
+func retry(t *testing.T, failures int, policy RetryPolicy) ([]msg.MsgFrom, []flow.TraceEvent) {
+	t.Helper()
+	return retryBuffered(t, failures, 0, policy)
+}
+
+// Like retry, with channels of the given size for the wrapped stage.
+func retryBuffered(t *testing.T, failures, buffer int, policy RetryPolicy) ([]msg.MsgFrom, []flow.TraceEvent) {
+	t.Helper()
+	s, err := NewRetry(flow.NewBase("s").WithInOut(0).WithTrace(100), newFlaky(failures, buffer), policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(t.Context())
+	s.In() <- msg.New("x").To(msg.NewAddr("s", "in"))
+	close(s.In())
+
+	var outs []msg.MsgFrom
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case m, ok := <-s.Out():
+			if !ok {
+				done = true
+				break
+			}
+			outs = append(outs, m)
+		case <-timeout:
+			t.Fatal("timeout waiting for the stage to close")
+		}
+	}
+	var events []flow.TraceEvent
+	for len(s.Trace()) > 0 {
+		events = append(events, <-s.Trace())
+	}
+	return outs, events
+}
+
+// Returns the attempts of the traced retries and the number of traced failures
+func retriesAndFailures(events []flow.TraceEvent) (retries []int, failures int) {
+	for _, e := range events {
+		switch e := e.(type) {
+		case flow.TraceRetry:
+			retries = append(retries, e.Attempt)
+		case flow.TraceFailure:
+			failures++
+		}
+	}
+	return retries, failures
+}
+
+func TestRetrySucceedsAfterFailures(t *testing.T) {
+	outs, events := retry(t, 2, RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Jitter: 0.5})
+	if len(outs) != 1 || outs[0].Port != "out" || outs[0].Data != "x" {
+		t.Errorf("unexpected outputs %+v", outs)
+	}
+	retries, failures := retriesAndFailures(events)
+	if len(retries) != 2 || retries[0] != 1 || retries[1] != 2 || failures != 0 {
+		t.Errorf("got retries %v and %d failures, want retries [1 2] and no failures", retries, failures)
+	}
+}
+
+func TestRetrySendsLastFailureToErrorPort(t *testing.T) {
+	outs, events := retry(t, 5, RetryPolicy{MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	if len(outs) != 1 || outs[0].Port != flow.ErrorPort {
+		t.Fatalf("unexpected outputs %+v", outs)
+	}
+	if f := outs[0].Data.(flow.FailedMsg); f.Attempt != 2 || f.Stage != "s" || !errors.Is(f.Error, errFlaky) {
+		t.Errorf("unexpected failed message %+v", f)
+	}
+	retries, failures := retriesAndFailures(events)
+	if len(retries) != 1 || failures != 1 {
+		t.Errorf("got retries %v and %d failures, want one of each", retries, failures)
+	}
+}
+
+func TestRetryWithBufferedTrace(t *testing.T) {
+	// The wrapped stage's error messages may be received before the trace events that
+	// show they are retried, so run it enough times to be likely to see that order.
+	for range 100 {
+		outs, _ := retryBuffered(t, 1, 10, RetryPolicy{MaxAttempts: 2})
+		if len(outs) != 1 || outs[0].Port != "out" {
+			t.Fatalf("got outputs %+v, want only the successful retry", outs)
+		}
+	}
+}
+
+func TestRetrySkipsNonRetryableErrors(t *testing.T) {
+	outs, events := retry(t, 5, RetryPolicy{MaxAttempts: 3, Retryable: func(err error) bool { return false }})
+	if len(outs) != 1 || outs[0].Port != flow.ErrorPort || outs[0].Data.(flow.FailedMsg).Attempt != 1 {
+		t.Errorf("unexpected outputs %+v", outs)
+	}
+	if retries, failures := retriesAndFailures(events); len(retries) != 0 || failures != 1 {
+		t.Errorf("got retries %v and %d failures, want a single failure", retries, failures)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 50 * time.Millisecond, Multiplier: 2}
+	for attempt, want := range []time.Duration{10, 20, 40, 50, 50} {
+		if got := p.backoff(attempt + 1); got != want*time.Millisecond {
+			t.Errorf("attempt %d: got backoff %v, want %v", attempt+1, got, want*time.Millisecond)
+		}
+	}
+}
@@ -0,0 +1,370 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"datapotamus.com/internal/common"
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/token"
+	"datapotamus.com/internal/validator"
+	"github.com/thejerf/suture/v4"
+)
+
+// Scatter and Gather implement the scatter/gather design described in the token package.
+//
+// Scatter splits the array in each message into one message per item, or per chunk of
+// items, and gives each a share of a new token whose shares merge to zero. Gather buffers
+// the messages that carry tokens of the same name, grouped by token, and sends each group
+// once the shares it has received merge to zero, meaning that every part has arrived.
+//
+// Completion messages, which are marked by MarkCompletion, contribute their token shares
+// to a group but no item, which supports groups of unknown size: a stage can send items
+// with a random "starter" share mixed into their tokens, followed by a completion message
+// that carries the merged starters, so that the group only completes once the completion
+// arrives. Items are gathered whatever their data, including null. Since shares are
+// merged by XOR, stages between a Scatter and a Gather must not send more than one
+// message with the same shares, which would cancel out.
+
+// Scatter splits arrays into messages that share a new token (see above).
+type Scatter struct {
+	flow.Base
+	name string
+	size int
+}
+
+// Returns a Scatter stage that sends each item of an array in its own message if size is
+// one, and otherwise chunks of up to size items as arrays. Tokens are named by prefixing
+// their IDs with the name, which identifies them to Gather stages with the same name.
+func NewScatter(base *flow.Base, name string, size int) (*Scatter, error) {
+	if err := checkTokenName(name); err != nil {
+		return nil, fmt.Errorf("scatter: %w", err)
+	}
+	if size < 1 {
+		return nil, errors.New("scatter: size must be at least 1")
+	}
+	return &Scatter{*base.WithPorts(scatterPorts), name, size}, nil
+}
+
+func checkTokenName(name string) error {
+	if name == "" || strings.Contains(name, tokenSep) {
+		return fmt.Errorf("token name must be non-empty and must not contain %q", tokenSep)
+	}
+	return nil
+}
+
+// Separates the name of a scattered token from its unique part
+const tokenSep = ":"
+
+// Suffix of the token ID that marks a completion message for the token with the ID
+const completionSuffix = tokenSep + "complete"
+
+// Returns the message marked as a completion message for the scattered token with the
+// given ID, so that Gather adds its token shares to the token's group but not its data.
+// Stages send completion messages with the shares that complete a group of unknown size
+// (see Scatter). The mark is a token of its own, so the children of the message inherit it.
+func MarkCompletion(m msg.Msg, tokenID string) msg.Msg {
+	return m.MergeTokens(token.Tokens{tokenID + completionSuffix: token.Zero()})
+}
+
+// Declarative configuration for the scatter stage
+type ScatterConfig struct {
+	Token string `json:"token"`
+	Size  int    `json:"size,omitempty"` // defaults to 1
+}
+
+func (c ScatterConfig) Validate(v *validator.Validator) {
+	v.CheckField(validator.NotBlank(c.Token), "token", "must not be blank")
+	v.CheckField(!strings.Contains(c.Token, tokenSep), "token", fmt.Sprintf("must not contain %q", tokenSep))
+	v.CheckField(c.Size >= 0, "size", "must not be negative")
+}
+
+func NewScatterFromConfig(base *flow.Base, cfg ScatterConfig) (*Scatter, error) {
+	return NewScatter(base, cfg.Token, max(cfg.Size, 1))
+}
+
+func (s *Scatter) Serve(ctx context.Context) error {
+	for {
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				// Input is done, so the stage is finished and should not be restarted.
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceRecv(m.ID)
+			items, ok := m.Data.([]any)
+			if !ok {
+				s.TraceSendError(m.Msg, fmt.Errorf("scatter: data is %T, want an array", m.Data), 1)
+				continue
+			}
+			s.scatter(m.Msg, items)
+			s.TraceSuccess(m.ID)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Sends the items in parts, splitting a new token and each of the message's tokens among
+// them, so that the message's tokens are restored once the parts are gathered. An empty
+// array is sent as a single completion message with nil data, which gathers to an empty
+// array.
+func (s *Scatter) scatter(m msg.Msg, items []any) {
+	var parts []any
+	if s.size == 1 {
+		parts = items
+	} else {
+		for chunk := range slices.Chunk(items, s.size) {
+			parts = append(parts, chunk)
+		}
+	}
+	if len(parts) == 0 {
+		parts = []any{nil}
+	}
+
+	id := s.name + tokenSep + common.NewID()
+	shares := map[string][]token.Value{id: token.Zero().Split(len(parts))}
+	for id, v := range m.Tokens {
+		shares[id] = v.Split(len(parts))
+	}
+	for i, part := range parts {
+		// Children take their tokens from the parent, so each part gets its own shares
+		parent := m
+		parent.Tokens = token.Tokens{}
+		for id, vs := range shares {
+			parent.Tokens[id] = vs[i]
+		}
+		if len(items) == 0 {
+			parent = MarkCompletion(parent, id)
+		}
+		s.TraceSend("out", parent, part)
+	}
+}
+
+// Gather collects the messages that carry tokens of a given name and sends each group
+// once its token is complete (see Scatter).
+//
+// A group is sent as a single message whose data is the array of the data of its
+// messages, in the order they arrived, and which is merged from those messages (see
+// flow.Base.TraceSendMerged). A message that carries several tokens of the name is
+// included in each of their groups, and succeeds once the last of them is sent.
+//
+// Messages held in incomplete groups are in flight, so a flow only drains or checkpoints
+// once their groups are sent, and the groups are lost if the stage stops first. A group
+// that is not complete within the stage's timeout (see WithTimeout), or when its input
+// closes, is sent on the error port instead, since a message scattered into it may have
+// been filtered or dropped and will never arrive. Its data is a flow.FailedMsg whose
+// message holds the items gathered so far and whose error wraps ErrIncompleteGroup.
+type Gather struct {
+	flow.Base
+	name    string
+	timeout time.Duration
+}
+
+// The error with which Gather fails the groups that it gives up on
+var ErrIncompleteGroup = errors.New("gather: group is incomplete")
+
+func NewGather(base *flow.Base, name string) (*Gather, error) {
+	if err := checkTokenName(name); err != nil {
+		return nil, fmt.Errorf("gather: %w", err)
+	}
+	return &Gather{*base.WithPorts(gatherPorts), name, 0}, nil
+}
+
+// Sets how long after its first message a group may stay incomplete before it is sent on
+// the error port. A timeout of zero, the default, lets groups wait indefinitely.
+func (s *Gather) WithTimeout(d time.Duration) *Gather {
+	s.timeout = max(d, 0)
+	return s
+}
+
+// Declarative configuration for the gather stage
+type GatherConfig struct {
+	Token         string `json:"token"`
+	TimeoutMillis int64  `json:"timeoutMillis,omitempty"`
+}
+
+func (c GatherConfig) Validate(v *validator.Validator) {
+	v.CheckField(validator.NotBlank(c.Token), "token", "must not be blank")
+	v.CheckField(!strings.Contains(c.Token, tokenSep), "token", fmt.Sprintf("must not contain %q", tokenSep))
+	v.CheckField(c.TimeoutMillis >= 0, "timeoutMillis", "must not be negative")
+}
+
+func NewGatherFromConfig(base *flow.Base, cfg GatherConfig) (*Gather, error) {
+	g, err := NewGather(base, cfg.Token)
+	if err != nil {
+		return nil, err
+	}
+	return g.WithTimeout(time.Duration(cfg.TimeoutMillis) * time.Millisecond), nil
+}
+
+// A group of messages being gathered
+type group struct {
+	id    string      // ID of the group's token
+	value token.Value // merged shares received so far
+	msgs  []msg.Msg
+	items []any
+	at    time.Time // when the group's first message was received
+}
+
+// State of a running Gather stage
+type gatherRun struct {
+	groups  map[string]*group // by token ID
+	pending map[msg.ID]int    // number of incomplete groups each message is in
+	timer   *time.Timer       // set while groups are open with a timeout
+}
+
+func (s *Gather) Serve(ctx context.Context) error {
+	r := &gatherRun{groups: map[string]*group{}, pending: map[msg.ID]int{}}
+	defer func() {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+	}()
+	for {
+		var timeout <-chan time.Time
+		if r.timer != nil {
+			timeout = r.timer.C
+		}
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				// Input is done, so the open groups will never complete.
+				for _, g := range openGroups(r) {
+					s.fail(r, g, fmt.Errorf("%w: input closed", ErrIncompleteGroup))
+				}
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceRecv(m.ID)
+			s.gather(r, m.Msg)
+		case now := <-timeout:
+			r.timer = nil
+			for _, g := range openGroups(r) {
+				if !now.Before(g.at.Add(s.timeout)) {
+					s.fail(r, g, fmt.Errorf("%w after %v", ErrIncompleteGroup, s.timeout))
+				}
+			}
+			s.schedule(r)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Returns the open groups, oldest first.
+func openGroups(r *gatherRun) []*group {
+	groups := slices.Collect(maps.Values(r.groups))
+	slices.SortFunc(groups, func(a, b *group) int { return a.at.Compare(b.at) })
+	return groups
+}
+
+// Sets a timer for when the oldest open group times out, if there is a timeout.
+func (s *Gather) schedule(r *gatherRun) {
+	if s.timeout <= 0 {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	if groups := openGroups(r); len(groups) > 0 {
+		r.timer = time.NewTimer(time.Until(groups[0].at.Add(s.timeout)))
+	}
+}
+
+// Returns whether the token ID is for a token with the stage's name, rather than
+// a completion mark or a token of another name.
+func (s *Gather) gathers(id string) bool {
+	rest, ok := strings.CutPrefix(id, s.name+tokenSep)
+	return ok && !strings.Contains(rest, tokenSep)
+}
+
+// Adds the message to the groups of its tokens, sending the groups that are complete.
+func (s *Gather) gather(r *gatherRun, m msg.Msg) {
+	var ids []string
+	for _, id := range slices.Sorted(maps.Keys(m.Tokens)) {
+		if s.gathers(id) {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		s.TraceSendError(m, fmt.Errorf("gather: message has no %q token", s.name), 1)
+		return
+	}
+
+	var complete []*group
+	opened := false
+	for _, id := range ids {
+		g := r.groups[id]
+		if g == nil {
+			g = &group{id: id, at: time.Now()}
+			r.groups[id] = g
+			opened = true
+		}
+		g.value = g.value.Merge(m.Tokens[id])
+		g.msgs = append(g.msgs, m)
+		if _, ok := m.Tokens[id+completionSuffix]; !ok {
+			g.items = append(g.items, m.Data)
+		}
+		if g.value.IsZero() {
+			complete = append(complete, g)
+		}
+	}
+	r.pending[m.ID] = len(ids)
+
+	for _, g := range complete {
+		s.remove(r, g)
+		s.TraceSendMerged("out", s.parents(g), g.items)
+		s.succeed(r, g)
+	}
+	if opened && r.timer == nil {
+		s.schedule(r)
+	}
+}
+
+// Sends an incomplete group on the error port.
+func (s *Gather) fail(r *gatherRun, g *group, err error) {
+	s.remove(r, g)
+	failed := msg.Msg{Data: g.items}
+	s.TraceSendMerged(flow.ErrorPort, s.parents(g), flow.FailedMsg{Msg: failed, Error: err, Stage: s.ID(), Attempt: 1})
+	s.succeed(r, g)
+}
+
+// Removes a group that is about to be sent.
+func (s *Gather) remove(r *gatherRun, g *group) {
+	delete(r.groups, g.id)
+	if g.items == nil {
+		g.items = []any{}
+	}
+}
+
+// Succeeds the messages of a sent group that are in no other open group.
+func (s *Gather) succeed(r *gatherRun, g *group) {
+	for _, gm := range g.msgs {
+		if r.pending[gm.ID]--; r.pending[gm.ID] == 0 {
+			delete(r.pending, gm.ID)
+			s.TraceSuccess(gm.ID)
+		}
+	}
+}
+
+// Returns the parents of the message sent for a group. The gathered tokens and their
+// completion marks are left out of their tokens, so that the message carries only the
+// shares of the tokens scattered before them.
+func (s *Gather) parents(g *group) []msg.Msg {
+	parents := make([]msg.Msg, len(g.msgs))
+	for i, m := range g.msgs {
+		m.Tokens = maps.Clone(m.Tokens)
+		maps.DeleteFunc(m.Tokens, func(id string, _ token.Value) bool { return strings.HasPrefix(id, s.name+tokenSep) })
+		parents[i] = m
+	}
+	return parents
+}
@@ -0,0 +1,251 @@
+package stages
+
+import (
+	"errors"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/flow/token"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Sends the messages through a Scatter stage connected to a Gather stage and returns the
+// gathered outputs.
+func scatterGather(t *testing.T, size int, msgs ...msg.Msg) []msg.MsgFrom {
+	t.Helper()
+	sc, err := NewScatter(flow.NewBase("s").WithInOut(0), "t", size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := NewGather(flow.NewBase("g").WithInOut(0), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sc.Serve(t.Context())
+	go g.Serve(t.Context())
+	go func() {
+		for _, m := range msgs {
+			sc.In() <- m.To(msg.NewAddr("s", "in"))
+		}
+		close(sc.In())
+	}()
+	go func() {
+		for m := range sc.Out() {
+			g.In() <- m.Msg.To(msg.NewAddr("g", "in"))
+		}
+		close(g.In())
+	}()
+	return collect(t, g.Out())
+}
+
+// Returns the messages sent on the channel until it is closed.
+func collect(t *testing.T, out <-chan msg.MsgFrom) []msg.MsgFrom {
+	t.Helper()
+	var outs []msg.MsgFrom
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case m, ok := <-out:
+			if !ok {
+				return outs
+			}
+			outs = append(outs, m)
+		case <-timeout:
+			t.Fatal("timeout waiting for the stage to close its output")
+		}
+	}
+}
+
+func TestScatterGather(t *testing.T) {
+	tests := []struct {
+		name string
+		size int
+		data []any
+		want []any
+	}{
+		{"items", 1, []any{1, 2, 3}, []any{1, 2, 3}},
+		{"chunks", 2, []any{1, 2, 3}, []any{[]any{1, 2}, []any{3}}},
+		{"empty", 1, []any{}, []any{}},
+		{"null items", 1, []any{1, nil, 2}, []any{1, nil, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outs := scatterGather(t, tt.size, msg.New(tt.data))
+			if len(outs) != 1 {
+				t.Fatalf("got %d outputs, want 1", len(outs))
+			}
+			if diff := cmp.Diff(tt.want, outs[0].Data); diff != "" {
+				t.Errorf("unexpected gathered data (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestScatterGatherRestoresTokens(t *testing.T) {
+	m := msg.New([]any{"a", "b", "c"}).MergeTokens(token.Tokens{"outer": 42})
+	outs := scatterGather(t, 1, m, msg.New([]any{"d"}))
+	if len(outs) != 2 {
+		t.Fatalf("got %d outputs, want 2", len(outs))
+	}
+	if diff := cmp.Diff(token.Tokens{"outer": 42}, outs[0].Tokens); diff != "" {
+		t.Errorf("unexpected tokens after gathering (-want +got):\n%s", diff)
+	}
+	if len(outs[1].Tokens) != 0 {
+		t.Errorf("got tokens %v after gathering a message without tokens, want none", outs[1].Tokens)
+	}
+}
+
+func TestGatherStarterAndCompletion(t *testing.T) {
+	g, err := NewGather(flow.NewBase("g").WithInOut(0).WithTrace(20), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(t.Context())
+
+	// Items of a group of unknown size each mix in a starter, and the completion message
+	// cancels out the starters once the items have been sent.
+	a, b := token.Rand(), token.Rand()
+	msgs := []msg.Msg{
+		msg.New("a").MergeTokens(token.Tokens{"t:1": a}),
+		msg.New(nil).MergeTokens(token.Tokens{"t:1": b}),
+		MarkCompletion(msg.New(nil).MergeTokens(token.Tokens{"t:1": a.Merge(b)}), "t:1"),
+	}
+	go func() {
+		for _, m := range msgs {
+			g.In() <- m.To(msg.NewAddr("g", "in"))
+		}
+		close(g.In())
+	}()
+	outs := collect(t, g.Out())
+	if len(outs) != 1 {
+		t.Fatalf("got %d outputs, want 1", len(outs))
+	}
+	if diff := cmp.Diff([]any{"a", nil}, outs[0].Data); diff != "" {
+		t.Errorf("unexpected gathered data (-want +got):\n%s", diff)
+	}
+	if len(outs[0].Tokens) != 0 {
+		t.Errorf("got tokens %v after gathering, want none", outs[0].Tokens)
+	}
+
+	succeeded := map[msg.ID]bool{}
+	for len(succeeded) < len(msgs) {
+		if e, ok := (<-g.Trace()).(flow.TraceSuccess); ok {
+			succeeded[e.ID] = true
+		}
+	}
+	for _, m := range msgs {
+		if !succeeded[m.ID] {
+			t.Errorf("message %v did not succeed", m.ID)
+		}
+	}
+}
+
+func TestScatterGatherErrors(t *testing.T) {
+	sc, err := NewScatter(flow.NewBase("s").WithInOut(0), "t", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go sc.Serve(t.Context())
+	sc.In() <- msg.New("x").To(msg.NewAddr("s", "in"))
+	if m := <-sc.Out(); m.Port != flow.ErrorPort {
+		t.Errorf("got %v from scatter, want a message on the error port", m)
+	}
+
+	g, err := NewGather(flow.NewBase("g").WithInOut(0), "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go g.Serve(t.Context())
+	g.In() <- msg.New("x").MergeTokens(token.Tokens{"other:1": 1}).To(msg.NewAddr("g", "in"))
+	if m := <-g.Out(); m.Port != flow.ErrorPort {
+		t.Errorf("got %v from gather, want a message on the error port", m)
+	}
+
+	if _, err := NewScatter(flow.NewBase("s"), "a:b", 1); err == nil {
+		t.Error("got no error for a token name containing a colon")
+	}
+}
+
+func TestGatherFailsIncompleteGroups(t *testing.T) {
+	// Scatters [1, 2, 3] and drops the second item on its way to the gather stage
+	scattered := func(t *testing.T) []msg.Msg {
+		t.Helper()
+		sc, err := NewScatter(flow.NewBase("s").WithInOut(0), "t", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go sc.Serve(t.Context())
+		go func() {
+			sc.In() <- msg.New([]any{1, 2, 3}).To(msg.NewAddr("s", "in"))
+			close(sc.In())
+		}()
+		var msgs []msg.Msg
+		for _, m := range collect(t, sc.Out()) {
+			if m.Data != 2 {
+				msgs = append(msgs, m.Msg)
+			}
+		}
+		return msgs
+	}
+	checkFailed := func(t *testing.T, m msg.MsgFrom) {
+		t.Helper()
+		failed, ok := m.Data.(flow.FailedMsg)
+		if m.Port != flow.ErrorPort || !ok || !errors.Is(failed.Error, ErrIncompleteGroup) {
+			t.Fatalf("got %v on port %q, want an incomplete group on the error port", m.Data, m.Port)
+		}
+		if diff := cmp.Diff([]any{1, 3}, failed.Msg.Data); diff != "" {
+			t.Errorf("unexpected partial group (-want +got):\n%s", diff)
+		}
+	}
+
+	t.Run("timeout", func(t *testing.T) {
+		synctest.Test(t, func(t *testing.T) {
+			msgs := scattered(t)
+			g, err := NewGather(flow.NewBase("g").WithInOut(0).WithTrace(20), "t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			g.WithTimeout(time.Second)
+			go g.Serve(t.Context())
+			start := time.Now()
+			for _, m := range msgs {
+				g.In() <- m.To(msg.NewAddr("g", "in"))
+			}
+			checkFailed(t, <-g.Out())
+			if elapsed := time.Since(start); elapsed != time.Second {
+				t.Errorf("got the incomplete group after %v, want 1s", elapsed)
+			}
+
+			// The gathered messages succeed, so that they are no longer in flight
+			succeeded := map[msg.ID]bool{}
+			for len(succeeded) < len(msgs) {
+				if e, ok := (<-g.Trace()).(flow.TraceSuccess); ok {
+					succeeded[e.ID] = true
+				}
+			}
+		})
+	})
+
+	t.Run("input closed", func(t *testing.T) {
+		msgs := scattered(t)
+		g, err := NewGather(flow.NewBase("g").WithInOut(0), "t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go g.Serve(t.Context())
+		go func() {
+			for _, m := range msgs {
+				g.In() <- m.To(msg.NewAddr("g", "in"))
+			}
+			close(g.In())
+		}()
+		outs := collect(t, g.Out())
+		if len(outs) != 1 {
+			t.Fatalf("got %d outputs, want 1", len(outs))
+		}
+		checkFailed(t, outs[0])
+	})
+}
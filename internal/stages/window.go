@@ -0,0 +1,432 @@
+package stages
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"datapotamus.com/internal/validator"
+	"github.com/itchyny/gojq"
+	"github.com/thejerf/suture/v4"
+)
+
+// Window groups messages by key into windows of time and sends the reduction of each
+// window once it closes. Each message is windowed by the time it is received, or by an
+// event time taken from its data, and a window closes once the stage's clock passes its
+// end: the current time for processing time, or the latest event time received for
+// event time. Windows that are open when the input closes are sent then.
+//
+// A window is sent as a single message merged from the window's messages (see
+// flow.Base.TraceSendMerged), whose data is an object with the window's "key", "start"
+// and "end" times in RFC 3339 format, "count" of messages, and the reducer's "result".
+// A message in several sliding windows is merged into each of them, along with its
+// tokens. A message succeeds once each window it is in has been sent, and is sent to the
+// error port if the reducer fails for any of them, or if it arrives after all of its
+// windows have closed.
+//
+// Messages held in open windows are in flight, so a flow only drains or checkpoints once
+// their windows close, which with event time requires later messages to arrive, and the
+// windows are lost if the stage stops first.
+type Window struct {
+	flow.Base
+	spec      WindowSpec
+	key       *gojq.Code // nil if all messages share a key
+	eventTime *gojq.Code // nil for processing time
+	reduce    Reducer
+}
+
+// The kinds of windows a Window stage can group messages into
+type WindowType string
+
+const (
+	// Consecutive windows of a fixed size
+	TumblingWindows WindowType = "tumbling"
+	// Windows of a fixed size that start at a fixed interval, and may overlap
+	SlidingWindows WindowType = "sliding"
+	// Windows that last from a key's first message until a gap with no messages
+	SessionWindows WindowType = "session"
+)
+
+// Determines how a Window stage groups messages into windows.
+type WindowSpec struct {
+	Type WindowType
+	// The length of tumbling and sliding windows
+	Size time.Duration
+	// The interval between the starts of sliding windows, which is at most their size
+	Slide time.Duration
+	// How long a session window lasts after its last message
+	Gap time.Duration
+	// If set, a jq filter whose first result on a message's data is its key, as with
+	// JQPartition. Messages with different keys are windowed separately.
+	Key string
+	// If set, a jq filter whose first result on a message's data is its event time, as
+	// seconds since the Unix epoch or an RFC 3339 string. If not, messages are windowed by
+	// the time they are received.
+	EventTime string
+}
+
+// Reduces the data of the messages in a window, in the order they were received.
+type Reducer func(ctx context.Context, items []any) (any, error)
+
+// Returns a reducer whose result is the first result of a jq filter run on the array of
+// the window's data, such as `map(.duration) | add`.
+func JQReducer(filter string, timeout time.Duration) (Reducer, error) {
+	code, err := compileJQ(filter)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		return nil, errors.New("jq: timeout should be greater than zero")
+	}
+	q := &JQ{code: code, timeout: timeout}
+	return func(ctx context.Context, items []any) (any, error) {
+		results, err := q.Query(ctx, items)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) == 0 {
+			return nil, fmt.Errorf("jq: reduction %q produced no result", filter)
+		}
+		return results[0], nil
+	}, nil
+}
+
+func NewWindow(base *flow.Base, spec WindowSpec, reduce Reducer) (*Window, error) {
+	switch spec.Type {
+	case TumblingWindows:
+		if spec.Size <= 0 {
+			return nil, errors.New("window: tumbling windows need a positive size")
+		}
+	case SlidingWindows:
+		if spec.Size <= 0 || spec.Slide <= 0 || spec.Slide > spec.Size {
+			return nil, errors.New("window: sliding windows need a positive size and a positive slide no longer than the size")
+		}
+	case SessionWindows:
+		if spec.Gap <= 0 {
+			return nil, errors.New("window: session windows need a positive gap")
+		}
+	default:
+		return nil, fmt.Errorf("window: unknown window type %q", spec.Type)
+	}
+	if reduce == nil {
+		return nil, errors.New("window: a reducer is required")
+	}
+	s := &Window{Base: *base.WithPorts(windowPorts), spec: spec, reduce: reduce}
+	var err error
+	if spec.Key != "" {
+		if s.key, err = compileJQ(spec.Key); err != nil {
+			return nil, fmt.Errorf("window: key: %w", err)
+		}
+	}
+	if spec.EventTime != "" {
+		if s.eventTime, err = compileJQ(spec.EventTime); err != nil {
+			return nil, fmt.Errorf("window: event time: %w", err)
+		}
+	}
+	return s, nil
+}
+
+// Declarative configuration for the window stage
+type WindowConfig struct {
+	Type          string `json:"type"`
+	SizeMillis    int64  `json:"sizeMillis,omitempty"`
+	SlideMillis   int64  `json:"slideMillis,omitempty"`
+	GapMillis     int64  `json:"gapMillis,omitempty"`
+	Key           string `json:"key,omitempty"`
+	EventTime     string `json:"eventTime,omitempty"`
+	Reduce        string `json:"reduce"`
+	TimeoutMillis int64  `json:"timeoutMillis"`
+}
+
+func (c WindowConfig) Validate(v *validator.Validator) {
+	types := []string{string(TumblingWindows), string(SlidingWindows), string(SessionWindows)}
+	v.CheckField(validator.In(c.Type, types...), "type", "must be one of tumbling, sliding, and session")
+	v.CheckField(c.Type == string(SessionWindows) || c.SizeMillis > 0, "sizeMillis", "must be greater than zero")
+	v.CheckField(c.Type != string(SlidingWindows) || c.SlideMillis > 0, "slideMillis", "must be greater than zero")
+	v.CheckField(c.SlideMillis <= c.SizeMillis, "slideMillis", "must not be greater than sizeMillis")
+	v.CheckField(c.Type != string(SessionWindows) || c.GapMillis > 0, "gapMillis", "must be greater than zero")
+	v.CheckField(validator.NotBlank(c.Reduce), "reduce", "must not be blank")
+	v.CheckField(c.TimeoutMillis > 0, "timeoutMillis", "must be greater than zero")
+}
+
+func NewWindowFromConfig(base *flow.Base, cfg WindowConfig) (*Window, error) {
+	reduce, err := JQReducer(cfg.Reduce, time.Duration(cfg.TimeoutMillis)*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	return NewWindow(base, WindowSpec{
+		Type:      WindowType(cfg.Type),
+		Size:      time.Duration(cfg.SizeMillis) * time.Millisecond,
+		Slide:     time.Duration(cfg.SlideMillis) * time.Millisecond,
+		Gap:       time.Duration(cfg.GapMillis) * time.Millisecond,
+		Key:       cfg.Key,
+		EventTime: cfg.EventTime,
+	}, reduce)
+}
+
+// An open window
+type window struct {
+	key        string
+	start, end time.Time
+	msgs       []msg.Msg
+}
+
+// State of a running Window stage
+type windowRun struct {
+	open     map[string][]*window // by key
+	clock    time.Time            // windows that end by this time are closed
+	pending  map[msg.ID]*windowed
+	received int         // number of messages received, for ordering them
+	timer    *time.Timer // set while windows are open with processing time
+}
+
+// A message in open windows
+type windowed struct {
+	seq     int   // order in which the message was received
+	windows int   // number of open windows the message is in
+	err     error // set if the reducer failed for one of the message's windows
+}
+
+func (s *Window) Serve(ctx context.Context) error {
+	r := &windowRun{open: map[string][]*window{}, pending: map[msg.ID]*windowed{}}
+	defer func() {
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+	}()
+	for {
+		var timeout <-chan time.Time
+		if r.timer != nil {
+			timeout = r.timer.C
+		}
+		select {
+		case m, ok := <-s.Ch.In:
+			if !ok {
+				// Input is done, so send the open windows and finish.
+				s.send(ctx, r, s.closeWindows(r, func(*window) bool { return true }))
+				close(s.Ch.Out)
+				return suture.ErrDoNotRestart
+			}
+			s.TraceRecv(m.ID)
+			s.add(ctx, r, m.Msg)
+		case <-timeout:
+			r.timer = nil
+			s.advance(ctx, r, time.Now())
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// Adds a message to its windows and sends the windows that close.
+func (s *Window) add(ctx context.Context, r *windowRun, m msg.Msg) {
+	key, t, err := s.keyAndTime(m.Data)
+	if err != nil {
+		s.TraceSendError(m, err, 1)
+		return
+	}
+	ws := s.windowsFor(r, key, t)
+	if len(ws) == 0 {
+		s.TraceSendError(m, fmt.Errorf("window: message at %v arrived after its windows closed", t.UTC().Format(time.RFC3339Nano)), 1)
+		return
+	}
+	for _, w := range ws {
+		w.msgs = append(w.msgs, m)
+	}
+	r.received++
+	r.pending[m.ID] = &windowed{seq: r.received, windows: len(ws)}
+	s.advance(ctx, r, t)
+}
+
+// Returns the key and the time of a message's data.
+func (s *Window) keyAndTime(data any) (key string, t time.Time, err error) {
+	if s.key != nil {
+		if key, err = jqKey(s.key, s.spec.Key, data); err != nil {
+			return "", t, fmt.Errorf("window: key: %w", err)
+		}
+	}
+	if s.eventTime == nil {
+		return key, time.Now(), nil
+	}
+	result, ok := s.eventTime.Run(data).Next()
+	if !ok {
+		return "", t, fmt.Errorf("window: event time filter %q produced no result", s.spec.EventTime)
+	}
+	switch v := result.(type) {
+	case error:
+		return "", t, fmt.Errorf("window: event time: %w", v)
+	case int:
+		return key, time.Unix(int64(v), 0), nil
+	case float64:
+		sec, frac := math.Modf(v)
+		return key, time.Unix(int64(sec), int64(frac*1e9)), nil
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return "", t, fmt.Errorf("window: event time: %w", err)
+		}
+		return key, t, nil
+	default:
+		return "", t, fmt.Errorf("window: event time is %T, want a number or a string", v)
+	}
+}
+
+// Returns the open windows of the key that a message at time t belongs to, opening and
+// merging windows as needed. Returns none if the message's windows have closed.
+func (s *Window) windowsFor(r *windowRun, key string, t time.Time) []*window {
+	if s.spec.Type == SessionWindows {
+		w := &window{key: key, start: t, end: t.Add(s.spec.Gap)}
+		if !w.end.After(r.clock) {
+			return nil
+		}
+		// Merge the sessions that overlap the message's into a single session
+		var kept []*window
+		for _, o := range r.open[key] {
+			if o.start.Before(w.end) && w.start.Before(o.end) {
+				if o.start.Before(w.start) {
+					w.start = o.start
+				}
+				if o.end.After(w.end) {
+					w.end = o.end
+				}
+				w.msgs = append(w.msgs, o.msgs...)
+			} else {
+				kept = append(kept, o)
+			}
+		}
+		r.open[key] = append(kept, w)
+		return []*window{w}
+	}
+
+	slide := s.spec.Slide
+	if s.spec.Type == TumblingWindows {
+		slide = s.spec.Size
+	}
+	var ws []*window
+	for start := t.Truncate(slide); start.Add(s.spec.Size).After(t); start = start.Add(-slide) {
+		end := start.Add(s.spec.Size)
+		if !end.After(r.clock) {
+			// Earlier windows end earlier, so they have closed too
+			break
+		}
+		i := slices.IndexFunc(r.open[key], func(w *window) bool { return w.start.Equal(start) })
+		if i < 0 {
+			r.open[key] = append(r.open[key], &window{key: key, start: start, end: end})
+			i = len(r.open[key]) - 1
+		}
+		ws = append(ws, r.open[key][i])
+	}
+	return ws
+}
+
+// Advances the clock to time t, if it is later, and sends the windows that close. With
+// processing time, also sets a timer for when the next window closes.
+func (s *Window) advance(ctx context.Context, r *windowRun, t time.Time) {
+	if t.After(r.clock) {
+		r.clock = t
+	}
+	s.send(ctx, r, s.closeWindows(r, func(w *window) bool { return !w.end.After(r.clock) }))
+	if s.eventTime != nil {
+		return
+	}
+	if r.timer != nil {
+		r.timer.Stop()
+		r.timer = nil
+	}
+	var next time.Time
+	for _, ws := range r.open {
+		for _, w := range ws {
+			if next.IsZero() || w.end.Before(next) {
+				next = w.end
+			}
+		}
+	}
+	if !next.IsZero() {
+		r.timer = time.NewTimer(time.Until(next))
+	}
+}
+
+// Removes and returns the open windows for which closed returns true, in the order they end.
+func (s *Window) closeWindows(r *windowRun, closed func(*window) bool) []*window {
+	var ws []*window
+	for key, open := range r.open {
+		var kept []*window
+		for _, w := range open {
+			if closed(w) {
+				ws = append(ws, w)
+			} else {
+				kept = append(kept, w)
+			}
+		}
+		if len(kept) == 0 {
+			delete(r.open, key)
+		} else {
+			r.open[key] = kept
+		}
+	}
+	slices.SortFunc(ws, func(a, b *window) int {
+		return cmp.Or(a.end.Compare(b.end), a.start.Compare(b.start), cmp.Compare(a.key, b.key))
+	})
+	return ws
+}
+
+// Reduces and sends closed windows, and traces the outcomes of the messages whose
+// windows have all been sent.
+func (s *Window) send(ctx context.Context, r *windowRun, ws []*window) {
+	for _, w := range ws {
+		// Messages of merged sessions may be out of order
+		slices.SortFunc(w.msgs, func(a, b msg.Msg) int {
+			return cmp.Compare(r.pending[a.ID].seq, r.pending[b.ID].seq)
+		})
+		items := make([]any, len(w.msgs))
+		for i, m := range w.msgs {
+			items[i] = m.Data
+		}
+		result, err := s.call(ctx, items)
+		if err == nil {
+			s.TraceSendMerged("out", w.msgs, map[string]any{
+				"key":    w.key,
+				"start":  w.start.UTC().Format(time.RFC3339Nano),
+				"end":    w.end.UTC().Format(time.RFC3339Nano),
+				"count":  len(items),
+				"result": result,
+			})
+		}
+		for _, m := range w.msgs {
+			p := r.pending[m.ID]
+			if err != nil && p.err == nil {
+				p.err = err
+			}
+			if p.windows--; p.windows > 0 {
+				continue
+			}
+			delete(r.pending, m.ID)
+			if p.err != nil {
+				s.TraceSendError(m, p.err, 1)
+			} else {
+				s.TraceSuccess(m.ID)
+			}
+		}
+	}
+}
+
+// Calls the reducer, turning a panic into an error so that it fails the window's
+// messages rather than restarting the stage and losing its open windows.
+func (s *Window) call(ctx context.Context, items []any) (result any, err error) {
+	defer func() {
+		if pv := recover(); pv != nil {
+			err = fmt.Errorf("window: reducer panic: %v", pv)
+		}
+	}()
+	result, err = s.reduce(ctx, items)
+	if err != nil {
+		return nil, fmt.Errorf("window: reducing: %w", err)
+	}
+	return result, nil
+}
@@ -0,0 +1,180 @@
+package stages
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"testing/synctest"
+	"time"
+
+	"datapotamus.com/internal/flow"
+	"datapotamus.com/internal/flow/msg"
+	"github.com/google/go-cmp/cmp"
+)
+
+// Sends each value through the stage, closes its input, and returns the outputs.
+func runWindow(t *testing.T, s *Window, values ...any) []msg.MsgFrom {
+	t.Helper()
+	go s.Serve(t.Context())
+	go func() {
+		for _, v := range values {
+			s.In() <- msg.New(v).To(msg.NewAddr(s.ID(), "in"))
+		}
+		close(s.In())
+	}()
+	return collect(t, s.Out())
+}
+
+// Returns the data of a window of event times in seconds.
+func win(key string, start, end int64, count int, result any) map[string]any {
+	return map[string]any{
+		"key":    key,
+		"start":  time.Unix(start, 0).UTC().Format(time.RFC3339Nano),
+		"end":    time.Unix(end, 0).UTC().Format(time.RFC3339Nano),
+		"count":  count,
+		"result": result,
+	}
+}
+
+// Returns data for a message by a speaker at an event time in seconds.
+func utterance(speaker string, t int, n int) map[string]any {
+	return map[string]any{"speaker": speaker, "t": t, "n": n}
+}
+
+func TestWindowEventTime(t *testing.T) {
+	tests := []struct {
+		name   string
+		spec   WindowSpec
+		values []any
+		want   []any
+	}{
+		{
+			"tumbling",
+			WindowSpec{Type: TumblingWindows, Size: 10 * time.Second, Key: ".speaker"},
+			[]any{utterance("a", 1, 1), utterance("b", 2, 2), utterance("a", 5, 3), utterance("a", 12, 4), utterance("b", 25, 5)},
+			[]any{
+				win("a", 0, 10, 2, []any{1, 3}),
+				win("b", 0, 10, 1, []any{2}),
+				win("a", 10, 20, 1, []any{4}),
+				win("b", 20, 30, 1, []any{5}),
+			},
+		},
+		{
+			"sliding",
+			WindowSpec{Type: SlidingWindows, Size: 10 * time.Second, Slide: 5 * time.Second},
+			[]any{utterance("a", 1, 1), utterance("a", 7, 2), utterance("a", 12, 3)},
+			[]any{
+				win("", -5, 5, 1, []any{1}),
+				win("", 0, 10, 2, []any{1, 2}),
+				win("", 5, 15, 2, []any{2, 3}),
+				win("", 10, 20, 1, []any{3}),
+			},
+		},
+		{
+			"session",
+			WindowSpec{Type: SessionWindows, Gap: 5 * time.Second, Key: ".speaker"},
+			[]any{utterance("a", 1, 1), utterance("a", 10, 2), utterance("a", 20, 3), utterance("a", 16, 4), utterance("b", 17, 5)},
+			[]any{
+				win("a", 1, 6, 1, []any{1}),
+				win("a", 10, 15, 1, []any{2}),
+				win("b", 17, 22, 1, []any{5}),
+				win("a", 16, 25, 2, []any{3, 4}),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reduce, err := JQReducer("map(.n)", time.Second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tt.spec.EventTime = ".t"
+			s, err := NewWindow(flow.NewBase("w").WithInOut(0), tt.spec, reduce)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []any
+			for _, m := range runWindow(t, s, tt.values...) {
+				got = append(got, m.Data)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("unexpected windows (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestWindowProcessingTime(t *testing.T) {
+	count := func(ctx context.Context, items []any) (any, error) { return len(items), nil }
+	tests := []struct {
+		name string
+		spec WindowSpec
+		want time.Duration // time until the window is sent
+	}{
+		{"tumbling", WindowSpec{Type: TumblingWindows, Size: time.Second}, time.Second},
+		{"session", WindowSpec{Type: SessionWindows, Gap: time.Second}, 1500 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			synctest.Test(t, func(t *testing.T) {
+				s, err := NewWindow(flow.NewBase("w").WithInOut(0), tt.spec, count)
+				if err != nil {
+					t.Fatal(err)
+				}
+				go s.Serve(t.Context())
+
+				start := time.Now()
+				s.In() <- msg.New(1).To(msg.NewAddr("w", "in"))
+				time.Sleep(500 * time.Millisecond)
+				s.In() <- msg.New(2).To(msg.NewAddr("w", "in"))
+				m := <-s.Out()
+				if elapsed := time.Since(start); elapsed != tt.want {
+					t.Errorf("got window after %v, want %v", elapsed, tt.want)
+				}
+				if result := m.Data.(map[string]any)["result"]; result != 2 {
+					t.Errorf("got result %v, want 2", result)
+				}
+			})
+		})
+	}
+}
+
+func TestWindowFailures(t *testing.T) {
+	reduce := func(ctx context.Context, items []any) (any, error) {
+		for _, item := range items {
+			if item.(map[string]any)["n"] == 0 {
+				return nil, errors.New("zero")
+			}
+		}
+		return len(items), nil
+	}
+	spec := WindowSpec{Type: SlidingWindows, Size: 10 * time.Second, Slide: 5 * time.Second, EventTime: ".t"}
+	s, err := NewWindow(flow.NewBase("w").WithInOut(0), spec, reduce)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first message is in windows [-5, 5) and [0, 10), and the second message, which
+	// fails both of its windows, is in [0, 10) and [5, 15). The last message is late.
+	outs := runWindow(t, s, utterance("a", 3, 1), utterance("a", 7, 0), utterance("a", 30, 1), utterance("a", 1, 1))
+
+	var windows, failed []any
+	for _, m := range outs {
+		if f, ok := m.Data.(flow.FailedMsg); ok {
+			failed = append(failed, f.Error.Error())
+		} else {
+			windows = append(windows, m.Data.(map[string]any)["start"])
+		}
+	}
+	wantWindows := []any{"1969-12-31T23:59:55Z", "1970-01-01T00:00:25Z", "1970-01-01T00:00:30Z"}
+	if diff := cmp.Diff(wantWindows, windows); diff != "" {
+		t.Errorf("unexpected window starts (-want +got):\n%s", diff)
+	}
+	wantFailed := []any{
+		"window: reducing: zero",
+		"window: reducing: zero",
+		"window: message at 1970-01-01T00:00:01Z arrived after its windows closed",
+	}
+	if diff := cmp.Diff(wantFailed, failed); diff != "" {
+		t.Errorf("unexpected failures (-want +got):\n%s", diff)
+	}
+}